@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
@@ -11,12 +12,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sync"
 	"time"
 
-	"github.com/cloudflare/cfssl/log"
 	"github.com/cloudflare/gokeyless/protocol"
 	"github.com/lziest/ttlcache"
 )
@@ -24,24 +27,392 @@ import (
 const (
 	remoteCacheSize = 512
 	remoteCacheTTL  = time.Minute * 5
+	dnsCacheSize    = 512
+
+	defaultDNSNegativeTTL   = 5 * time.Second
+	defaultHealthJitter     = 0.2
+	maxHealthJitter         = 0.99
+	defaultBreakerCooldown  = 30 * time.Second
+	defaultDialBackoff      = 100 * time.Millisecond
+	defaultValidateTimeout  = time.Second
+	defaultSessionCacheSize = 64
+	defaultTCPKeepAlive     = 30 * time.Second
+	defaultMaxReconnect     = 10 * time.Second
+	// maxDialBackoff caps the backoff between dial retries.
+	maxDialBackoff = 10 * time.Second
 )
 
 // Client is a Keyless Client capable of connecting to servers and performing keyless operations.
 type Client struct {
 	// Config is initialized with the client auth configuration used for communicating with keyless servers.
 	Config *tls.Config
-	// Dialer used to manage connections.
+	// SessionCacheSize is the number of TLS sessions kept for resumption
+	// if Config has no ClientSessionCache, in which case the sessions of
+	// all servers are kept in a cache shared by the client, keyed by
+	// server address and name. Zero means 64; a negative value disables
+	// resumption.
+	SessionCacheSize int
+	// VerifyServer, if set, is called once the TLS handshake with a server
+	// completes, after the verification of its certificate chain by Config,
+	// e.g. to pin the certificate or public key the server presents. If it
+	// returns an error, the connection is closed and the dial fails with a
+	// *VerificationError.
+	VerifyServer func(cs tls.ConnectionState, remote Remote) error
+	// Dialer used to manage connections. Connections to servers and
+	// proxies have TCP_NODELAY set, as Go does by default, which suits the
+	// small, latency-sensitive messages of the keyless protocol; Dialer's
+	// Control hook may set further socket options.
 	Dialer *net.Dialer
+	// TCPKeepAlive is the keepalive period of connections to servers and
+	// proxies if the KeepAlive of Dialer is zero, so that a server which
+	// went away silently is detected even between health checks. Zero
+	// means 30 seconds; a negative value disables keepalives.
+	TCPKeepAlive time.Duration
 	// Resolvers is an ordered list of DNS servers used to look up remote servers.
+	// Use SetResolvers to change it while the client is in use, or
+	// LoadSystemResolvers to use those of the system.
 	Resolvers []string
+	// Resolve, if set, resolves the host names of servers in place of
+	// DoHEndpoint and Resolvers, e.g. to use the resolver of a service
+	// mesh, or deterministic addresses in tests. Its answers are cached as
+	// those of the system resolver are, see DNSCacheTTL.
+	Resolve func(host string) ([]net.IP, error)
+	// SearchDomains are the domains which short host names are looked up
+	// in, with DoHEndpoint and Resolvers, as the search list of
+	// resolv.conf(5) is: a name with fewer than NDots dots is tried with
+	// each domain appended, in order, before it's tried as is, and other
+	// names are tried as is first. Names ending in a dot are only tried as
+	// is. The system resolver, tried last, applies its own search list.
+	SearchDomains []string
+	// NDots is the number of dots a host name needs to be tried as is
+	// before SearchDomains. Zero means 1.
+	NDots int
+	// ServerNameForIP, if set, is consulted for the TLS server name of each
+	// address that LookupServer and LookupServerWithName resolve a host to,
+	// for deployments which front a distinct certificate per node behind a
+	// shared DNS name. If it returns "", the server name given to the
+	// lookup is used.
+	ServerNameForIP func(ip net.IP) string
+	// DNSCacheTTL bounds how long resolved addresses are cached. When zero,
+	// answers are cached for the smallest TTL of the returned records; when
+	// positive, that TTL is additionally capped at DNSCacheTTL (which is also
+	// used for answers from the system resolver, whose TTL is unknown); when
+	// negative, caching is disabled, including of failed lookups.
+	DNSCacheTTL time.Duration
+	// DNSNegativeTTL is how long a failed lookup is cached, so that lookups
+	// of a host which doesn't resolve don't query every resolver again
+	// during an outage. The A and AAAA queries are cached on their own, so
+	// that only the one which failed is skipped. Zero means 5 seconds; a
+	// negative value disables caching of failures.
+	DNSNegativeTTL time.Duration
+	// DNSTimeout bounds each query to one of Resolvers, including dialing
+	// it. A resolver which times out is skipped in favor of the next one.
+	// Zero means the defaults of the dns package, 2 seconds each for
+	// dialing, writing the query and reading the answer.
+	DNSTimeout time.Duration
+	// LinkLocalZone is the zone, i.e. the network interface such as
+	// "eth0", through which the IPv6 link-local addresses (fe80::/10) that
+	// servers resolve to are dialed, since such an address can't be dialed
+	// without one. If it's unset, link-local addresses resolved are
+	// skipped with a warning. Other addresses are unaffected.
+	LinkLocalZone string
+	// IPPreference selects which address families of resolved host names
+	// are dialed, and which are tried first. The default is IPBoth.
+	IPPreference IPPreference
+	// DoHEndpoint is the URL of a DNS-over-HTTPS (RFC 8484) server used to
+	// look up remote servers before trying Resolvers, e.g.
+	// "https://dns.example.com/dns-query". The HTTPS connections are made
+	// with DoHTLSConfig as of the first query, and are reused by later
+	// queries. If the query fails, Resolvers are used as usual.
+	DoHEndpoint string
+	// DoHTLSConfig is the TLS config of the connections to DoHEndpoint. If
+	// it's nil, the server is verified with the system roots and no client
+	// certificate is offered. Config isn't used, so that the keyserver CA
+	// and the client certificate of the keyless connections aren't imposed
+	// on the DNS provider.
+	DoHTLSConfig *tls.Config
+	// DoHTimeout bounds each DNS-over-HTTPS query. Zero means 5 seconds.
+	DoHTimeout time.Duration
+	// DialTimeout, if positive, bounds each dial to a server, including the
+	// TLS handshake, regardless of the Timeout of Dialer. This allows
+	// keeping Dialer's other settings, e.g. a long KeepAlive, while
+	// bounding the time spent connecting.
+	DialTimeout time.Duration
+	// HandshakeTimeout, if positive, bounds the TLS handshake of each dial
+	// on its own, once connected, so that a server which accepts
+	// connections but stalls the handshake, e.g. behind an overloaded HSM,
+	// is given up on sooner than DialTimeout allows.
+	HandshakeTimeout time.Duration
+	// DialFunc, if set, connects to the server at addr on network in place
+	// of Dialer and Proxy, e.g. to use an in-memory transport in tests or
+	// to instrument connections. If it returns a *tls.Conn, its handshake
+	// is completed as usual, if it isn't yet, and checked by VerifyServer.
+	// Other connections with a ConnectionState method, e.g. wrapping a
+	// *tls.Conn whose handshake is complete, are checked by VerifyServer as
+	// they are; connections without one are used without TLS, which is an
+	// error if VerifyServer is set. It's given the TLS config the
+	// connection would be made with, and isn't bounded by DialTimeout
+	// before the handshake.
+	DialFunc func(network, addr string, config *tls.Config) (net.Conn, error)
+	// DialContextFunc is like DialFunc, and takes precedence over it, but
+	// is given the context of the dial, which is done once the dial is
+	// canceled or DialTimeout elapsed.
+	DialContextFunc func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error)
+	// Proxy, if set, is the URL of a proxy through which servers are
+	// dialed, for clients which can only reach them through an egress
+	// proxy. The schemes "socks5" (or "socks5h") and "http", for an HTTP
+	// proxy supporting the CONNECT method, are supported, with credentials
+	// taken from the URL's user info. The TLS handshake with the server is
+	// made through the tunnel, so the proxy can't see the traffic.
+	Proxy *url.URL
+	// ReResolveOnFailure makes the Groups returned by LookupServer and
+	// LookupServerWithName look up their host name again once none of
+	// their members can be dialed, e.g. because the servers behind it were
+	// replaced, and replace their members with the servers found. Members
+	// found again keep their state. Answers are cached as usual, see
+	// DNSCacheTTL, so new addresses are only picked up once the old ones
+	// expire.
+	ReResolveOnFailure bool
+	// ReconnectBackoff is how long a reconnect to a server waits after the
+	// server closed a connection which wasn't stable, i.e. which lasted
+	// less than MaxReconnectBackoff, so that a server which keeps closing
+	// connections doesn't put the client in a tight reconnect loop. The
+	// wait doubles with each such connection in a row, up to
+	// MaxReconnectBackoff, and is reset by a stable one. Zero, the
+	// default, disables the backoff.
+	ReconnectBackoff time.Duration
+	// MaxReconnectBackoff caps the wait of ReconnectBackoff. Zero means 10
+	// seconds.
+	MaxReconnectBackoff time.Duration
+	// MaxRemotes, if positive, caps the number of servers of the Groups
+	// made by LookupServer, LookupServerWithName and LookupServerSRV, so
+	// that a bogus answer listing hundreds of servers doesn't have every
+	// one of them probed by each health check. The first addresses
+	// resolved, or the SRV targets of the best priorities, are kept and
+	// the rest ignored, with a warning.
+	MaxRemotes int
+	// MaxInflightPerConn, if positive, is the maximum number of operations
+	// in flight on a single connection. Operations over the limit wait for
+	// one to complete, within their timeout, so that a server isn't sent
+	// more requests at once than it can take.
+	MaxInflightPerConn int
+	// LatencyPercentiles makes Groups keep a histogram of the ping
+	// latencies of each member by PingAll, in addition to their moving
+	// average, so that Group.Stats reports their percentiles and a
+	// LatencyPolicy may rank members by one of them. The histogram follows
+	// roughly the last thousand pings of a member.
+	LatencyPercentiles bool
 	// DefaultRemote is a default remote to dial and register keys to.
 	// TODO: DefaultRemote needs to deal with default server DNS changes automatically.
 	// NOTE: For now DefaultRemote is very static to save dns lookup overhead
 	DefaultRemote Remote
-	// Blacklist is a list of addresses that this client won't dial.
+	// Blacklist is a list of addresses that this client won't dial. See AddrSet
+	// for how addresses are matched.
 	Blacklist *AddrSet
+	// PreferredZone, if set, is the zone of the servers a Group dials
+	// first, as given to NewServerInZone. Servers in other zones are only
+	// dialed once none in the preferred zone can be.
+	PreferredZone string
+	// MaxConnsPerRemote is the maximum number of connections kept open to a
+	// single server. Dial prefers an idle connection, opens a new one while
+	// below the limit, and otherwise shares the least-loaded connection.
+	// Values below 1 are treated as 1.
+	MaxConnsPerRemote int
+	// MaxConcurrentDials, if positive, bounds the number of dials to
+	// servers in progress at once across the client, from connecting up to
+	// the end of the TLS handshake, e.g. so that recovering from an outage
+	// of many servers doesn't exhaust file descriptors or spike the CPU.
+	// Dials over the limit wait for a slot until their context is done or
+	// DialTimeout elapses. It must be set before the client is used.
+	MaxConcurrentDials int
+	// ValidateAfter, if positive, is how long a pooled connection may be
+	// idle before Dial pings it prior to handing it out. If the ping fails,
+	// e.g. because the server went away without closing the connection,
+	// the connection is closed and Dial reconnects, instead of the next
+	// operation failing. The ping is bounded by DialTimeout, or by one
+	// second if it's unset.
+	ValidateAfter time.Duration
+	// MaxConnLifetime, if positive, is how long a connection to a server is
+	// reused for. Once exceeded, the next Dial opens a new connection, and
+	// the old one is closed as soon as no caller is using it, so that
+	// clients rebalance behind a changing load balancer. Zero means
+	// connections are reused for as long as they're healthy.
+	MaxConnLifetime time.Duration
+	// MaxIdleTime, if positive, is how long a connection to a member of a
+	// Group is kept open without being used. Idle connections are closed by
+	// a goroutine of the Group, started by its first dial and stopped by
+	// Group.Close, and the next Dial reconnects.
+	MaxIdleTime time.Duration
+	// PerRemoteRate, if positive, caps the rate of dials to any single
+	// server, in dials per second, to protect servers from a misbehaving
+	// client. A Group dials other members in place of those over the limit,
+	// and fails with ErrRateLimited if all of them are. Health check pings
+	// count toward the limit but aren't held against a server when it's
+	// exceeded.
+	PerRemoteRate float64
+	// PerRemoteBurst is the number of dials to a single server allowed in
+	// a burst above PerRemoteRate. Values below 1 are treated as 1.
+	PerRemoteBurst int
+	// BreakerThreshold is the number of consecutive dial or ping failures
+	// after which a Group stops dialing a member for BreakerCooldown. Once
+	// the cooldown elapses, a single trial dial is allowed; a success closes
+	// the breaker again. Zero disables the circuit breaker.
+	BreakerThreshold int
+	// ProtocolBreakerThreshold, if positive, is the number of consecutive
+	// failures with an error from the server, see protocol.Error, which opens
+	// the circuit breaker of a member, and BreakerThreshold then only counts
+	// consecutive transport failures, such as failed dials and timeouts. A
+	// server rejecting operations is still reachable, so e.g. a higher
+	// threshold keeps it in rotation longer than an unreachable one. Zero
+	// counts both kinds of failures toward BreakerThreshold.
+	ProtocolBreakerThreshold int
+	// BreakerCooldown is how long an open circuit breaker rejects dials.
+	// Zero means 30 seconds.
+	BreakerCooldown time.Duration
+	// ProbeConcurrency is the number of remotes a Group probes at once
+	// during the measurement sweeps it runs in the background. Values below
+	// 1 are treated as 1.
+	ProbeConcurrency int
+	// SingleMemberFastPath makes a Group with a single member dial it as
+	// the bare server would be dialed: its Policy isn't consulted, and no
+	// background probe sweep is started, so the only dials are those of the
+	// callers, served by the pooled connection. Failures still count toward
+	// the circuit breaker and Group.Stats.
+	SingleMemberFastPath bool
+	// InitialProbeTimeout, if positive, makes LookupServer and its variants
+	// warm the Groups they return, as Group.WarmupWithin does, so that the
+	// first dials are routed by measured latency. The lookups then take up
+	// to that long more; members which don't answer in time are measured as
+	// they do. Zero leaves the Groups unmeasured until their first sweep.
+	InitialProbeTimeout time.Duration
+	// PingPayload is the payload of the health check pings of a Group,
+	// which the server must echo back for the ping to succeed. Nil means an
+	// empty payload. It's unused if ProbeOp is set.
+	PingPayload []byte
+	// ProbeOp, if set, is the operation whose duration is measured by the
+	// health checks of a Group in place of a ping, e.g. a signature with a
+	// key held in an HSM, so that members are ranked by the latency of
+	// real operations. An error counts as a failed health check.
+	ProbeOp func(*Conn) error
+	// PingTimeout, if positive, bounds each health check ping, or ProbeOp,
+	// of a Group. A probe which doesn't complete in time is abandoned and
+	// counted as a failure, so that a wedged server doesn't stall the
+	// sweep. Zero means probes aren't bounded.
+	PingTimeout time.Duration
+	// ProbeRate, if positive, caps the rate of the health check probes of
+	// all the Groups dialed with the client combined, in probes per
+	// second, so that the sweeps of many Groups don't add up to bursts of
+	// probes against the servers. Probes over the limit wait for their
+	// turn, which counts toward the timeout of Group.WarmupWithin.
+	// Keepalive pings aren't limited.
+	ProbeRate float64
+	// ProbeBurst is the number of probes allowed in a burst above
+	// ProbeRate. Values below 1 are treated as 1.
+	ProbeBurst int
+	// HealthCheckJitter randomizes each interval between the health check
+	// sweeps of a Group, and between keepalive pings, by up to this
+	// fraction in either direction, so that clients started together, e.g.
+	// by a fleet-wide deploy, don't probe servers in lockstep. Zero means
+	// 0.2, i.e. intervals vary by up to 20%; a negative value disables
+	// jitter. Values of 1 or more are treated as 0.99.
+	HealthCheckJitter float64
+	// HealthCheckMaxInterval, if positive, makes the health check started
+	// by Group.StartHealthCheck adaptive: rather than sweeping every member
+	// each interval, it probes each member on its own schedule, doubling
+	// the interval of a member after each successful probe up to
+	// HealthCheckMaxInterval, and dropping it to HealthCheckMinInterval
+	// after a failure, so that stable servers are probed less and failing
+	// ones are watched closely until they recover.
+	HealthCheckMaxInterval time.Duration
+	// HealthCheckMinInterval is the interval at which members are probed
+	// after a failure if HealthCheckMaxInterval is set. Zero means the
+	// interval given to StartHealthCheck.
+	HealthCheckMinInterval time.Duration
+	// KeepaliveInterval, if positive, is how often idle connections are
+	// pinged so that intermediaries such as NATs and load balancers don't
+	// drop them for inactivity. A connection whose ping fails, or isn't
+	// answered within the interval, is closed, and the next Dial reconnects.
+	KeepaliveInterval time.Duration
+	// DialRetries is the number of times a Group retries when none of its
+	// members could be dialed, e.g. during a rolling restart. Retries are
+	// spaced by an exponential backoff with jitter, starting at DialBackoff,
+	// and stop once the dial's context is done.
+	DialRetries int
+	// DialBackoff is the base interval of the backoff between dial retries.
+	// Zero means 100 milliseconds.
+	DialBackoff time.Duration
+	// LatencyAlpha is the smoothing factor of the default LatencyPolicy of a
+	// Group; see LatencyPolicy.Alpha.
+	LatencyAlpha float64
+	// LatencyResetAfter is the number of consecutive failures after which
+	// the default LatencyPolicy of a Group discards the latency of a
+	// member; see LatencyPolicy.ResetAfter.
+	LatencyResetAfter int
+	// Logger, if set, receives the log messages of the client, which are
+	// otherwise logged with the cfssl log package. Messages which aren't
+	// tied to a client, e.g. those of AddrSet, are still logged with the
+	// cfssl log package.
+	Logger Logger
+	// Metrics, if set, receives events about dials and health checks.
+	Metrics Metrics
+	// OnConnClose, if set, is called once each connection dialed by the
+	// client is closed, with the server it was dialed to and one of the
+	// CloseReason constants, e.g. to account for the resources of wrapped
+	// connections. It's called from the goroutine closing the connection,
+	// without locks held, so it mustn't block for long.
+	OnConnClose func(remote Remote, conn *Conn, reason string)
+	// Tracer, if set, starts spans around DNS lookups, dials and health
+	// check pings. Dials are traced as children of the span in the context
+	// given to DialContext.
+	Tracer Tracer
+	// OnStateChange, if set, is called whenever a member of a Group becomes
+	// unhealthy after a failed dial or ping, or healthy again after a
+	// successful one. addr is nil and serverName empty for members which
+	// aren't single servers. It's called without any lock held, possibly
+	// concurrently, so it may use the Client but must be safe for
+	// concurrent use.
+	OnStateChange func(addr net.Addr, serverName string, healthy bool)
+	// LatencyThreshold, if positive, is the moving average of latencies
+	// above which members of Groups are reported as slow, with a
+	// HealthEvent of kind LatencyAbove, and then LatencyBelow once they
+	// recover. See SubscribeHealth.
+	LatencyThreshold time.Duration
 	// remoteCache maps all known server names to corresponding remote.
 	remoteCache *ttlcache.LRU
+	// dnsCache maps host names to their resolved addresses.
+	dnsCache *ttlcache.LRU
+	// sessionCache is the ClientSessionCache used if Config has none.
+	sessionCache     tls.ClientSessionCache
+	sessionCacheOnce sync.Once
+	// dialSlots holds a value for each dial in progress, up to
+	// MaxConcurrentDials.
+	dialSlots     chan struct{}
+	dialSlotsOnce sync.Once
+	// dohTransport is the HTTP transport of DoHEndpoint lookups, shared so
+	// that they reuse its connections.
+	dohTransport     *http.Transport
+	dohTransportOnce sync.Once
+	// latencyAlphaOnce checks LatencyAlpha on the first use of the default
+	// LatencyPolicy.
+	latencyAlphaOnce sync.Once
+	// rateLimits maps server addresses to the *tokenBucket enforcing
+	// PerRemoteRate.
+	rateLimits addrCache
+	// probeLimit is the token bucket enforcing ProbeRate.
+	probeLimit tokenBucket
+	// reconnects maps server addresses to the *reconnectBackoff enforcing
+	// ReconnectBackoff.
+	reconnects addrCache
+	// health holds the channels of SubscribeHealth.
+	health healthSubscribers
+	// resolversMu guards Resolvers against SetResolvers.
+	resolversMu sync.RWMutex
+	// cert is the client certificate set by SetClientCertificate, and
+	// certGeneration the number of times it was set, which scopes the
+	// session cache so that sessions of an old certificate aren't resumed.
+	cert           *tls.Certificate
+	certGeneration int
+	certMu         sync.RWMutex
 }
 
 // NewClient prepares a TLS client capable of connecting to keyservers.
@@ -58,9 +429,113 @@ func NewClient(cert tls.Certificate, keyserverCA *x509.CertPool) *Client {
 		Dialer:      &net.Dialer{},
 		Blacklist:   &AddrSet{},
 		remoteCache: ttlcache.NewLRU(remoteCacheSize, remoteCacheTTL, nil),
+		dnsCache:    ttlcache.NewLRU(dnsCacheSize, 0, nil),
 	}
 }
 
+// SetResolvers replaces the DNS servers used to look up remote servers, e.g.
+// to fail over to backup resolvers, while lookups may be in flight. Lookups
+// already in flight keep using the old list, and answers cached from it are
+// kept until they expire.
+func (c *Client) SetResolvers(resolvers []string) {
+	resolvers = append([]string(nil), resolvers...)
+	c.resolversMu.Lock()
+	c.Resolvers = resolvers
+	c.resolversMu.Unlock()
+}
+
+// SetClientCertificate replaces the certificate the client authenticates
+// with to servers, e.g. before the current one expires. Connections already
+// established are kept, and only the handshakes of new ones use cert, so
+// that rotating the certificate doesn't make every connection reconnect at
+// once. Sessions established with the old certificate aren't resumed. Once
+// set, cert takes precedence over the Certificates and GetClientCertificate
+// of Config.
+func (c *Client) SetClientCertificate(cert tls.Certificate) {
+	c.certMu.Lock()
+	c.cert = &cert
+	c.certGeneration++
+	c.certMu.Unlock()
+}
+
+// clientCertificate returns the certificate set by SetClientCertificate, if
+// any, and how many times it was set.
+func (c *Client) clientCertificate() (*tls.Certificate, int) {
+	c.certMu.RLock()
+	defer c.certMu.RUnlock()
+	return c.cert, c.certGeneration
+}
+
+// resolvers returns a snapshot of c.Resolvers.
+func (c *Client) resolvers() []string {
+	c.resolversMu.RLock()
+	defer c.resolversMu.RUnlock()
+	return c.Resolvers
+}
+
+func (c *Client) breakerCooldown() time.Duration {
+	if c.BreakerCooldown == 0 {
+		return defaultBreakerCooldown
+	}
+	return c.BreakerCooldown
+}
+
+func (c *Client) dnsNegativeTTL() time.Duration {
+	if c.DNSNegativeTTL == 0 {
+		return defaultDNSNegativeTTL
+	}
+	return c.DNSNegativeTTL
+}
+
+func (c *Client) healthCheckJitter() float64 {
+	switch {
+	case c.HealthCheckJitter == 0:
+		return defaultHealthJitter
+	case c.HealthCheckJitter < 0:
+		return 0
+	case c.HealthCheckJitter > maxHealthJitter:
+		return maxHealthJitter
+	}
+	return c.HealthCheckJitter
+}
+
+func (c *Client) validateTimeout() time.Duration {
+	if c.DialTimeout > 0 {
+		return c.DialTimeout
+	}
+	return defaultValidateTimeout
+}
+
+// netDialer returns a copy of c.Dialer with the keepalive period of
+// c.TCPKeepAlive applied.
+func (c *Client) netDialer() *net.Dialer {
+	var d net.Dialer
+	if c.Dialer != nil {
+		d = *c.Dialer
+	}
+	if d.KeepAlive == 0 {
+		d.KeepAlive = c.TCPKeepAlive
+		if d.KeepAlive == 0 {
+			d.KeepAlive = defaultTCPKeepAlive
+		}
+	}
+	return &d
+}
+
+func (c *Client) maxReconnectBackoff() time.Duration {
+	if c.MaxReconnectBackoff <= 0 {
+		return defaultMaxReconnect
+	}
+	return c.MaxReconnectBackoff
+}
+
+func (c *Client) dialBackoff() time.Duration {
+	if c.DialBackoff == 0 {
+		return defaultDialBackoff
+	}
+	return c.DialBackoff
+}
+
 // NewClientFromFile reads certificate, key, and CA files in order to create a Server.
 func NewClientFromFile(certFile, keyFile, caFile string) (*Client, error) {
 	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
@@ -81,48 +556,87 @@ func NewClientFromFile(certFile, keyFile, caFile string) (*Client, error) {
 	return NewClient(cert, keyserverCA), nil
 }
 
-// An AddrSet is a set of addresses.
+// timeNow returns the current time. Tests replace it to fake the clock.
+var timeNow = time.Now
+
+// An AddrSet is a set of addresses. It is safe for concurrent use.
+//
+// Addresses are matched by IP and port. An entry added with port 0 matches
+// its IP on any port. IPv4 addresses match their IPv4-mapped IPv6 form, e.g.
+// 1.2.3.4 and ::ffff:1.2.3.4 are the same address, and the zone of scoped
+// IPv6 addresses is ignored.
 type AddrSet struct {
-	addrs []*net.TCPAddr
+	sync.Mutex
+	addrs       []*net.TCPAddr
+	addrExpires []time.Time
 
-	subnets []*net.IPNet
-	snPorts []int
+	subnets   []*net.IPNet
+	snPorts   []int
+	snExpires []time.Time
 }
 
-// Add adds an addr to the set of addresses.
+// Add adds an addr to the set of addresses, on the given port, or on any port
+// if port is 0.
 func (as *AddrSet) Add(addr net.Addr, port int) {
+	as.AddWithExpiry(addr, port, 0)
+}
+
+// AddIP adds ip to the set of addresses on any port.
+func (as *AddrSet) AddIP(ip net.IP) {
+	as.Add(&net.IPAddr{IP: ip}, 0)
+}
+
+// AddWithExpiry adds an addr to the set of addresses for the duration ttl,
+// after which it's removed again. A ttl of zero never expires.
+func (as *AddrSet) AddWithExpiry(addr net.Addr, port int, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = timeNow().Add(ttl)
+	}
+
+	as.Lock()
+	defer as.Unlock()
 	switch t := addr.(type) {
 	case *net.TCPAddr:
-		as.addrs = append(as.addrs, &net.TCPAddr{IP: t.IP, Port: port})
+		as.addrs = append(as.addrs, &net.TCPAddr{IP: normalizeIP(t.IP), Port: port})
+		as.addrExpires = append(as.addrExpires, expires)
 	case *net.IPAddr:
-		as.addrs = append(as.addrs, &net.TCPAddr{IP: t.IP, Port: port})
+		as.addrs = append(as.addrs, &net.TCPAddr{IP: normalizeIP(t.IP), Port: port})
+		as.addrExpires = append(as.addrExpires, expires)
 	case *net.IPNet:
-		as.subnets = append(as.subnets, t)
+		as.subnets = append(as.subnets, normalizeIPNet(t))
 		as.snPorts = append(as.snPorts, port)
+		as.snExpires = append(as.snExpires, expires)
 
 	default:
-		log.Debugf("silently ignoring unexpected address type: %T", addr)
+		defaultLogger.Debugf("silently ignoring unexpected address type: %T", addr)
 		return
 	}
 
-	log.Debugf("add to blacklist addr set: %s", addr)
+	defaultLogger.Debugf("add to blacklist addr set: %s", addr)
 }
 
-// Contains determines if an addr belongs to the set of addresses.
+// Contains determines if an addr belongs to the set of addresses. Expired
+// addresses are removed from the set.
 func (as *AddrSet) Contains(addr net.Addr) bool {
 	t, ok := addr.(*net.TCPAddr)
 	if !ok {
 		return false
 	}
+	ip := normalizeIP(t.IP)
+
+	as.Lock()
+	defer as.Unlock()
+	as.prune()
 
 	for _, cand := range as.addrs {
-		if t.Port == cand.Port && t.IP.Equal(cand.IP) {
+		if portMatches(cand.Port, t.Port) && ip.Equal(cand.IP) {
 			return true
 		}
 	}
 
 	for i, sn := range as.subnets {
-		if t.Port == as.snPorts[i] && sn.Contains(t.IP) {
+		if portMatches(as.snPorts[i], t.Port) && sn.Contains(ip) {
 			return true
 		}
 	}
@@ -130,6 +644,57 @@ func (as *AddrSet) Contains(addr net.Addr) bool {
 	return false
 }
 
+// portMatches reports whether an entry of an AddrSet on port matches an
+// address on addrPort.
+func portMatches(port, addrPort int) bool {
+	return port == 0 || port == addrPort
+}
+
+// normalizeIP returns the 4-byte form of ip if it's an IPv4 address,
+// including an IPv4-mapped IPv6 address, and ip otherwise.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// normalizeIPNet returns the IPv4 form of n if it's a subnet of IPv4-mapped
+// IPv6 addresses, e.g. ::ffff:10.0.0.0/104 for 10.0.0.0/8, and n otherwise.
+func normalizeIPNet(n *net.IPNet) *net.IPNet {
+	ones, bits := n.Mask.Size()
+	if ip4 := n.IP.To4(); ip4 != nil && bits == 8*net.IPv6len && ones >= 96 {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+	}
+	return n
+}
+
+// prune removes expired addresses. as must be locked.
+func (as *AddrSet) prune() {
+	now := timeNow()
+	expired := func(expires time.Time) bool {
+		return !expires.IsZero() && !now.Before(expires)
+	}
+
+	var n int
+	for i, cand := range as.addrs {
+		if !expired(as.addrExpires[i]) {
+			as.addrs[n], as.addrExpires[n] = cand, as.addrExpires[i]
+			n++
+		}
+	}
+	as.addrs, as.addrExpires = as.addrs[:n], as.addrExpires[:n]
+
+	n = 0
+	for i, sn := range as.subnets {
+		if !expired(as.snExpires[i]) {
+			as.subnets[n], as.snPorts[n], as.snExpires[n] = sn, as.snPorts[i], as.snExpires[i]
+			n++
+		}
+	}
+	as.subnets, as.snPorts, as.snExpires = as.subnets[:n], as.snPorts[:n], as.snExpires[:n]
+}
+
 // PopulateBlacklistFromHostname populates the client blacklist using an hostname.
 // All ips resolved from that hostname, appended with port are blacklisted.
 func (c *Client) PopulateBlacklistFromHostname(host string, port int) {
@@ -137,7 +702,7 @@ func (c *Client) PopulateBlacklistFromHostname(host string, port int) {
 	if host == "" {
 		return
 	}
-	if ips, err := LookupIPs(c.Resolvers, host); err == nil {
+	if ips, err := c.lookupIPs(context.Background(), host); err == nil {
 		for _, ip := range ips {
 			c.Blacklist.Add(&net.IPAddr{IP: ip}, port)
 		}
@@ -175,12 +740,12 @@ func (c *Client) getRemote(server string) (Remote, error) {
 		if r, ok := v.(Remote); ok {
 			return r, nil
 		}
-		log.Error("failed to convert cached remote")
+		c.logger().Errorf("failed to convert cached remote")
 	}
 
 	r, err := c.LookupServer(server)
 	if err != nil {
-		log.Error(err)
+		c.logger().Errorf("%v", err)
 		return nil, err
 	}
 	c.remoteCache.Set(server, r, 0) // use default timeout
@@ -301,7 +866,7 @@ func (c *Client) ScanDir(server, dir string, LoadPubKey func([]byte) (crypto.Pub
 		isPubKey := pubkeyExt.MatchString(info.Name())
 		isCert := crtExt.MatchString(info.Name())
 		if !info.IsDir() && (isPubKey || isCert) {
-			log.Infof("Loading %s...\n", path)
+			c.logger().Infof("Loading %s...\n", path)
 
 			in, err := ioutil.ReadFile(path)
 			if err != nil {
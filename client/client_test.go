@@ -3,6 +3,7 @@ package client
 import (
 	"net"
 	"testing"
+	"time"
 )
 
 func TestAddrSet(t *testing.T) {
@@ -32,3 +33,76 @@ func TestAddrSet(t *testing.T) {
 		t.Fatal("doesn't contain address in subnet")
 	}
 }
+
+func TestAddrSetMatching(t *testing.T) {
+	as := &AddrSet{}
+	as.Add(&net.TCPAddr{IP: net.ParseIP("1.2.3.4")}, 2407)
+	as.AddIP(net.ParseIP("::ffff:5.6.7.8"))
+	as.AddIP(net.ParseIP("2001:db8::1"))
+	as.Add(&net.IPNet{IP: net.ParseIP("::ffff:10.0.0.0"), Mask: net.CIDRMask(104, 128)}, 2407)
+
+	for _, tc := range []struct {
+		addr     *net.TCPAddr
+		contains bool
+	}{
+		// entries with a port only match that port
+		{&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 2407}, true},
+		{&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 2408}, false},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:1.2.3.4"), Port: 2407}, true},
+		// AddIP matches any port, in either IPv4 form
+		{&net.TCPAddr{IP: net.IPv4(5, 6, 7, 8).To4(), Port: 2407}, true},
+		{&net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 443}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 2407}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 2407, Zone: "eth0"}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2407}, false},
+		// an IPv4-mapped subnet matches IPv4 addresses
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 2407}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 2408}, false},
+		{&net.TCPAddr{IP: net.ParseIP("11.1.2.3"), Port: 2407}, false},
+	} {
+		if got := as.Contains(tc.addr); got != tc.contains {
+			t.Errorf("Contains(%s) = %v, expected %v", tc.addr, got, tc.contains)
+		}
+	}
+}
+
+func TestAddrSetExpiry(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	addr := newTestServer(t)
+	cl := newTestClient(t)
+	r := NewServer(addr, "localhost")
+	cl.Blacklist.AddWithExpiry(addr, addr.(*net.TCPAddr).Port, time.Minute)
+	cl.Blacklist.AddWithExpiry(&net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}, 2407, 2*time.Minute)
+	cl.Blacklist.Add(&net.IPAddr{IP: net.IPv4(1, 1, 1, 1)}, 2407)
+
+	if _, err := r.Dial(cl); err == nil {
+		t.Fatal("dialed blacklisted address")
+	}
+
+	now = now.Add(time.Minute)
+	if cl.Blacklist.Contains(addr) {
+		t.Fatal("contains expired address")
+	}
+	if !cl.Blacklist.Contains(&net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 2407}) {
+		t.Fatal("doesn't contain subnet that hasn't expired")
+	}
+	conn, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal("expired address not dialable:", err)
+	}
+	conn.Close()
+
+	now = now.Add(time.Minute)
+	if cl.Blacklist.Contains(&net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 2407}) {
+		t.Fatal("contains expired subnet")
+	}
+	if !cl.Blacklist.Contains(&net.TCPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 2407}) {
+		t.Fatal("address without expiry was removed")
+	}
+	if len(cl.Blacklist.addrs) != 1 || len(cl.Blacklist.subnets) != 0 {
+		t.Fatal("expired entries were not pruned")
+	}
+}
@@ -0,0 +1,648 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// An IPPreference filters and orders the addresses a host name resolves to.
+type IPPreference int
+
+const (
+	// IPBoth keeps all addresses, in the order they were resolved.
+	IPBoth IPPreference = iota
+	// IPPreferV4 keeps all addresses, IPv4 first.
+	IPPreferV4
+	// IPPreferV6 keeps all addresses, IPv6 first.
+	IPPreferV6
+	// IPV4Only drops IPv6 addresses.
+	IPV4Only
+	// IPV6Only drops IPv4 addresses.
+	IPV6Only
+)
+
+// apply returns the addresses of ips selected by p, in order of preference.
+func (p IPPreference) apply(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch p {
+	case IPPreferV4:
+		return append(v4, v6...)
+	case IPPreferV6:
+		return append(v6, v4...)
+	case IPV4Only:
+		return v4
+	case IPV6Only:
+		return v6
+	}
+	return ips
+}
+
+// sortIPs returns ips without duplicates, IPv4 addresses first and then in
+// byte order, so that the same answers make the same servers in the same
+// order whichever resolvers they came from and however they were shuffled.
+func sortIPs(ips []net.IP) []net.IP {
+	seen := make(map[string]bool)
+	var sorted []net.IP
+	for _, ip := range ips {
+		ip = normalizeIP(ip)
+		if seen[string(ip)] {
+			continue
+		}
+		seen[string(ip)] = true
+		sorted = append(sorted, ip)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) < len(sorted[j])
+		}
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	return sorted
+}
+
+// LookupIPs resolves host with the resolvers list, using the first answer
+// from any resolver to each of the A and AAAA queries. It falls back to use
+// system default for final resolution if none of resolvers can answer.
+func LookupIPs(resolvers []string, host string) (ips []net.IP, err error) {
+	ips, _, err = lookupIPsTTL(context.Background(), defaultLogger, resolvers, host, 0)
+	return ips, err
+}
+
+// lookupIPsTTL is like LookupIPs, but also returns the smallest TTL of the
+// records the addresses came from. The TTL is zero if the addresses came
+// from the system resolver. Each query is bounded by timeout, unless it's
+// zero. Failed queries are logged with logger.
+//
+// The A and AAAA queries are sent to all resolvers at once, and the first
+// successful answer with records of each query type is used, so that a slow
+// resolver doesn't delay the lookup, while one failing fast doesn't hide the
+// answer of a slower one. Once ctx is done, the queries still outstanding are
+// aborted and ctx.Err() is returned.
+func lookupIPsTTL(ctx context.Context, logger Logger, resolvers []string, host string, timeout time.Duration) (ips []net.IP, ttl time.Duration, err error) {
+	ips, ttl, err = queryIPs(ctx, logger, resolvers, host, addressQTypes, timeout)
+	if len(ips) != 0 || err != nil {
+		return ips, ttl, err
+	}
+	ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host)
+	return ips, 0, err
+}
+
+// addressQTypes are the query types of the addresses of a host, in the order
+// of their addresses.
+var addressQTypes = []uint16{dns.TypeA, dns.TypeAAAA}
+
+// queryIPs is like lookupIPsTTL, but only makes the queries of qtypes, a
+// subset of addressQTypes, and doesn't fall back to the system resolver: it
+// returns no addresses if none of resolvers could answer. The only error it
+// returns is ctx.Err().
+func queryIPs(ctx context.Context, logger Logger, resolvers []string, host string, qtypes []uint16, timeout time.Duration) (ips []net.IP, ttl time.Duration, err error) {
+	type answer struct {
+		qtype    uint16
+		resolver string
+		in       *dns.Msg
+		err      error
+	}
+	// buffered so that queries outlasting the lookup don't block
+	answers := make(chan answer, len(resolvers)*len(qtypes))
+	// the queries are aborted once the lookup returns
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for _, resolver := range resolvers {
+		for _, qtype := range qtypes {
+			go func(resolver string, qtype uint16) {
+				in, err := exchangeFollowingCNAMEs(ctx, logger, resolver, host, qtype, timeout)
+				answers <- answer{qtype: qtype, resolver: resolver, in: in, err: err}
+			}(resolver, qtype)
+		}
+	}
+
+	// a query type is settled by its first successful answer with records,
+	// or once it failed with every resolver
+	pending := make(map[uint16]int)
+	for _, qtype := range qtypes {
+		pending[qtype] = len(resolvers)
+	}
+	settled := make(map[uint16]bool)
+	unsettled := len(qtypes)
+	if len(resolvers) == 0 {
+		unsettled = 0
+	}
+	seen := make(map[string]bool)
+	// addresses are kept in query type order, IPv4 first
+	found := make(map[uint16][]net.IP)
+	for unsettled > 0 {
+		var a answer
+		select {
+		case a = <-answers:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+		pending[a.qtype]--
+		if settled[a.qtype] {
+			continue
+		}
+		var records []dns.RR
+		if a.err == nil {
+			for _, rr := range a.in.Answer {
+				switch rr.(type) {
+				case *dns.A, *dns.AAAA:
+					records = append(records, rr)
+				}
+			}
+			if a.in.Rcode != dns.RcodeSuccess && a.in.Rcode != dns.RcodeNameError {
+				a.err = errors.New("DNS query failed: " + dns.RcodeToString[a.in.Rcode])
+			}
+		}
+		// a failed or empty answer counts as the resolver failing, so
+		// that the answers of the others are still waited for
+		if a.err != nil || len(records) == 0 {
+			if a.err != nil {
+				logger.Warningf("fail to get %s records for %s with %s: %v", dns.TypeToString[a.qtype], host, a.resolver, a.err)
+			} else {
+				logger.Debugf("no %s records for %s with %s", dns.TypeToString[a.qtype], host, a.resolver)
+			}
+			if pending[a.qtype] == 0 {
+				settled[a.qtype] = true
+				unsettled--
+			}
+			continue
+		}
+		settled[a.qtype] = true
+		unsettled--
+
+		for _, rr := range records {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			}
+			if seen[ip.String()] {
+				continue
+			}
+			seen[ip.String()] = true
+			logger.Debugf("resolve %s to %s with %s", host, ip, a.resolver)
+			t := time.Duration(rr.Header().Ttl) * time.Second
+			if len(seen) == 1 || t < ttl {
+				ttl = t
+			}
+			found[a.qtype] = append(found[a.qtype], ip)
+		}
+	}
+	for _, qtype := range qtypes {
+		ips = append(ips, found[qtype]...)
+	}
+	return ips, ttl, nil
+}
+
+// defaultDNSTimeout bounds dialing a resolver, sending it a query and reading
+// its answer, each, if Client.DNSTimeout is unset. It's the default of the
+// dns package.
+const defaultDNSTimeout = 2 * time.Second
+
+// exchange sends the query m to resolver and returns its answer. Queries are
+// made over TCP, so that the answers for large fleets aren't truncated as
+// they would be over UDP. This also makes advertising a larger UDP payload
+// size with EDNS0 unnecessary.
+//
+// The exchange is bounded by timeout, unless it's zero, and aborted once ctx
+// is done.
+func exchange(ctx context.Context, resolver string, m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	opTimeout := defaultDNSTimeout
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		opTimeout = timeout
+	}
+	d := net.Dialer{Timeout: opTimeout}
+	nc, err := d.DialContext(ctx, "tcp", resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+	// closing the connection interrupts a pending write or read
+	stop := afterFunc(ctx, func() { nc.Close() })
+	defer stop()
+
+	co := &dns.Conn{Conn: nc}
+	co.SetWriteDeadline(time.Now().Add(opTimeout))
+	if err := co.WriteMsg(m); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	co.SetReadDeadline(time.Now().Add(opTimeout))
+	in, err := co.ReadMsg()
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	if in.Id != m.Id {
+		return nil, dns.ErrId
+	}
+	return in, nil
+}
+
+// contextError returns ctx.Err() in place of err if ctx is done, as err is
+// then likely a consequence.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// maxCNAMEDepth bounds the length of the CNAME chains followed, so that
+// loops are broken.
+const maxCNAMEDepth = 8
+
+// exchangeFollowingCNAMEs queries resolver for the records of type qtype of
+// host. If the answer only holds a CNAME, as some resolvers don't include the
+// records of the canonical name, the canonical name is queried in turn, as
+// logged with logger.
+func exchangeFollowingCNAMEs(ctx context.Context, logger Logger, resolver, host string, qtype uint16, timeout time.Duration) (*dns.Msg, error) {
+	name := dns.Fqdn(host)
+	for depth := 0; ; depth++ {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		in, err := exchange(ctx, resolver, m, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		var target string
+		for _, rr := range in.Answer {
+			if rr.Header().Rrtype == qtype {
+				return in, nil
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				target = cname.Target
+			}
+		}
+		if target == "" {
+			return in, nil
+		}
+		if depth == maxCNAMEDepth {
+			return nil, fmt.Errorf("CNAME chain of %s longer than %d", host, maxCNAMEDepth)
+		}
+		logger.Debugf("follow CNAME of %s to %s", name, target)
+		name = target
+	}
+}
+
+// defaultDoHTimeout bounds a DNS-over-HTTPS query if Client.DoHTimeout is
+// unset.
+const defaultDoHTimeout = 5 * time.Second
+
+// maxDoHResponseSize bounds the DNS-over-HTTPS responses read; DNS messages
+// can't be larger.
+const maxDoHResponseSize = 65535
+
+// resolve resolves the addresses of the query types qtypes, a subset of
+// addressQTypes, of host with the client's Resolve hook, if any. Otherwise it
+// uses the client's DNS-over-HTTPS endpoint, if any, and then its resolvers,
+// for each of the names searchNames expands host to in turn, falling back to
+// the system resolver.
+func (c *Client) resolve(ctx context.Context, host string, qtypes []uint16) ([]net.IP, time.Duration, error) {
+	if c.Resolve != nil {
+		ips, err := c.Resolve(host)
+		return ipsOfQTypes(ips, qtypes), 0, err
+	}
+	// all names are looked up with the same resolvers, even if
+	// SetResolvers is called meanwhile
+	resolvers := c.resolvers()
+	for _, name := range c.searchNames(host) {
+		if c.DoHEndpoint != "" {
+			ips, ttl, err := c.lookupIPsDoH(ctx, name, qtypes)
+			if err == nil && len(ips) != 0 {
+				return ips, ttl, nil
+			}
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			c.logger().Warningf("fail to resolve %s with %s: %v", name, c.DoHEndpoint, err)
+		}
+		ips, ttl, err := queryIPs(ctx, c.logger(), resolvers, name, qtypes, c.DNSTimeout)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(ips) != 0 {
+			return ips, ttl, nil
+		}
+	}
+	network := "ip"
+	if len(qtypes) == 1 {
+		network = "ip6"
+		if qtypes[0] == dns.TypeA {
+			network = "ip4"
+		}
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	return ips, 0, err
+}
+
+// ipsOfQTypes returns the addresses among ips of the query types qtypes.
+func ipsOfQTypes(ips []net.IP, qtypes []uint16) []net.IP {
+	if len(qtypes) == len(addressQTypes) {
+		return ips
+	}
+	var filtered []net.IP
+	for _, ip := range ips {
+		qtype := dns.TypeAAAA
+		if ip.To4() != nil {
+			qtype = dns.TypeA
+		}
+		for _, t := range qtypes {
+			if t == qtype {
+				filtered = append(filtered, ip)
+			}
+		}
+	}
+	return filtered
+}
+
+// systemResolvConf is the resolv.conf(5) of the system stub resolver.
+const systemResolvConf = "/etc/resolv.conf"
+
+// LoadSystemResolvers configures c to look up servers as the system stub
+// resolver does, from /etc/resolv.conf: its nameservers replace Resolvers,
+// as by SetResolvers, and its search list and ndots option replace
+// SearchDomains and NDots, which unlike Resolvers must not change while
+// lookups are in flight. It fails, leaving c unchanged, if the file can't be
+// read, e.g. on platforms without one such as Windows, or lists no
+// nameserver.
+func (c *Client) LoadSystemResolvers() error {
+	return c.loadResolvConf(systemResolvConf)
+}
+
+// loadResolvConf is LoadSystemResolvers with the resolv.conf at path.
+func (c *Client) loadResolvConf(path string) error {
+	config, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to load system resolvers: %v", err)
+	}
+	if len(config.Servers) == 0 {
+		return fmt.Errorf("failed to load system resolvers: no nameserver in %s", path)
+	}
+	resolvers := make([]string, len(config.Servers))
+	for i, server := range config.Servers {
+		resolvers[i] = net.JoinHostPort(server, config.Port)
+	}
+	c.SetResolvers(resolvers)
+	c.SearchDomains = config.Search
+	c.NDots = config.Ndots
+	return nil
+}
+
+// searchNames returns the fully qualified names host is looked up as, in
+// order, according to c.SearchDomains and c.NDots.
+func (c *Client) searchNames(host string) []string {
+	if len(c.SearchDomains) == 0 || strings.HasSuffix(host, ".") {
+		return []string{host}
+	}
+	ndots := c.NDots
+	if ndots == 0 {
+		ndots = 1
+	}
+	var names []string
+	for _, domain := range c.SearchDomains {
+		names = append(names, dns.Fqdn(host+"."+strings.Trim(domain, ".")))
+	}
+	if strings.Count(host, ".") >= ndots {
+		return append([]string{host}, names...)
+	}
+	return append(names, host)
+}
+
+// lookupIPsDoH resolves the records of the query types qtypes of host with
+// the client's DNS-over-HTTPS endpoint, returning the addresses and their
+// smallest TTL.
+func (c *Client) lookupIPsDoH(ctx context.Context, host string, qtypes []uint16) (ips []net.IP, ttl time.Duration, err error) {
+	timeout := c.DoHTimeout
+	if timeout == 0 {
+		timeout = defaultDoHTimeout
+	}
+	httpClient := &http.Client{Transport: c.dohHTTPTransport(), Timeout: timeout}
+
+	for _, qtype := range qtypes {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(host), qtype)
+		// RFC 8484 recommends an ID of 0 for cache friendliness
+		m.Id = 0
+		in, err := exchangeDoH(ctx, httpClient, c.DoHEndpoint, m)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, rr := range in.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			c.logger().Debugf("resolve %s to %s", host, ip)
+			t := time.Duration(rr.Header().Ttl) * time.Second
+			if len(ips) == 0 || t < ttl {
+				ttl = t
+			}
+			ips = append(ips, ip)
+		}
+	}
+	return ips, ttl, nil
+}
+
+// dohHTTPTransport returns the transport of c for DNS-over-HTTPS lookups,
+// created with c.DoHTLSConfig on first use.
+func (c *Client) dohHTTPTransport() *http.Transport {
+	c.dohTransportOnce.Do(func() {
+		c.dohTransport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: c.DoHTLSConfig.Clone(),
+		}
+	})
+	return c.dohTransport
+}
+
+// exchangeDoH sends the DNS query m to a DNS-over-HTTPS endpoint with an
+// HTTPS POST of its wire format, as described in RFC 8484.
+func exchangeDoH(ctx context.Context, httpClient *http.Client, endpoint string, m *dns.Msg) (*dns.Msg, error) {
+	query, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: maxDoHResponseSize})
+	if err != nil {
+		return nil, err
+	}
+
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, err
+	}
+	if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+		return nil, errors.New("DNS query failed: " + dns.RcodeToString[in.Rcode])
+	}
+	return in, nil
+}
+
+// lookupIPs resolves host with the client's resolvers, serving answers from
+// the client's DNS cache while they are fresh. The failures of the A and AAAA
+// lookups are cached too, each on its own for Client.DNSNegativeTTL, so that
+// a query type which just failed isn't made again while the other may still
+// be. See Client.DNSCacheTTL. Once ctx is done, the lookup is aborted and
+// ctx.Err() returned.
+func (c *Client) lookupIPs(ctx context.Context, host string) ([]net.IP, error) {
+	ctx, span := c.tracer().Start(ctx, spanResolve)
+	span.SetAttribute("host", host)
+	ips, err := c.lookupIPsCached(ctx, host)
+	endSpan(span, err)
+	return ips, err
+}
+
+// lookupIPsCached implements lookupIPs.
+func (c *Client) lookupIPsCached(ctx context.Context, host string) ([]net.IP, error) {
+	if c.dnsCache == nil || c.DNSCacheTTL < 0 {
+		ips, _, err := c.resolve(ctx, host, addressQTypes)
+		return ips, err
+	}
+
+	if v, stale := c.dnsCache.Get(host); !stale {
+		if ips, ok := v.([]net.IP); ok {
+			c.logger().Debugf("resolve %s from cache", host)
+			return ips, nil
+		}
+	}
+	// the query types which failed recently aren't made again
+	var qtypes []uint16
+	var cachedErr error
+	for _, qtype := range addressQTypes {
+		if v, stale := c.dnsCache.Get(negativeCacheKey(host, qtype)); !stale {
+			if failure, ok := v.(*dnsFailure); ok {
+				if cachedErr == nil {
+					cachedErr = failure.err
+				}
+				continue
+			}
+		}
+		qtypes = append(qtypes, qtype)
+	}
+	if len(qtypes) == 0 {
+		c.logger().Debugf("resolve %s from negative cache", host)
+		return nil, cachedErr
+	}
+
+	ips, ttl, err := c.resolve(ctx, host, qtypes)
+	if ctx.Err() != nil {
+		// an aborted lookup says nothing about the host
+		return nil, ctx.Err()
+	}
+	if negativeTTL := c.dnsNegativeTTL(); negativeTTL > 0 {
+		for _, qtype := range qtypes {
+			if len(ipsOfQTypes(ips, []uint16{qtype})) == 0 {
+				c.dnsCache.Set(negativeCacheKey(host, qtype), &dnsFailure{err: err}, negativeTTL)
+			}
+		}
+	}
+	if err != nil || len(ips) == 0 {
+		return ips, err
+	}
+	if c.DNSCacheTTL > 0 && (ttl == 0 || ttl > c.DNSCacheTTL) {
+		ttl = c.DNSCacheTTL
+	}
+	if ttl > 0 {
+		c.dnsCache.Set(host, ips, ttl)
+	}
+	return ips, nil
+}
+
+// dnsFailure is cached in place of the addresses of a query type of a host
+// which failed to resolve, recording the error of the lookup, if any.
+type dnsFailure struct {
+	err error
+}
+
+// negativeCacheKey returns the key of the dnsFailure of the query type qtype
+// of host in the DNS cache, which host names can't collide with.
+func negativeCacheKey(host string, qtype uint16) string {
+	return host + "/" + dns.TypeToString[qtype]
+}
+
+// lookupSRV resolves the SRV records for name with the resolvers list
+// sequentially until one resolver can answer the request. It falls back to
+// use the system default if none of the resolvers can answer. Each query is
+// bounded by timeout, unless it's zero, and failed queries are logged with
+// logger. Once ctx is done, the lookup is aborted and ctx.Err() returned.
+func lookupSRV(ctx context.Context, logger Logger, resolvers []string, name string, timeout time.Duration) ([]*dns.SRV, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeSRV)
+	for _, resolver := range resolvers {
+		in, err := exchange(ctx, resolver, m, timeout)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			logger.Warningf("fail to get SRV records for %s with %s: %v", name, resolver, err)
+			continue
+		}
+		var srvs []*dns.SRV
+		for _, rr := range in.Answer {
+			if srv, ok := rr.(*dns.SRV); ok {
+				logger.Debugf("resolve %s to %s", name, srv)
+				srvs = append(srvs, srv)
+			}
+		}
+		if len(srvs) != 0 {
+			return srvs, nil
+		}
+	}
+
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	srvs := make([]*dns.SRV, len(addrs))
+	for i, addr := range addrs {
+		srvs[i] = &dns.SRV{
+			Target:   addr.Target,
+			Port:     addr.Port,
+			Priority: addr.Priority,
+			Weight:   addr.Weight,
+		}
+	}
+	return srvs, nil
+}
@@ -0,0 +1,1160 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stubResolver is a local DNS server answering on both UDP and TCP.
+type stubResolver struct {
+	addr    string
+	queries int32
+	// rcode is the response code of the answers, see SetRcode.
+	rcode   int32
+	servers []*dns.Server
+}
+
+// maxUDPAnswers is the number of records a stubResolver answers with over
+// UDP before truncating the answer.
+const maxUDPAnswers = 10
+
+// newStubResolver starts a DNS server which answers every query with the
+// records returned by answer.
+func newStubResolver(t *testing.T, answer func(q dns.Question) []dns.RR) *stubResolver {
+	sr := &stubResolver{}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&sr.queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Rcode = int(atomic.LoadInt32(&sr.rcode))
+		m.Answer = answer(req.Question[0])
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp && len(m.Answer) > maxUDPAnswers {
+			m.Answer = m.Answer[:maxUDPAnswers]
+			m.Truncated = true
+		}
+		w.WriteMsg(m)
+	})
+
+	// the TCP listener must share the UDP port, which may already be taken
+	var pc net.PacketConn
+	var l net.Listener
+	var err error
+	for i := 0; i < 10; i++ {
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		sr.addr = pc.LocalAddr().String()
+		if l, err = net.Listen("tcp", sr.addr); err == nil {
+			break
+		}
+		pc.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr.servers = []*dns.Server{
+		{PacketConn: pc, Handler: handler},
+		{Listener: l, Handler: handler},
+	}
+	for _, srv := range sr.servers {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+	}
+	return sr
+}
+
+func (sr *stubResolver) Queries() int {
+	return int(atomic.LoadInt32(&sr.queries))
+}
+
+// SetRcode makes sr answer with rcode, e.g. dns.RcodeServerFailure.
+func (sr *stubResolver) SetRcode(rcode int) {
+	atomic.StoreInt32(&sr.rcode, int32(rcode))
+}
+
+func (sr *stubResolver) Close() {
+	for _, srv := range sr.servers {
+		srv.Shutdown()
+	}
+}
+
+// addressRRs answers A and AAAA questions with the given addresses.
+func addressRRs(ttl uint32, ips ...string) func(q dns.Question) []dns.RR {
+	return func(q dns.Question) (rrs []dns.RR) {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			switch {
+			case q.Qtype == dns.TypeA && ip.To4() != nil:
+				rrs = append(rrs, &dns.A{Hdr: hdr, A: ip})
+			case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+				rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		return
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	sr := newStubResolver(t, addressRRs(1, "127.0.0.1", "::1"))
+	defer sr.Close()
+
+	cl := newTestClient(t)
+	cl.Resolvers = []string{sr.addr}
+
+	ips, err := cl.lookupIPs(context.Background(), "keyless.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 {
+		t.Fatalf("expected 2 addresses, got %v", ips)
+	}
+	queries := sr.Queries()
+
+	// served from the cache while the record TTL hasn't expired
+	if ips, err = cl.lookupIPs(context.Background(), "keyless.test"); err != nil || len(ips) != 2 {
+		t.Fatalf("cached lookup failed: %v %v", ips, err)
+	}
+	if sr.Queries() != queries {
+		t.Fatal("cached lookup issued DNS queries")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, err = cl.lookupIPs(context.Background(), "keyless.test"); err != nil {
+		t.Fatal(err)
+	}
+	if sr.Queries() == queries {
+		t.Fatal("expired cache entry was not refreshed")
+	}
+}
+
+func TestDNSCacheTTLOverride(t *testing.T) {
+	sr := newStubResolver(t, addressRRs(3600, "127.0.0.1"))
+	defer sr.Close()
+
+	cl := newTestClient(t)
+	cl.Resolvers = []string{sr.addr}
+
+	// a negative DNSCacheTTL disables caching
+	cl.DNSCacheTTL = -1
+	for i := 0; i < 2; i++ {
+		if _, err := cl.lookupIPs(context.Background(), "keyless.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sr.Queries() != 4 {
+		t.Fatalf("expected every lookup to query, got %d queries", sr.Queries())
+	}
+
+	// a positive DNSCacheTTL caps the record TTL
+	cl.DNSCacheTTL = 100 * time.Millisecond
+	if _, err := cl.lookupIPs(context.Background(), "clamped.test"); err != nil {
+		t.Fatal(err)
+	}
+	queries := sr.Queries()
+	time.Sleep(200 * time.Millisecond)
+	if _, err := cl.lookupIPs(context.Background(), "clamped.test"); err != nil {
+		t.Fatal(err)
+	}
+	if sr.Queries() == queries {
+		t.Fatal("DNSCacheTTL did not cap the cache lifetime")
+	}
+}
+
+func TestDNSNegativeCache(t *testing.T) {
+	var resolvable int32
+	sr := newStubResolver(t, func(q dns.Question) []dns.RR {
+		if atomic.LoadInt32(&resolvable) == 0 {
+			return nil
+		}
+		return addressRRs(3600, "127.0.0.1")(q)
+	})
+	defer sr.Close()
+
+	cl := newTestClient(t)
+	cl.Resolvers = []string{sr.addr}
+	cl.DNSNegativeTTL = 100 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		if ips, err := cl.lookupIPs(context.Background(), "missing.invalid"); err == nil && len(ips) != 0 {
+			t.Fatalf("unexpected answer %v", ips)
+		}
+	}
+	if sr.Queries() != 2 {
+		t.Fatalf("expected the failure to be cached, got %d queries", sr.Queries())
+	}
+
+	// the failure is forgotten once the negative TTL expires, and the
+	// success replaces it
+	atomic.StoreInt32(&resolvable, 1)
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if ips, err := cl.lookupIPs(context.Background(), "missing.invalid"); err != nil || len(ips) != 1 {
+			t.Fatalf("lookup failed after recovery: %v %v", ips, err)
+		}
+	}
+	if sr.Queries() != 4 {
+		t.Fatalf("expected a single lookup after recovery, got %d queries", sr.Queries())
+	}
+
+	// a query type which failed isn't made again, while the other is
+	v4only := newStubResolver(t, addressRRs(0, "127.0.0.1"))
+	defer v4only.Close()
+	cl.Resolvers = []string{v4only.addr}
+	for i := 0; i < 2; i++ {
+		if ips, err := cl.lookupIPs(context.Background(), "v4only.test"); err != nil || len(ips) != 1 {
+			t.Fatalf("unexpected answer %v %v", ips, err)
+		}
+	}
+	if v4only.Queries() != 3 {
+		t.Fatalf("expected the AAAA failure to be cached, got %d queries", v4only.Queries())
+	}
+	cl.Resolvers = []string{sr.addr}
+
+	// a negative DNSNegativeTTL disables caching of failures
+	cl.DNSNegativeTTL = -1
+	atomic.StoreInt32(&resolvable, 0)
+	for i := 0; i < 2; i++ {
+		cl.lookupIPs(context.Background(), "uncached.invalid")
+	}
+	if sr.Queries() != 8 {
+		t.Fatalf("failed lookup should not be cached, got %d queries", sr.Queries())
+	}
+}
+
+func TestDNSTimeout(t *testing.T) {
+	// a resolver which accepts queries but never answers them
+	blackhole, _ := newBlackhole(t, "tcp", "127.0.0.1:0")
+	defer blackhole.Close()
+	sr := newStubResolver(t, addressRRs(60, "127.0.0.1"))
+	defer sr.Close()
+
+	cl := newTestClient(t)
+	cl.Resolvers = []string{blackhole.Addr().String(), sr.addr}
+	cl.DNSTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	ips, err := cl.lookupIPs(context.Background(), "timeout.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("expected the answer of the second resolver, got %v", ips)
+	}
+	// the AAAA query, which the second resolver has no records for, times
+	// out on the first resolver
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("lookup took %v with a 100ms timeout", elapsed)
+	}
+}
+
+func TestLookupServerContext(t *testing.T) {
+	blackhole, _ := newBlackhole(t, "tcp", "127.0.0.1:0")
+	defer blackhole.Close()
+
+	cl := newTestClient(t)
+	cl.Resolvers = []string{blackhole.Addr().String()}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := cl.LookupServerContext(ctx, "cancel.test:2407"); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("canceled lookup took %v", elapsed)
+	}
+
+	// the aborted lookup wasn't cached as a failure
+	sr := newStubResolver(t, addressRRs(60, "127.0.0.1"))
+	defer sr.Close()
+	cl.Resolvers = []string{sr.addr}
+	if _, err := cl.LookupServer("cancel.test:2407"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParallelResolvers(t *testing.T) {
+	slow := newStubResolver(t, func(q dns.Question) []dns.RR {
+		time.Sleep(time.Second)
+		return addressRRs(60, "127.0.0.2")(q)
+	})
+	defer slow.Close()
+	fast := newStubResolver(t, addressRRs(60, "127.0.0.1", "::1"))
+	defer fast.Close()
+
+	start := time.Now()
+	ips, _, err := lookupIPsTTL(context.Background(), defaultLogger, []string{slow.addr, fast.addr}, "parallel.test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("lookup waited %v for the slow resolver", elapsed)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("127.0.0.1")) || !ips[1].Equal(net.ParseIP("::1")) {
+		t.Fatalf("expected the answer of the fast resolver, got %v", ips)
+	}
+}
+
+func TestFailingResolvers(t *testing.T) {
+	slow := newStubResolver(t, func(q dns.Question) []dns.RR {
+		time.Sleep(200 * time.Millisecond)
+		return addressRRs(60, "127.0.0.2", "::2")(q)
+	})
+	defer slow.Close()
+	failing := newStubResolver(t, addressRRs(60, "127.0.0.1", "::1"))
+	failing.SetRcode(dns.RcodeServerFailure)
+	defer failing.Close()
+	empty := newStubResolver(t, addressRRs(60))
+	defer empty.Close()
+
+	// the fast failed and empty answers don't settle the lookup
+	ips, _, err := lookupIPsTTL(context.Background(), defaultLogger, []string{failing.addr, empty.addr, slow.addr}, "failing.test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("127.0.0.2")) || !ips[1].Equal(net.ParseIP("::2")) {
+		t.Fatalf("expected the answer of the slow resolver, got %v", ips)
+	}
+}
+
+func TestSetResolvers(t *testing.T) {
+	primary := newStubResolver(t, addressRRs(60, "192.0.2.1"))
+	defer primary.Close()
+	backup := newStubResolver(t, addressRRs(60, "192.0.2.2"))
+	defer backup.Close()
+
+	cl := newTestClient(t)
+	cl.DNSCacheTTL = -1
+	cl.SetResolvers([]string{primary.addr})
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := cl.lookupIPs(context.Background(), "keyless.test"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		cl.SetResolvers([]string{backup.addr})
+		cl.SetResolvers([]string{primary.addr, backup.addr})
+	}
+	close(stop)
+	wg.Wait()
+
+	resolvers := []string{backup.addr}
+	cl.SetResolvers(resolvers)
+	// the client keeps its own copy
+	resolvers[0] = primary.addr
+	ips, err := cl.lookupIPs(context.Background(), "keyless.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.2")) {
+		t.Fatalf("expected the answer of the backup resolver, got %v", ips)
+	}
+}
+
+func TestSearchDomains(t *testing.T) {
+	var mu sync.Mutex
+	var queried []string
+	sr := newStubResolver(t, func(q dns.Question) []dns.RR {
+		mu.Lock()
+		queried = append(queried, q.Name)
+		mu.Unlock()
+		if q.Name != "keyless.internal." {
+			return nil
+		}
+		return addressRRs(60, "192.0.2.1")(q)
+	})
+	defer sr.Close()
+
+	cl := newTestClient(t)
+	cl.DNSCacheTTL = -1
+	cl.Resolvers = []string{sr.addr}
+	cl.SearchDomains = []string{"corp.", "internal"}
+
+	ips, err := cl.lookupIPs(context.Background(), "keyless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("expected the address of keyless.internal, got %v", ips)
+	}
+	mu.Lock()
+	for _, name := range queried {
+		if name != "keyless.corp." && name != "keyless.internal." {
+			t.Errorf("unexpected query of %s", name)
+		}
+	}
+	queried = nil
+	mu.Unlock()
+
+	// names with enough dots are tried as is first
+	if ips, err := cl.lookupIPs(context.Background(), "keyless.internal"); err != nil || len(ips) != 1 {
+		t.Fatalf("expected keyless.internal to resolve, got %v, %v", ips, err)
+	}
+	mu.Lock()
+	for _, name := range queried {
+		if name != "keyless.internal." {
+			t.Errorf("unexpected query of %s", name)
+		}
+	}
+	mu.Unlock()
+
+	if names := cl.searchNames("keyless."); !reflect.DeepEqual(names, []string{"keyless."}) {
+		t.Fatalf("expected a fully qualified name to be tried as is, got %v", names)
+	}
+	cl.NDots = 2
+	want := []string{"keyless.internal.corp.", "keyless.internal.internal.", "keyless.internal"}
+	if names := cl.searchNames("keyless.internal"); !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected search domains first with NDots 2, got %v", names)
+	}
+}
+
+func TestLoadSystemResolvers(t *testing.T) {
+	cl := newTestClient(t)
+	if err := cl.loadResolvConf("testdata/resolv.conf"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"192.0.2.53:53", "[2001:db8::53]:53"}; !reflect.DeepEqual(cl.resolvers(), want) {
+		t.Fatalf("expected resolvers %v, got %v", want, cl.resolvers())
+	}
+	if want := []string{"keyless.test", "example.test"}; !reflect.DeepEqual(cl.SearchDomains, want) {
+		t.Fatalf("expected search domains %v, got %v", want, cl.SearchDomains)
+	}
+	if cl.NDots != 2 {
+		t.Fatalf("expected ndots 2, got %d", cl.NDots)
+	}
+
+	// a missing file, or one without a nameserver, leaves the client as is
+	empty, err := ioutil.TempFile("", "resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(empty.Name())
+	fmt.Fprintln(empty, "search other.test")
+	empty.Close()
+	for _, path := range []string{"testdata/missing.conf", empty.Name()} {
+		if err := cl.loadResolvConf(path); err == nil {
+			t.Fatalf("%s: expected an error", path)
+		}
+		if len(cl.resolvers()) != 2 || len(cl.SearchDomains) != 2 {
+			t.Fatalf("%s: expected the client to be unchanged, got %v and %v", path, cl.resolvers(), cl.SearchDomains)
+		}
+	}
+}
+
+func TestReResolveOnFailure(t *testing.T) {
+	addr := newTestServer(t).(*net.TCPAddr)
+	// nothing listens on the port of the server at the initial addresses
+	var answer atomic.Value
+	answer.Store([]string{"127.0.0.2", "127.0.0.3"})
+	sr := newStubResolver(t, func(q dns.Question) []dns.RR {
+		return addressRRs(60, answer.Load().([]string)...)(q)
+	})
+	defer sr.Close()
+
+	cl := newTestClient(t)
+	cl.Resolvers = []string{sr.addr}
+	cl.DNSCacheTTL = -1
+	cl.ReResolveOnFailure = true
+	r, err := cl.LookupServerWithName("localhost", "keyless.test", strconv.Itoa(addr.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := r.(*Group)
+	defer g.Close()
+
+	// the servers moved to a new address
+	answer.Store([]string{"127.0.0.3", addr.IP.String()})
+	conn, err := g.Dial(cl)
+	if err != nil {
+		t.Fatalf("dial after the servers moved failed: %v", err)
+	}
+	conn.Close()
+	var addrs []string
+	for _, st := range g.Remotes() {
+		addrs = append(addrs, st.Addr)
+	}
+	want := []string{addr.String(), net.JoinHostPort("127.0.0.3", strconv.Itoa(addr.Port))}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("expected members %v after looking the host up again, got %v", want, addrs)
+	}
+	// a member found again keeps its state
+	if st := g.Remotes()[1]; st.Healthy || st.LastError == nil {
+		t.Fatalf("state of a member found again was reset: %+v", st)
+	}
+
+	// without the option, the group stays as it was looked up
+	cl.ReResolveOnFailure = false
+	answer.Store([]string{"127.0.0.2"})
+	r, err = cl.LookupServerWithName("localhost", "keyless.test", strconv.Itoa(addr.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g = r.(*Group)
+	defer g.Close()
+	answer.Store([]string{addr.IP.String()})
+	if _, err := g.Dial(cl); err == nil {
+		t.Fatal("dial succeeded without looking the host up again")
+	}
+	if st := g.Remotes(); len(st) != 1 || st[0].Addr != net.JoinHostPort("127.0.0.2", strconv.Itoa(addr.Port)) {
+		t.Fatalf("members changed without ReResolveOnFailure: %+v", st)
+	}
+}
+
+func TestLinkLocal(t *testing.T) {
+	cl := newTestClient(t)
+	r, err := cl.LookupServer("[fe80::1%eth1]:2407")
+	if err != nil {
+		t.Fatal(err)
+	}
+	single := r.(*singleRemote)
+	if single.String() != "[fe80::1%eth1]:2407" || single.ServerName != "fe80::1" {
+		t.Fatalf("expected [fe80::1%%eth1]:2407 (fe80::1), got %s (%s)", single.String(), single.ServerName)
+	}
+	// the dial target keeps the zone
+	if addr, err := net.ResolveTCPAddr("tcp", single.String()); err != nil || addr.Zone != "eth1" || !addr.IP.Equal(net.ParseIP("fe80::1")) {
+		t.Fatalf("malformed dial target %s: %v, %v", single.String(), addr, err)
+	}
+	if _, err := cl.LookupServer("[fe80::1]:2407"); err == nil {
+		t.Fatal("expected a link-local address without a zone to be rejected")
+	}
+
+	cl.Resolve = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("fe80::2"), net.ParseIP("2001:db8::2"), net.ParseIP("169.254.0.2")}, nil
+	}
+	lookup := func() []string {
+		r, err := cl.LookupServer("keyless.test:2407")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var addrs []string
+		for _, st := range r.(*Group).Remotes() {
+			addrs = append(addrs, st.Addr)
+		}
+		return addrs
+	}
+	// link-local addresses can't be dialed without a zone
+	if addrs := lookup(); !reflect.DeepEqual(addrs, []string{"169.254.0.2:2407", "[2001:db8::2]:2407"}) {
+		t.Fatalf("expected the link-local IPv6 address to be skipped, got %v", addrs)
+	}
+	cl.LinkLocalZone = "eth0"
+	if addrs := lookup(); !reflect.DeepEqual(addrs, []string{"169.254.0.2:2407", "[2001:db8::2]:2407", "[fe80::2%eth0]:2407"}) {
+		t.Fatalf("expected the link-local IPv6 address to be scoped to eth0, got %v", addrs)
+	}
+	if r, err := cl.LookupServer("[fe80::1]:2407"); err != nil || r.(*singleRemote).String() != "[fe80::1%eth0]:2407" {
+		t.Fatalf("expected the literal to be scoped to eth0, got %v, %v", r, err)
+	}
+}
+
+func TestLookupOrder(t *testing.T) {
+	// a duplicate record doesn't make a duplicate server
+	ips := []string{"127.0.0.3", "::2", "127.0.0.1", "::1", "127.0.0.2", "127.0.0.1"}
+	// whichever resolver answers first, with its own shuffle of the records
+	var resolvers []string
+	for i := 0; i < 3; i++ {
+		sr := newStubResolver(t, func(q dns.Question) []dns.RR {
+			shuffled := append([]string(nil), ips...)
+			rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+			return addressRRs(60, shuffled...)(q)
+		})
+		defer sr.Close()
+		resolvers = append(resolvers, sr.addr)
+	}
+
+	cl := newTestClient(t)
+	cl.Resolvers = resolvers
+	cl.DNSCacheTTL = -1
+	want := []string{"127.0.0.1:2407", "127.0.0.2:2407", "127.0.0.3:2407", "[::1]:2407", "[::2]:2407"}
+	for i := 0; i < 10; i++ {
+		r, err := cl.LookupServer("keyless.test:2407")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var addrs []string
+		for _, st := range r.(*Group).Remotes() {
+			addrs = append(addrs, st.Addr)
+		}
+		r.Close()
+		if !reflect.DeepEqual(addrs, want) {
+			t.Fatalf("expected servers %v, got %v", want, addrs)
+		}
+	}
+}
+
+func TestNewGroupFromAddrs(t *testing.T) {
+	cl := newTestClient(t)
+	cl.Resolve = func(host string) ([]net.IP, error) {
+		if host != "keyless.test" {
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+		return []net.IP{net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.1")}, nil
+	}
+	cl.Blacklist = &AddrSet{}
+	cl.Blacklist.Add(&net.TCPAddr{IP: net.ParseIP("192.0.2.9")}, 2407)
+
+	r, err := cl.NewGroupFromAddrs([]string{
+		"192.0.2.1:2407",
+		"[2001:db8::1]:2407",
+		"keyless.test:2407",
+		"192.0.2.9:2407",
+		"missing-port",
+	}, "keyless.example")
+	if err == nil || !strings.Contains(err.Error(), `"missing-port"`) {
+		t.Fatalf("expected an error about the malformed entry, got %v", err)
+	}
+	g, ok := r.(*Group)
+	if !ok {
+		t.Fatalf("expected a Group of the valid entries, got %T", r)
+	}
+	defer g.Close()
+	var addrs []string
+	for _, st := range g.Remotes() {
+		addrs = append(addrs, st.Addr)
+		if st.ServerName != "keyless.example" {
+			t.Fatalf("expected server name keyless.example, got %s", st.ServerName)
+		}
+	}
+	if want := []string{"192.0.2.1:2407", "[2001:db8::1]:2407", "192.0.2.2:2407"}; !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("expected servers %v, got %v", want, addrs)
+	}
+
+	if _, err := cl.NewGroupFromAddrs([]string{"192.0.2.1:port", "unknown.test:2407"}, ""); err == nil {
+		t.Fatal("expected an error without any valid entry")
+	}
+}
+
+func TestLookupIPLiteral(t *testing.T) {
+	sr := newStubResolver(t, addressRRs(60, "127.0.0.1"))
+	defer sr.Close()
+
+	cl := newTestClient(t)
+	cl.Resolvers = []string{sr.addr}
+	for _, tc := range []struct {
+		hostport, addr, serverName string
+	}{
+		{"192.0.2.5:2407", "192.0.2.5:2407", "192.0.2.5"},
+		{"[2001:db8::5]:2407", "[2001:db8::5]:2407", "2001:db8::5"},
+	} {
+		r, err := cl.LookupServer(tc.hostport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		single, ok := r.(*singleRemote)
+		if !ok {
+			t.Fatalf("%s: expected a single server, got %T", tc.hostport, r)
+		}
+		if single.String() != tc.addr || single.ServerName != tc.serverName {
+			t.Fatalf("%s: expected %s (%s), got %s (%s)", tc.hostport, tc.addr, tc.serverName, single.String(), single.ServerName)
+		}
+	}
+
+	// a bracketed host given on its own is taken as an address too
+	r, err := cl.LookupServerWithName("keyless.test", "[2001:db8::5]", "2407")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if single := r.(*singleRemote); single.String() != "[2001:db8::5]:2407" || single.ServerName != "keyless.test" {
+		t.Fatalf("expected [2001:db8::5]:2407 (keyless.test), got %s (%s)", single.String(), single.ServerName)
+	}
+	if sr.Queries() != 0 {
+		t.Fatalf("looking up IP addresses issued %d DNS queries", sr.Queries())
+	}
+
+	cl.Blacklist.Add(&net.TCPAddr{IP: net.ParseIP("192.0.2.5")}, 2407)
+	if _, err := cl.LookupServer("192.0.2.5:2407"); !errors.Is(err, ErrBlacklisted) {
+		t.Fatalf("expected a blacklisted address to be rejected, got %v", err)
+	}
+}
+
+func TestLookupInvalidInputs(t *testing.T) {
+	sr := newStubResolver(t, addressRRs(60, "127.0.0.1"))
+	defer sr.Close()
+
+	cl := newTestClient(t)
+	cl.Resolvers = []string{sr.addr}
+	for _, tc := range []struct {
+		serverName, host, port, err string
+	}{
+		{"", "keyless.test", "0", "invalid port 0"},
+		{"", "keyless.test", "-1", "invalid port -1"},
+		{"", "keyless.test", "65536", "invalid port 65536"},
+		{"", "keyless.test", "https", `invalid port "https"`},
+		{"", "192.0.2.5", "65536", "invalid port 65536"},
+		{"", "", "2407", "missing server host"},
+		{"keyless test", "keyless.test", "2407", "invalid character ' '"},
+		{"keyless..test", "keyless.test", "2407", "empty label"},
+		{"-keyless.test", "192.0.2.5", "2407", "hyphen"},
+		{strings.Repeat("a", 64) + ".test", "keyless.test", "2407", "longer than 63"},
+		{"", "keyless_test!", "2407", "invalid character '!'"},
+	} {
+		_, err := cl.LookupServerWithName(tc.serverName, tc.host, tc.port)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q, %q, %q: expected an error containing %q, got %v", tc.serverName, tc.host, tc.port, tc.err, err)
+		}
+	}
+	if _, err := cl.LookupServer(":2407"); err == nil || !strings.Contains(err.Error(), "missing server host") {
+		t.Errorf("expected an empty host to be rejected, got %v", err)
+	}
+	if sr.Queries() != 0 {
+		t.Fatalf("invalid inputs issued %d DNS queries", sr.Queries())
+	}
+
+	// valid names pass, with an optional trailing dot
+	for _, serverName := range []string{"keyless.test", "keyless.test.", "_srv.keyless-1.test", "192.0.2.5", "2001:db8::5"} {
+		if _, err := cl.LookupServerWithName(serverName, "192.0.2.5", "2407"); err != nil {
+			t.Errorf("%q: %v", serverName, err)
+		}
+	}
+}
+
+func TestNewServerChecked(t *testing.T) {
+	for _, tc := range []struct {
+		addr       net.Addr
+		serverName string
+		err        string
+	}{
+		{nil, "localhost", "missing server address"},
+		{(*net.TCPAddr)(nil), "localhost", "no IP"},
+		{&net.TCPAddr{Port: 2407}, "localhost", "no IP"},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.5")}, "localhost", "invalid port 0"},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.5"), Port: 70000}, "localhost", "invalid port 70000"},
+		{&net.UnixAddr{Net: "unix"}, "localhost", "no path"},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.5"), Port: 2407}, "", "missing server name"},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.5"), Port: 2407}, "*.keyless.test", "invalid character '*'"},
+	} {
+		if _, err := NewServerChecked(tc.addr, tc.serverName); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v, %q: expected an error containing %q, got %v", tc.addr, tc.serverName, tc.err, err)
+		}
+	}
+
+	r, err := NewServerChecked(&net.TCPAddr{IP: net.ParseIP("192.0.2.5"), Port: 2407}, "keyless.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if single := r.(*singleRemote); single.String() != "192.0.2.5:2407" || single.ServerName != "keyless.test" {
+		t.Fatalf("expected 192.0.2.5:2407 (keyless.test), got %s (%s)", single.String(), single.ServerName)
+	}
+	if _, err := NewServerChecked(&net.UnixAddr{Name: "/tmp/keyless.sock", Net: "unix"}, "keyless.test"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCNAME(t *testing.T) {
+	sr := newStubResolver(t, func(q dns.Question) []dns.RR {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}
+		switch q.Name {
+		case "alias.test.":
+			return []dns.RR{&dns.CNAME{Hdr: hdr, Target: "other.test."}}
+		case "other.test.":
+			return []dns.RR{&dns.CNAME{Hdr: hdr, Target: "target.test."}}
+		case "target.test.":
+			return addressRRs(60, "127.0.0.2", "::2")(q)
+		case "loop.test.":
+			return []dns.RR{&dns.CNAME{Hdr: hdr, Target: "loop.test."}}
+		}
+		return nil
+	})
+	defer sr.Close()
+
+	ips, _, err := lookupIPsTTL(context.Background(), defaultLogger, []string{sr.addr}, "alias.test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("127.0.0.2")) || !ips[1].Equal(net.ParseIP("::2")) {
+		t.Fatalf("expected the addresses of the canonical name, got %v", ips)
+	}
+
+	queries := sr.Queries()
+	if _, err := exchangeFollowingCNAMEs(context.Background(), defaultLogger, sr.addr, "loop.test", dns.TypeA, 0); err == nil {
+		t.Fatal("expected an error for a CNAME loop")
+	}
+	if n := sr.Queries() - queries; n != maxCNAMEDepth+1 {
+		t.Fatalf("expected %d queries for a CNAME loop, got %d", maxCNAMEDepth+1, n)
+	}
+}
+
+func TestIPPreference(t *testing.T) {
+	var ips []net.IP
+	for _, s := range []string{"::1", "127.0.0.1", "::2", "127.0.0.2"} {
+		ips = append(ips, net.ParseIP(s))
+	}
+	for _, test := range []struct {
+		pref IPPreference
+		want []string
+	}{
+		{IPBoth, []string{"::1", "127.0.0.1", "::2", "127.0.0.2"}},
+		{IPPreferV4, []string{"127.0.0.1", "127.0.0.2", "::1", "::2"}},
+		{IPPreferV6, []string{"::1", "::2", "127.0.0.1", "127.0.0.2"}},
+		{IPV4Only, []string{"127.0.0.1", "127.0.0.2"}},
+		{IPV6Only, []string{"::1", "::2"}},
+	} {
+		got := test.pref.apply(ips)
+		if len(got) != len(test.want) {
+			t.Fatalf("preference %d: expected %v, got %v", test.pref, test.want, got)
+		}
+		for i, ip := range got {
+			if !ip.Equal(net.ParseIP(test.want[i])) {
+				t.Fatalf("preference %d: expected %v, got %v", test.pref, test.want, got)
+			}
+		}
+	}
+
+	// a host with no address of the preferred family doesn't resolve
+	sr := newStubResolver(t, addressRRs(60, "127.0.0.1"))
+	defer sr.Close()
+	cl := newTestClient(t)
+	cl.Resolvers = []string{sr.addr}
+	cl.IPPreference = IPV6Only
+	if _, err := cl.LookupServer("v4.test:2407"); err == nil {
+		t.Fatal("expected an error for a host without IPv6 addresses")
+	}
+}
+
+func TestLargeAnswer(t *testing.T) {
+	var all []string
+	for i := 1; i <= 100; i++ {
+		all = append(all, "127.0.1."+strconv.Itoa(i))
+	}
+	// truncated over UDP
+	sr := newStubResolver(t, addressRRs(60, all...))
+	defer sr.Close()
+
+	ips, _, err := lookupIPsTTL(context.Background(), defaultLogger, []string{sr.addr}, "fleet.test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != len(all) {
+		t.Fatalf("expected %d addresses, got %d", len(all), len(ips))
+	}
+}
+
+func TestLookupServerSRV(t *testing.T) {
+	_, p, _ := net.SplitHostPort(sAddr)
+	port, _ := strconv.Atoi(p)
+
+	sr := newStubResolver(t, func(q dns.Question) []dns.RR {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+		switch {
+		case q.Qtype == dns.TypeSRV && q.Name == "_keyless._tcp.example.test.":
+			srv := func(pri, weight uint16, target string) dns.RR {
+				return &dns.SRV{Hdr: hdr, Priority: pri, Weight: weight, Port: uint16(port), Target: target}
+			}
+			return []dns.RR{
+				srv(10, 5, "a.example.test."),
+				// shares its address with a.example.test
+				srv(10, 1, "b.example.test."),
+				// fails to resolve
+				srv(10, 1, "missing.invalid."),
+				srv(20, 1, "c.example.test."),
+			}
+		case q.Name == "a.example.test." || q.Name == "b.example.test.":
+			return addressRRs(60, "127.0.0.1")(q)
+		case q.Name == "c.example.test.":
+			return addressRRs(60, "127.0.0.2")(q)
+		}
+		return nil
+	})
+	defer sr.Close()
+
+	cl := newTestClient(t)
+	cl.Resolvers = []string{sr.addr}
+	cl.LatencyAlpha = 0.5
+	cl.LatencyResetAfter = 3
+
+	r, err := cl.LookupServerSRV("keyless", "tcp", "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := r.(*Group)
+	if len(g.remotes) != 2 {
+		t.Fatalf("expected 2 remotes, got %d", len(g.remotes))
+	}
+	if policy, ok := g.policy.(SRVPolicy); !ok {
+		t.Fatalf("expected SRVPolicy, got %T", g.policy)
+	} else if policy.LatencyPolicy != cl.latencyPolicy() {
+		t.Fatalf("expected the LatencyPolicy of the client, got %+v", policy.LatencyPolicy)
+	}
+
+	byAddr := make(map[string]*singleRemote)
+	for _, m := range g.remotes {
+		single := m.Remote.(*singleRemote)
+		byAddr[single.String()] = single
+	}
+	a := byAddr[net.JoinHostPort("127.0.0.1", p)]
+	if a == nil || a.ServerName != "a.example.test" || a.priority != 10 || a.weight != 5 {
+		t.Fatalf("bad remote for a.example.test: %+v", a)
+	}
+	other := byAddr[net.JoinHostPort("127.0.0.2", p)]
+	if other == nil || other.ServerName != "c.example.test" || other.priority != 20 || other.weight != 1 {
+		t.Fatalf("bad remote for c.example.test: %+v", other)
+	}
+}
+
+func TestMaxRemotes(t *testing.T) {
+	var fleet []string
+	for i := 1; i <= 50; i++ {
+		fleet = append(fleet, fmt.Sprintf("10.0.0.%d", i))
+	}
+	sr := newStubResolver(t, func(q dns.Question) []dns.RR {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+		switch {
+		case q.Qtype == dns.TypeSRV:
+			var rrs []dns.RR
+			// listed worst priority first
+			for i := 10; i > 0; i-- {
+				rrs = append(rrs, &dns.SRV{Hdr: hdr, Priority: uint16(i), Port: 2407, Target: fmt.Sprintf("t%d.example.test.", i)})
+			}
+			return rrs
+		case strings.HasPrefix(q.Name, "t"):
+			n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(q.Name, "t"), ".example.test."))
+			return addressRRs(60, fmt.Sprintf("10.1.%d.1", n), fmt.Sprintf("10.1.%d.2", n))(q)
+		}
+		return addressRRs(60, fleet...)(q)
+	})
+	defer sr.Close()
+
+	cl := newTestClient(t)
+	cl.Resolvers = []string{sr.addr}
+	cl.MaxRemotes = 5
+	r, err := cl.LookupServer("fleet.test:2407")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	for _, st := range r.(*Group).Remotes() {
+		addrs = append(addrs, st.Addr)
+	}
+	if want := []string{"10.0.0.1:2407", "10.0.0.2:2407", "10.0.0.3:2407", "10.0.0.4:2407", "10.0.0.5:2407"}; !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("expected the group to be clamped to %v, got %v", want, addrs)
+	}
+
+	// the SRV targets of the best priorities are kept
+	r, err = cl.LookupServerSRV("keyless", "tcp", "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs = nil
+	for _, st := range r.(*Group).Remotes() {
+		addrs = append(addrs, st.Addr)
+	}
+	if want := []string{"10.1.1.1:2407", "10.1.1.2:2407", "10.1.2.1:2407", "10.1.2.2:2407", "10.1.3.1:2407"}; !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("expected the best SRV targets %v, got %v", want, addrs)
+	}
+}
+
+// newDoHServer starts a DNS-over-HTTPS server which answers every query with
+// the records returned by answer, along with the number of connections it
+// accepted. Its certificate is the one of httptest, which isn't signed by
+// the keyserver CA, and requests offering a client certificate are refused.
+func newDoHServer(t *testing.T, answer func(q dns.Question) []dns.RR) (*httptest.Server, *int32) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			http.Error(w, "client certificate offered", http.StatusForbidden)
+			return
+		}
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = answer(req.Question[0])
+		out, _ := m.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(out)
+	}))
+	accepted := new(int32)
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(accepted, 1)
+		}
+	}
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	return srv, accepted
+}
+
+func TestDoH(t *testing.T) {
+	srv, accepted := newDoHServer(t, addressRRs(60, "127.0.0.2", "::2"))
+	defer srv.Close()
+
+	cl := newTestClient(t)
+	cl.DoHEndpoint = srv.URL + "/dns-query"
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	cl.DoHTLSConfig = &tls.Config{RootCAs: roots}
+	ips, err := cl.lookupIPs(context.Background(), "doh.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("127.0.0.2")) || !ips[1].Equal(net.ParseIP("::2")) {
+		t.Fatalf("unexpected answer %v", ips)
+	}
+
+	// later lookups reuse the connection of the first one
+	if _, err := cl.lookupIPs(context.Background(), "other.doh.test"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Fatalf("expected the lookups to share one connection, got %d", n)
+	}
+}
+
+func TestDoHFallback(t *testing.T) {
+	// a server which always fails
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	sr := newStubResolver(t, addressRRs(60, "127.0.0.3"))
+	defer sr.Close()
+
+	cl := newTestClient(t)
+	cl.DoHEndpoint = srv.URL
+	cl.Resolvers = []string{sr.addr}
+	ips, err := cl.lookupIPs(context.Background(), "fallback.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.3")) {
+		t.Fatalf("expected the resolver answer, got %v", ips)
+	}
+}
+
+func TestLookupServerDedup(t *testing.T) {
+	// both resolvers give the same answers
+	sr1 := newStubResolver(t, addressRRs(60, "127.0.0.1", "127.0.0.2"))
+	defer sr1.Close()
+	sr2 := newStubResolver(t, addressRRs(60, "127.0.0.2", "127.0.0.1"))
+	defer sr2.Close()
+
+	cl := newTestClient(t)
+	cl.Resolvers = []string{sr1.addr, sr2.addr}
+	r, err := cl.LookupServer("dedup.test:2407")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := r.(*Group)
+	if len(g.remotes) != 2 {
+		t.Fatalf("expected 2 unique remotes, got %d", len(g.remotes))
+	}
+
+	g.Add(NewServer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2407}, "dedup.test"))
+	if len(g.remotes) != 2 {
+		t.Fatal("adding a duplicate remote grew the group")
+	}
+	g.Add(NewServer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2407}, "other.test"))
+	if len(g.remotes) != 3 {
+		t.Fatal("remote with a different server name was not added")
+	}
+}
+
+func TestResolveHook(t *testing.T) {
+	sr := newStubResolver(t, addressRRs(60, "127.0.0.1"))
+	defer sr.Close()
+
+	var resolved []string
+	cl := newTestClient(t)
+	cl.Resolvers = []string{sr.addr}
+	cl.Resolve = func(host string) ([]net.IP, error) {
+		resolved = append(resolved, host)
+		return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, nil
+	}
+	r, err := cl.LookupServerWithName("keyless.test", "hook.test", "2407")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	for _, m := range r.(*Group).remotes {
+		addrs = append(addrs, m.Remote.(*singleRemote).String())
+	}
+	if want := []string{"192.0.2.1:2407", "[2001:db8::1]:2407"}; !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("expected remotes %v, got %v", want, addrs)
+	}
+	if !reflect.DeepEqual(resolved, []string{"hook.test"}) {
+		t.Fatalf("expected a single call to Resolve for hook.test, got %v", resolved)
+	}
+	if sr.Queries() != 0 {
+		t.Fatal("resolvers were queried despite the Resolve hook")
+	}
+
+	cl.Resolve = func(host string) ([]net.IP, error) {
+		return nil, errors.New("no such host")
+	}
+	if _, err := cl.LookupServer("failing.test:2407"); err == nil {
+		t.Fatal("expected lookup to fail with a failing Resolve hook")
+	}
+}
+
+func TestServerNameForIP(t *testing.T) {
+	cl := newTestClient(t)
+	cl.Resolve = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")}, nil
+	}
+	cl.ServerNameForIP = func(ip net.IP) string {
+		switch ip.String() {
+		case "192.0.2.1":
+			return "node1.keyless.test"
+		case "192.0.2.2":
+			return "node2.keyless.test"
+		}
+		return ""
+	}
+	r, err := cl.LookupServer("keyless.test:2407")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]string)
+	for _, m := range r.(*Group).remotes {
+		single := m.Remote.(*singleRemote)
+		names[single.String()] = single.ServerName
+	}
+	want := map[string]string{
+		"192.0.2.1:2407": "node1.keyless.test",
+		"192.0.2.2:2407": "node2.keyless.test",
+		// falls back to the host name
+		"192.0.2.3:2407": "keyless.test",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected server names %v, got %v", want, names)
+	}
+}
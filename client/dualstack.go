@@ -0,0 +1,203 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// connectionAttemptDelay is the head start each dial of a dual-stack remote
+// gets before the next address is tried, as recommended by RFC 8305.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// A dualStackRemote is a single host reachable at several addresses,
+// typically both IPv4 and IPv6, which are raced against each other.
+type dualStackRemote struct {
+	// remotes alternates between address families, IPv6 first.
+	remotes []*singleRemote
+
+	mu sync.Mutex
+	// preferred is the index of the remote which last won a race.
+	preferred int
+}
+
+// NewDualStackServer creates a new remote for a single keyserver reachable at
+// each of addrs, e.g. the IPv4 and IPv6 addresses of a host name. Dials race
+// the addresses as described by RFC 8305 ("Happy Eyeballs"): addresses are
+// tried in turn, alternating between IPv6 and IPv4, each with a head start of
+// 250 milliseconds over the next, and the first established connection wins.
+// The other dials are canceled. Later dials start with the address which won
+// last, so that a host whose IPv6 routes blackhole only costs a head start
+// once.
+func NewDualStackServer(serverName string, addrs []net.Addr) (Remote, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("attempted to create dual-stack remote without addresses")
+	}
+
+	var v6, v4 []*singleRemote
+	for _, addr := range addrs {
+		s := &singleRemote{Addr: addr, ServerName: serverName}
+		if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP.To4() != nil {
+			v4 = append(v4, s)
+		} else {
+			v6 = append(v6, s)
+		}
+	}
+
+	r := &dualStackRemote{}
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			r.remotes = append(r.remotes, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			r.remotes = append(r.remotes, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return r, nil
+}
+
+// Dial races a dial to each address, returning the first connection
+// established.
+func (r *dualStackRemote) Dial(c *Client) (*Conn, error) {
+	return r.DialContext(context.Background(), c)
+}
+
+// DialContext is like Dial, but all dials are aborted once ctx is done.
+func (r *dualStackRemote) DialContext(ctx context.Context, c *Client) (*Conn, error) {
+	r.mu.Lock()
+	preferred := r.preferred
+	r.mu.Unlock()
+
+	// losers are canceled once a dial wins
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i   int
+		cn  *Conn
+		err error
+	}
+	results := make(chan result, len(r.remotes))
+	launched := 0
+	launch := func() <-chan time.Time {
+		i := (preferred + launched) % len(r.remotes)
+		launched++
+		go func() {
+			cn, err := r.remotes[i].DialContext(ctx, c)
+			results <- result{i, cn, err}
+		}()
+		if launched == len(r.remotes) {
+			return nil
+		}
+		return time.After(connectionAttemptDelay)
+	}
+
+	next := launch()
+	var errs []error
+	for pending := 1; pending > 0; {
+		select {
+		case <-next:
+			next = launch()
+			pending++
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				r.mu.Lock()
+				r.preferred = res.i
+				r.mu.Unlock()
+				// dials which complete regardless of the cancelation
+				// are returned to the pool
+				go func(n int) {
+					for ; n > 0; n-- {
+						if res := <-results; res.err == nil {
+							res.cn.KeepAlive()
+						}
+					}
+				}(pending)
+				return res.cn, nil
+			}
+			errs = append(errs, res.err)
+			// a failed dial gives up its head start
+			if launched < len(r.remotes) {
+				next = launch()
+				pending++
+			}
+		}
+	}
+	return nil, combineErrors(errs)
+}
+
+// PingAll pings each address.
+func (r *dualStackRemote) PingAll(c *Client, concurrency int) {
+	for _, s := range r.remotes {
+		s.PingAll(c, concurrency)
+	}
+}
+
+// IsHealthy reports whether any address is healthy.
+func (r *dualStackRemote) IsHealthy(c *Client) bool {
+	for _, s := range r.remotes {
+		if s.IsHealthy(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn returns an established connection to an address, preferring the one
+// which won the last race, without dialing.
+func (r *dualStackRemote) Conn() (*Conn, bool) {
+	r.mu.Lock()
+	preferred := r.preferred
+	r.mu.Unlock()
+	for i := range r.remotes {
+		if cn, ok := r.remotes[(preferred+i)%len(r.remotes)].Conn(); ok {
+			return cn, true
+		}
+	}
+	return nil, false
+}
+
+// inFlight returns the number of callers using a connection to any address.
+func (r *dualStackRemote) inFlight() int {
+	var n int
+	for _, s := range r.remotes {
+		n += s.inFlight()
+	}
+	return n
+}
+
+// reapIdle closes the pooled connections to each address which haven't been
+// used for maxIdle.
+func (r *dualStackRemote) reapIdle(maxIdle time.Duration) {
+	for _, s := range r.remotes {
+		s.reapIdle(maxIdle)
+	}
+}
+
+// closeGracefully is like Close, but drains the connections to each address
+// for up to timeout.
+func (r *dualStackRemote) closeGracefully(timeout time.Duration) error {
+	var errs []error
+	for _, s := range r.remotes {
+		if err := s.closeGracefully(timeout); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+// Close closes all pooled connections to each address.
+func (r *dualStackRemote) Close() error {
+	var errs []error
+	for _, s := range r.remotes {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
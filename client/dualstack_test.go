@@ -0,0 +1,80 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newBlackhole starts a listener on network and address which accepts
+// connections but never answers on them.
+func newBlackhole(t *testing.T, network, address string) (net.Listener, *int32) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", address, err)
+	}
+	accepted := new(int32)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l, accepted
+}
+
+func TestDualStackServer(t *testing.T) {
+	v6, accepted := newBlackhole(t, "tcp6", "[::1]:0")
+	defer v6.Close()
+	v4 := newTestServer(t)
+
+	r, err := NewDualStackServer("localhost", []net.Addr{v4, v6.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	start := time.Now()
+	conn, err := r.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dial took %v despite the IPv4 address being reachable", elapsed)
+	}
+	if conn.addr != v4.String() {
+		t.Fatalf("expected a connection to %v, got %v", v4, conn.addr)
+	}
+	if err := conn.Ping(nil); err != nil {
+		t.Fatal(err)
+	}
+	// IPv6 is tried first
+	if atomic.LoadInt32(accepted) != 1 {
+		t.Fatal("IPv6 address was not dialed first")
+	}
+
+	// the winner is dialed first from then on
+	conn, err = r.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+	if atomic.LoadInt32(accepted) != 1 {
+		t.Fatal("blackholed address was dialed again")
+	}
+
+	if _, err := NewDualStackServer("localhost", nil); err == nil {
+		t.Fatal("expected an error without addresses")
+	}
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// A HealthEventKind is the kind of transition a HealthEvent reports.
+type HealthEventKind int
+
+const (
+	// RemoteDown is published when a member of a Group becomes unhealthy,
+	// i.e. a dial, ping or operation failed after it was healthy.
+	RemoteDown HealthEventKind = iota
+	// RemoteUp is published when a member of a Group becomes healthy again.
+	RemoteUp
+	// BreakerOpened is published when the circuit breaker of a member
+	// opens, see Client.BreakerThreshold.
+	BreakerOpened
+	// BreakerClosed is published when the circuit breaker of a member
+	// closes again.
+	BreakerClosed
+	// LatencyAbove is published when the moving average of the latencies
+	// of a member rises above Client.LatencyThreshold.
+	LatencyAbove
+	// LatencyBelow is published when it falls back below the threshold.
+	LatencyBelow
+)
+
+func (k HealthEventKind) String() string {
+	switch k {
+	case RemoteDown:
+		return "down"
+	case RemoteUp:
+		return "up"
+	case BreakerOpened:
+		return "breaker opened"
+	case BreakerClosed:
+		return "breaker closed"
+	case LatencyAbove:
+		return "latency above threshold"
+	case LatencyBelow:
+		return "latency below threshold"
+	}
+	return "unknown"
+}
+
+// A HealthEvent reports a transition of the health of a member of a Group,
+// e.g. to forward to an alerting system. See Client.SubscribeHealth.
+type HealthEvent struct {
+	// Remote is the member.
+	Remote Remote
+	Kind   HealthEventKind
+	// Latency is the moving average of the latencies of the member, or
+	// zero if it's unmeasured, e.g. after a failure.
+	Latency time.Duration
+	// Err is the error of the failure which made the member unhealthy or
+	// opened its breaker, and nil for other kinds.
+	Err  error
+	Time time.Time
+}
+
+// healthSubscribers is the set of channels of Client.SubscribeHealth.
+type healthSubscribers struct {
+	mu   sync.Mutex
+	subs map[chan HealthEvent]struct{}
+}
+
+// SubscribeHealth returns a channel receiving the HealthEvents of the members
+// of all the Groups dialed with c, in the order they happen, along with a
+// function which unsubscribes and closes the channel. Events are sent
+// without blocking, so that a slow consumer can't stall dials: the channel
+// buffers up to buffer events, and events which don't fit are dropped.
+func (c *Client) SubscribeHealth(buffer int) (<-chan HealthEvent, func()) {
+	ch := make(chan HealthEvent, buffer)
+	c.health.mu.Lock()
+	if c.health.subs == nil {
+		c.health.subs = make(map[chan HealthEvent]struct{})
+	}
+	c.health.subs[ch] = struct{}{}
+	c.health.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			c.health.mu.Lock()
+			delete(c.health.subs, ch)
+			c.health.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// publish sends an event of kind about m to the subscribers of c. The Group
+// holding m must be locked.
+func (c *Client) publish(m *Member, kind HealthEventKind, err error) {
+	c.health.mu.Lock()
+	defer c.health.mu.Unlock()
+	if len(c.health.subs) == 0 {
+		return
+	}
+	ev := HealthEvent{Remote: m.Remote, Kind: kind, Latency: m.latency.val, Err: err, Time: timeNow()}
+	for ch := range c.health.subs {
+		select {
+		case ch <- ev:
+		default:
+			c.logger().Debugf("dropped %s event of a slow health subscriber", kind)
+		}
+	}
+}
+
+// checkLatency publishes LatencyAbove or LatencyBelow if the moving average
+// of m crossed c.LatencyThreshold since it was last checked. The Group
+// holding m must be locked.
+func (m *Member) checkLatency(c *Client) {
+	if c.LatencyThreshold <= 0 || !m.latency.measured {
+		return
+	}
+	slow := m.latency.val > c.LatencyThreshold
+	if slow == m.slow {
+		return
+	}
+	m.slow = slow
+	if slow {
+		c.publish(m, LatencyAbove, nil)
+	} else {
+		c.publish(m, LatencyBelow, nil)
+	}
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// A failoverRemote dials a backup remote only when its primary remote can't
+// be dialed.
+type failoverRemote struct {
+	primary, backup Remote
+}
+
+// NewFailoverRemote creates a new remote which dials primary, typically a
+// Group, and falls back to backup when the dial to primary fails, e.g. when
+// all of its servers are down. Each dial tries primary first, so traffic
+// returns to it as soon as it recovers.
+func NewFailoverRemote(primary, backup Remote) Remote {
+	return &failoverRemote{primary: primary, backup: backup}
+}
+
+// Dial dials the primary remote, or the backup remote if that fails.
+func (r *failoverRemote) Dial(c *Client) (*Conn, error) {
+	return r.DialContext(context.Background(), c)
+}
+
+// DialContext is like Dial, but the dials are aborted once ctx is done.
+func (r *failoverRemote) DialContext(ctx context.Context, c *Client) (*Conn, error) {
+	cn, err := r.primary.DialContext(ctx, c)
+	if err == nil {
+		return cn, nil
+	}
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	cn, backupErr := r.backup.DialContext(ctx, c)
+	if backupErr != nil {
+		return nil, combineErrors([]error{err, backupErr})
+	}
+	return cn, nil
+}
+
+// PingAll pings both the primary and backup remotes.
+func (r *failoverRemote) PingAll(c *Client, concurrency int) {
+	r.primary.PingAll(c, concurrency)
+	r.backup.PingAll(c, concurrency)
+}
+
+// IsHealthy reports whether either remote is healthy.
+func (r *failoverRemote) IsHealthy(c *Client) bool {
+	return r.primary.IsHealthy(c) || r.backup.IsHealthy(c)
+}
+
+// Conn returns an established connection to the primary remote, or else to
+// the backup remote, without dialing.
+func (r *failoverRemote) Conn() (*Conn, bool) {
+	for _, rr := range []Remote{r.primary, r.backup} {
+		if cr, ok := rr.(conner); ok {
+			if cn, ok := cr.Conn(); ok {
+				return cn, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// inFlight returns the number of callers using a connection to either
+// remote.
+func (r *failoverRemote) inFlight() int {
+	var n int
+	for _, rr := range []Remote{r.primary, r.backup} {
+		if f, ok := rr.(inFlighter); ok {
+			n += f.inFlight()
+		}
+	}
+	return n
+}
+
+// reapIdle closes the pooled connections to either remote which haven't been
+// used for maxIdle.
+func (r *failoverRemote) reapIdle(maxIdle time.Duration) {
+	for _, rr := range []Remote{r.primary, r.backup} {
+		if reaper, ok := rr.(idleReaper); ok {
+			reaper.reapIdle(maxIdle)
+		}
+	}
+}
+
+// closeGracefully is like Close, but drains the connections to either remote
+// for up to timeout.
+func (r *failoverRemote) closeGracefully(timeout time.Duration) error {
+	var errs []error
+	for _, rr := range []Remote{r.primary, r.backup} {
+		if err := closeRemote(rr, timeout); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+// Close closes both the primary and backup remotes.
+func (r *failoverRemote) Close() error {
+	var errs []error
+	for _, rr := range []Remote{r.primary, r.backup} {
+		if err := rr.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
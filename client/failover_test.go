@@ -0,0 +1,48 @@
+package client
+
+import "testing"
+
+func TestFailoverRemote(t *testing.T) {
+	primaryAddr, backupAddr := newTestServer(t), newTestServer(t)
+	primary := &flakyRemote{Remote: NewServer(primaryAddr, "localhost")}
+	r := NewFailoverRemote(primary, NewServer(backupAddr, "localhost"))
+	defer r.Close()
+
+	dial := func() string {
+		conn, err := r.Dial(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.KeepAlive()
+		if err := conn.Ping(nil); err != nil {
+			t.Fatal(err)
+		}
+		return conn.addr
+	}
+
+	if addr := dial(); addr != primaryAddr.String() {
+		t.Fatalf("expected the primary to be dialed, got %s", addr)
+	}
+
+	primary.setFailing(true)
+	if addr := dial(); addr != backupAddr.String() {
+		t.Fatalf("expected the backup to be dialed while the primary fails, got %s", addr)
+	}
+
+	// traffic returns to the primary once it recovers
+	primary.setFailing(false)
+	dials := primary.Dials()
+	if addr := dial(); addr != primaryAddr.String() {
+		t.Fatalf("expected the recovered primary to be dialed, got %s", addr)
+	}
+	if primary.Dials() != dials+1 {
+		t.Fatal("recovered primary was not dialed first")
+	}
+
+	// both failing
+	deadPrimary := &flakyRemote{Remote: NewServer(primaryAddr, "localhost"), failing: 1}
+	deadBackup := &flakyRemote{Remote: NewServer(backupAddr, "localhost"), failing: 1}
+	if _, err := NewFailoverRemote(deadPrimary, deadBackup).Dial(c); err == nil {
+		t.Fatal("expected dial to fail with both remotes failing")
+	}
+}
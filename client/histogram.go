@@ -0,0 +1,85 @@
+package client
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// histogramMin is the upper bound of the first bucket of a
+	// latencyHistogram, which also holds all faster samples.
+	histogramMin = 50 * time.Microsecond
+	// histogramGrowth is the ratio between the bounds of consecutive
+	// buckets, so that a percentile is reported within 5% of the samples
+	// it's taken from.
+	histogramGrowth = 1.1
+	// histogramBuckets covers latencies up to about 200 seconds.
+	histogramBuckets = 160
+	// histogramDecay is the number of samples at which the counts are
+	// halved, so that the percentiles follow recent pings rather than the
+	// whole lifetime of a member.
+	histogramDecay = 1024
+)
+
+// latencyHistogram counts ping latencies in buckets whose bounds grow
+// exponentially, so that percentiles can be estimated in constant space.
+type latencyHistogram struct {
+	counts [histogramBuckets]uint32
+	total  int
+}
+
+// bucketOf returns the index of the bucket holding d.
+func bucketOf(d time.Duration) int {
+	if d <= histogramMin {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(float64(d)/float64(histogramMin)) / math.Log(histogramGrowth)))
+	if i >= histogramBuckets {
+		return histogramBuckets - 1
+	}
+	return i
+}
+
+// bucketBound returns the upper bound of bucket i.
+func bucketBound(i int) float64 {
+	return float64(histogramMin) * math.Pow(histogramGrowth, float64(i))
+}
+
+// Add counts a sample of d.
+func (h *latencyHistogram) Add(d time.Duration) {
+	if h.total >= histogramDecay {
+		h.total = 0
+		for i := range h.counts {
+			h.counts[i] /= 2
+			h.total += int(h.counts[i])
+		}
+	}
+	h.counts[bucketOf(d)]++
+	h.total++
+}
+
+// Percentile returns an estimate of the q-th quantile, in (0, 1], of the
+// samples, and whether there are any.
+func (h *latencyHistogram) Percentile(q float64) (time.Duration, bool) {
+	if h.total == 0 {
+		return 0, false
+	}
+	rank := int(math.Ceil(q * float64(h.total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int
+	for i, n := range h.counts {
+		seen += int(n)
+		if seen < rank {
+			continue
+		}
+		if i == 0 {
+			return histogramMin, true
+		}
+		// the middle of the bucket is within half its width of any
+		// sample in it
+		return time.Duration((bucketBound(i-1) + bucketBound(i)) / 2), true
+	}
+	return time.Duration(bucketBound(histogramBuckets - 1)), true
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
@@ -9,8 +10,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"time"
 
-	"github.com/cloudflare/cfssl/log"
 	"github.com/cloudflare/gokeyless/protocol"
 	"golang.org/x/crypto/ed25519"
 )
@@ -94,6 +95,60 @@ func (key *PrivateKey) Public() crypto.PublicKey {
 	return key.public
 }
 
+// DoWithRetry dials r and runs op on the connection. If op fails at the
+// connection level, i.e. with any error but a protocol.Error returned by the
+// server, the connection is dropped and op is retried on a new one, up to
+// maxRetries times. If r is a Group, the member whose connection failed is
+// recorded as failing, and isn't dialed again by the retries unless no other
+// member is left, so that op fails over to the next best member. The error
+// of the last attempt is returned; dial errors aren't retried, as Groups
+// already retry dials. The outcome of each attempt on a member of a Group is
+// reported to it as by Group.Observe, with internal errors of the server
+// counted as failures although they aren't retried.
+func (c *Client) DoWithRetry(r Remote, op func(*Conn) error, maxRetries int) error {
+	g, isGroup := r.(*Group)
+	failed := make(map[string]bool)
+	for attempt := 0; ; attempt++ {
+		var conn *Conn
+		var err error
+		if isGroup && len(failed) != 0 {
+			conn, _, err = g.dial(context.Background(), c, &excludingPolicy{g: g, c: c, exclude: failed}, false)
+		} else {
+			conn, err = r.Dial(c)
+		}
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		err = op(conn)
+		latency := time.Since(start)
+		var serverErr protocol.Error
+		if err == nil || errors.As(err, &serverErr) {
+			conn.KeepAlive()
+			if isGroup {
+				// the server answered, though it may have failed
+				// internally
+				var observed error
+				if serverErr == protocol.ErrInternal {
+					observed = err
+				}
+				g.observeAddr(c, conn.addr, latency, observed)
+			}
+			return err
+		}
+		conn.discard(CloseReasonOpFailed)
+		if isGroup {
+			g.observeAddr(c, conn.addr, latency, err)
+		}
+		if attempt >= maxRetries {
+			return err
+		}
+		failed[conn.addr] = true
+		c.logger().Infof("retrying operation failed on %s: %v", conn.addr, err)
+	}
+}
+
 // execute performs an opaque cryptographic operation on a server associated
 // with the key.
 func (key *PrivateKey) execute(op protocol.Op, msg []byte) ([]byte, error) {
@@ -120,11 +175,11 @@ func (key *PrivateKey) execute(op protocol.Op, msg []byte) ([]byte, error) {
 			CertID:   key.certID,
 		})
 		if err != nil {
-			conn.Close()
+			conn.closeFor(CloseReasonOpFailed)
 			// not the last attempt, log error and retry
 			if attempts > 1 {
-				log.Info("failed remote operation:", err)
-				log.Infof("retry new connction")
+				key.client.logger().Infof("failed remote operation: %v", err)
+				key.client.logger().Infof("retry new connction")
 				continue
 			}
 			return nil, err
@@ -0,0 +1,32 @@
+package client
+
+import "github.com/cloudflare/cfssl/log"
+
+// A Logger receives the log messages of a Client, so that they can be routed
+// to a logging library such as zap, logr or slog, at a verbosity chosen per
+// Client. Implementations must be safe for concurrent use.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warningf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// cfsslLogger logs with the global logger of the cfssl log package.
+type cfsslLogger struct{}
+
+func (cfsslLogger) Debugf(format string, v ...interface{})   { log.Debugf(format, v...) }
+func (cfsslLogger) Infof(format string, v ...interface{})    { log.Infof(format, v...) }
+func (cfsslLogger) Warningf(format string, v ...interface{}) { log.Warningf(format, v...) }
+func (cfsslLogger) Errorf(format string, v ...interface{})   { log.Errorf(format, v...) }
+
+// defaultLogger logs the messages which aren't tied to a Client, e.g. those
+// of an AddrSet, and those of Clients without a Logger.
+var defaultLogger Logger = cfsslLogger{}
+
+func (c *Client) logger() Logger {
+	if c.Logger == nil {
+		return defaultLogger
+	}
+	return c.Logger
+}
@@ -0,0 +1,56 @@
+package client
+
+import "time"
+
+// Metrics receives events about the keyservers a Client connects to, labeled
+// by TLS server name and address. Implementations must be safe for
+// concurrent use. The prommetrics package provides a Prometheus
+// implementation.
+type Metrics interface {
+	// Dial is called before a new connection to a keyserver is dialed.
+	Dial(serverName, addr string)
+	// DialFailure is called when dialing a new connection fails.
+	DialFailure(serverName, addr string)
+	// PingFailure is called when a health check ping fails.
+	PingFailure(serverName, addr string)
+	// BlacklistRejection is called when a keyserver is not dialed because
+	// it's on the client blacklist.
+	BlacklistRejection(serverName, addr string)
+	// Latency is called with the round trip time of each successful
+	// health check ping.
+	Latency(serverName, addr string, d time.Duration)
+}
+
+// ReuseMetrics may be implemented by Metrics to also receive the dials which
+// were served by a pooled connection, along with Dial for those which open a
+// new one, e.g. to tune MaxConnsPerRemote and MaxConnLifetime.
+type ReuseMetrics interface {
+	// Reuse is called when a dial returns a pooled connection.
+	Reuse(serverName, addr string)
+}
+
+// HandshakeMetrics may be implemented by Metrics to also receive the TLS
+// handshakes of the connections dialed, e.g. to check that
+// Config.ClientSessionCache or Client.SessionCacheSize make them resume
+// sessions rather than pay for full handshakes.
+type HandshakeMetrics interface {
+	// Handshake is called when the TLS handshake of a new connection
+	// completes, with whether it resumed a session.
+	Handshake(serverName, addr string, resumed bool)
+}
+
+// nopMetrics discards all events.
+type nopMetrics struct{}
+
+func (nopMetrics) Dial(serverName, addr string)                     {}
+func (nopMetrics) DialFailure(serverName, addr string)              {}
+func (nopMetrics) PingFailure(serverName, addr string)              {}
+func (nopMetrics) BlacklistRejection(serverName, addr string)       {}
+func (nopMetrics) Latency(serverName, addr string, d time.Duration) {}
+
+func (c *Client) metrics() Metrics {
+	if c.Metrics == nil {
+		return nopMetrics{}
+	}
+	return c.Metrics
+}
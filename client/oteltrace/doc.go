@@ -0,0 +1,9 @@
+// Package oteltrace adapts OpenTelemetry tracers to client.Tracer, so that the
+// DNS lookups, dials and health check pings of a client.Client show up in
+// OpenTelemetry traces:
+//
+//	c.Tracer = oteltrace.New(otel.Tracer("gokeyless"))
+//
+// The adapter is built with the otel build tag, so that only the programs
+// using it require go.opentelemetry.io/otel.
+package oteltrace
@@ -0,0 +1,45 @@
+// +build otel
+
+package oteltrace
+
+import (
+	"context"
+
+	"github.com/cloudflare/gokeyless/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// New returns a client.Tracer which starts its spans with t, as client spans.
+func New(t trace.Tracer) client.Tracer {
+	return tracer{t}
+}
+
+type tracer struct {
+	t trace.Tracer
+}
+
+func (t tracer) Start(ctx context.Context, name string) (context.Context, client.Span) {
+	ctx, s := t.t.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, span{s}
+}
+
+// span adapts a trace.Span to client.Span. Errors are recorded as events of
+// the span, and set its status.
+type span struct {
+	s trace.Span
+}
+
+func (s span) SetAttribute(key, value string) {
+	s.s.SetAttributes(attribute.String(key, value))
+}
+
+func (s span) RecordError(err error) {
+	s.s.RecordError(err)
+	s.s.SetStatus(codes.Error, err.Error())
+}
+
+func (s span) End() {
+	s.s.End()
+}
@@ -0,0 +1,485 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// A Policy decides which members of a Group are dialed. Its methods are
+// called with the Group locked, so they may read and update the state of
+// members without further synchronization, but must not block.
+type Policy interface {
+	// Pick returns the member to dial out of candidates, which excludes
+	// members whose circuit breaker is open. If the dial fails, Pick is
+	// called again without the failed member, up to three times in total.
+	Pick(candidates []*Member) (*Member, error)
+	// Observe is called with the outcome of each health check ping of m
+	// by PingAll, and of each operation reported by Group.Observe. latency
+	// is only meaningful if err is nil. err is a protocol.Error, possibly
+	// wrapped, if the server was reached but answered with an error.
+	Observe(m *Member, latency time.Duration, err error)
+}
+
+const defaultLatencyAlpha = 0.5
+
+// LatencyPolicy prefers the members with the lowest moving average of ping
+// latencies, breaking ties by error count, and then at random. It picks one
+// of the best three at random to spread load between servers of similar
+// latency. It is the default Policy of a Group.
+type LatencyPolicy struct {
+	// Alpha is the smoothing factor, in (0, 1), of the moving average. A
+	// smaller alpha gives each new sample less weight, so routing adapts
+	// more slowly but flaps less on noisy networks. Zero, or a value out of
+	// range, means 0.5.
+	Alpha float64
+	// Percentile, if in (0, 1), ranks members by that quantile of their
+	// ping latencies instead of the moving average, e.g. 0.99 to avoid
+	// servers with a long tail of slow responses. It requires
+	// Client.LatencyPercentiles; members without percentiles are ranked
+	// by the moving average.
+	Percentile float64
+	// ResetAfter is the number of consecutive failed pings or operations
+	// after which the moving average of a member is discarded, making it
+	// unmeasured, so that a member which is mostly fine keeps its rank
+	// across a transient failure. Zero means 1: the average is discarded
+	// by any failure.
+	ResetAfter int
+}
+
+// Pick implements Policy.
+func (p LatencyPolicy) Pick(candidates []*Member) (*Member, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("no remote to pick from")
+	}
+	ranked := append([]*Member(nil), candidates...)
+	// shuffle first, so that ties, such as between members of a new Group
+	// which haven't been measured yet, don't always favor the same ones
+	rand.Shuffle(len(ranked), func(i, j int) { ranked[i], ranked[j] = ranked[j], ranked[i] })
+	sort.SliceStable(ranked, func(i, j int) bool { return p.better(ranked[i], ranked[j]) })
+	// Because of potential expensive fresh tls dial operation,
+	// only the best few are considered.
+	n := 3
+	if len(ranked) < n {
+		n = len(ranked)
+	}
+	return ranked[rand.Intn(n)], nil
+}
+
+// Observe implements Policy.
+func (p LatencyPolicy) Observe(m *Member, latency time.Duration, err error) {
+	if err != nil {
+		// m.failures already counts err
+		if n := p.resetAfter(); n == 1 || m.failures >= n {
+			m.latency.Reset()
+		}
+		return
+	}
+	m.latency.Update(latency, p.alpha())
+}
+
+func (p LatencyPolicy) resetAfter() int {
+	if p.ResetAfter <= 0 {
+		return 1
+	}
+	return p.ResetAfter
+}
+
+func (p LatencyPolicy) alpha() float64 {
+	if p.Alpha <= 0 || p.Alpha >= 1 {
+		return defaultLatencyAlpha
+	}
+	return p.Alpha
+}
+
+// checkAlpha warns through logger if p is a LatencyPolicy, or an SRVPolicy,
+// whose Alpha is out of range. It's called once when a Policy is installed,
+// rather than by alpha on every sample.
+func checkAlpha(p Policy, logger Logger) {
+	var lp LatencyPolicy
+	switch p := p.(type) {
+	case LatencyPolicy:
+		lp = p
+	case *LatencyPolicy:
+		lp = *p
+	case SRVPolicy:
+		lp = p.LatencyPolicy
+	case *SRVPolicy:
+		lp = p.LatencyPolicy
+	default:
+		return
+	}
+	if lp.Alpha != 0 && lp.alpha() != lp.Alpha {
+		logger.Warningf("latency alpha %v out of range (0, 1), using %v", lp.Alpha, defaultLatencyAlpha)
+	}
+}
+
+// better reports whether p prefers a over b, as betterMember does but by
+// p.Percentile if set and both have been measured.
+func (p LatencyPolicy) better(a, b *Member) bool {
+	if p.Percentile <= 0 || p.Percentile >= 1 || !a.latency.measured || !b.latency.measured {
+		return betterMember(a, b)
+	}
+	pa, okA := a.Percentile(p.Percentile)
+	pb, okB := b.Percentile(p.Percentile)
+	if !okA || !okB {
+		return betterMember(a, b)
+	}
+	if pa != pb {
+		return pa < pb
+	}
+	return a.errorCount < b.errorCount
+}
+
+// PowerOfTwoPolicy samples two members at random and picks the one which
+// LatencyPolicy would prefer. Compared to LatencyPolicy, it still favors fast
+// servers but spreads load more evenly, so callers don't stampede the single
+// fastest server until its latency degrades. Latencies are measured as by the
+// embedded LatencyPolicy.
+type PowerOfTwoPolicy struct {
+	LatencyPolicy
+}
+
+// Pick implements Policy.
+func (p PowerOfTwoPolicy) Pick(candidates []*Member) (*Member, error) {
+	switch len(candidates) {
+	case 0:
+		return nil, errors.New("no remote to pick from")
+	case 1:
+		return candidates[0], nil
+	}
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if p.better(candidates[j], candidates[i]) {
+		return candidates[j], nil
+	}
+	return candidates[i], nil
+}
+
+// InverseLatencyPolicy picks members at random with a probability
+// proportional to the inverse of their moving average of ping latencies, so
+// that a server twice as fast gets twice the traffic. Compared to
+// LatencyPolicy, slow servers still get some traffic, and load doesn't
+// oscillate between servers of similar latency. Unhealthy members are only
+// picked if all candidates are, and members which haven't been measured are
+// only picked, uniformly at random, while none of the candidates has been.
+// Latencies are measured as by the embedded LatencyPolicy.
+type InverseLatencyPolicy struct {
+	LatencyPolicy
+}
+
+// minInverseLatency bounds the weight of a member whose measured latency
+// is zero.
+const minInverseLatency = time.Microsecond
+
+// Pick implements Policy.
+func (p InverseLatencyPolicy) Pick(candidates []*Member) (*Member, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("no remote to pick from")
+	}
+	var healthy []*Member
+	for _, m := range candidates {
+		if m.healthy() {
+			healthy = append(healthy, m)
+		}
+	}
+	if len(healthy) != 0 {
+		candidates = healthy
+	}
+
+	weights := make([]float64, len(candidates))
+	var total float64
+	for i, m := range candidates {
+		if latency, ok := m.Latency(); ok {
+			if latency < minInverseLatency {
+				latency = minInverseLatency
+			}
+			weights[i] = 1 / float64(latency)
+			total += weights[i]
+		}
+	}
+	if total == 0 {
+		return candidates[rand.Intn(len(candidates))], nil
+	}
+	n := rand.Float64() * total
+	for i, m := range candidates {
+		if n < weights[i] {
+			return m, nil
+		}
+		n -= weights[i]
+	}
+	// rounding may leave n just above the last weight
+	for i := len(candidates) - 1; ; i-- {
+		if weights[i] > 0 {
+			return candidates[i], nil
+		}
+	}
+}
+
+// LeastConnectionsPolicy picks the member with the fewest operations in
+// flight, as reported by Member.InFlight, breaking ties by latency and error
+// count, and then at random. Unlike LatencyPolicy, it steers load away from
+// a fast server which is already saturated. Latencies are measured as by the
+// embedded LatencyPolicy.
+type LeastConnectionsPolicy struct {
+	LatencyPolicy
+}
+
+// Pick implements Policy.
+func (p LeastConnectionsPolicy) Pick(candidates []*Member) (*Member, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("no remote to pick from")
+	}
+	var best *Member
+	var bestInFlight int
+	// start at a random candidate, so that ties don't always favor the
+	// same ones
+	start := rand.Intn(len(candidates))
+	for i := range candidates {
+		m := candidates[(start+i)%len(candidates)]
+		n := m.InFlight()
+		if best == nil || n < bestInFlight || (n == bestInFlight && p.better(m, best)) {
+			best, bestInFlight = m, n
+		}
+	}
+	return best, nil
+}
+
+// WeightedPolicy picks members at random with a probability proportional to
+// the weights given to NewWeightedGroup, regardless of latency. Members with a
+// weight of zero are only picked if all candidates have a weight of zero.
+type WeightedPolicy struct{}
+
+// Pick implements Policy.
+func (WeightedPolicy) Pick(candidates []*Member) (*Member, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("no remote to pick from")
+	}
+	var total int
+	for _, m := range candidates {
+		total += m.weight
+	}
+	if total == 0 {
+		return candidates[rand.Intn(len(candidates))], nil
+	}
+	n := rand.Intn(total)
+	for _, m := range candidates {
+		if n < m.weight {
+			return m, nil
+		}
+		n -= m.weight
+	}
+	panic("unreachable")
+}
+
+// Observe implements Policy.
+func (WeightedPolicy) Observe(m *Member, latency time.Duration, err error) {}
+
+// SRVPolicy picks members as their SRV records direct (RFC 2782): only
+// candidates of the lowest priority value are considered, and one of them is
+// picked at random with a probability proportional to its SRV weight, or as
+// the embedded LatencyPolicy would if all their weights are zero. Members of
+// a higher priority value are thus only dialed once none of a lower one can
+// be, e.g. because their circuit breakers are open or dialing them failed.
+// A dial of the Group tries up to three members of each tier in turn.
+// Members which weren't discovered through SRV records have a priority and
+// weight of zero. It is the Policy of the Groups made by
+// Client.LookupServerSRV.
+type SRVPolicy struct {
+	LatencyPolicy
+}
+
+// Pick implements Policy.
+func (p SRVPolicy) Pick(candidates []*Member) (*Member, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("no remote to pick from")
+	}
+	var tier []*Member
+	var tierPriority uint16
+	for _, m := range candidates {
+		priority, _ := srvOf(m)
+		if tier == nil || priority < tierPriority {
+			tier, tierPriority = nil, priority
+		}
+		if priority == tierPriority {
+			tier = append(tier, m)
+		}
+	}
+
+	var total int
+	for _, m := range tier {
+		_, weight := srvOf(m)
+		total += int(weight)
+	}
+	if total == 0 {
+		return p.LatencyPolicy.Pick(tier)
+	}
+	n := rand.Intn(total)
+	for _, m := range tier {
+		_, weight := srvOf(m)
+		if n < int(weight) {
+			return m, nil
+		}
+		n -= int(weight)
+	}
+	panic("unreachable")
+}
+
+// srvOf returns the priority and weight of the SRV record m was discovered
+// through, if any.
+func srvOf(m *Member) (priority, weight uint16) {
+	if single, ok := m.Remote.(*singleRemote); ok {
+		return single.priority, single.weight
+	}
+	return 0, 0
+}
+
+// nextSRVTiers returns the candidates of a higher SRV priority value than m,
+// which p picks from once the tier of m is exhausted, or nil if p isn't an
+// SRVPolicy.
+func nextSRVTiers(p Policy, candidates []*Member, m *Member) []*Member {
+	switch p.(type) {
+	case SRVPolicy, *SRVPolicy:
+	default:
+		return nil
+	}
+	priority, _ := srvOf(m)
+	var next []*Member
+	for _, cand := range candidates {
+		if p, _ := srvOf(cand); p > priority {
+			next = append(next, cand)
+		}
+	}
+	return next
+}
+
+// RoundRobinPolicy cycles through the members of a Group in order, spreading
+// dials evenly regardless of latency. Members which can't be dialed are
+// skipped in favor of the next one. A RoundRobinPolicy must not be shared
+// between Groups.
+type RoundRobinPolicy struct {
+	// next is the position of the member to be picked next.
+	next int
+}
+
+// Pick implements Policy.
+func (p *RoundRobinPolicy) Pick(candidates []*Member) (*Member, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("no remote to pick from")
+	}
+	// pick the first candidate at or after next, wrapping around to the
+	// first candidate overall
+	var picked, first *Member
+	for _, m := range candidates {
+		if m.pos >= p.next && (picked == nil || m.pos < picked.pos) {
+			picked = m
+		}
+		if first == nil || m.pos < first.pos {
+			first = m
+		}
+	}
+	if picked == nil {
+		picked = first
+	}
+	p.next = picked.pos + 1
+	return picked, nil
+}
+
+// Observe implements Policy.
+func (p *RoundRobinPolicy) Observe(m *Member, latency time.Duration, err error) {}
+
+// rendezvousPolicy picks the member with the highest rendezvous hash of key,
+// which is used by Group.DialForKey. Members are identified by address and
+// server name, or by their position in the Group for other remotes.
+type rendezvousPolicy struct {
+	key []byte
+}
+
+// Pick implements Policy.
+func (p rendezvousPolicy) Pick(candidates []*Member) (*Member, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("no remote to pick from")
+	}
+	var best *Member
+	var bestScore uint64
+	for _, m := range candidates {
+		h := fnv.New64a()
+		h.Write(p.key)
+		if single, ok := m.Remote.(*singleRemote); ok {
+			fmt.Fprintf(h, "\x00%s\x00%s\x00%s", single.Network(), single.String(), single.ServerName)
+		} else {
+			fmt.Fprintf(h, "\x00%d", m.pos)
+		}
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	return best, nil
+}
+
+// Observe implements Policy.
+func (p rendezvousPolicy) Observe(m *Member, latency time.Duration, err error) {}
+
+// excludingPolicy picks members as the Policy of a Group would, but avoids
+// the single servers whose addresses are in exclude unless no other
+// candidate is left. It is used by Client.DoWithRetry.
+type excludingPolicy struct {
+	g       *Group
+	c       *Client
+	exclude map[string]bool
+}
+
+// Pick implements Policy.
+func (p *excludingPolicy) Pick(candidates []*Member) (*Member, error) {
+	var rest []*Member
+	for _, m := range candidates {
+		if single, ok := m.Remote.(*singleRemote); !ok || !p.exclude[single.String()] {
+			rest = append(rest, m)
+		}
+	}
+	if len(rest) == 0 {
+		rest = candidates
+	}
+	return p.g.policyFor(p.c).Pick(rest)
+}
+
+// Observe implements Policy.
+func (p *excludingPolicy) Observe(m *Member, latency time.Duration, err error) {}
+
+// byLatency sorts members by latency, breaking ties by error count.
+type byLatency []*Member
+
+// Len(), Less(i, j) and Swap(i,j) implements sort.Interface
+
+// Len returns the number of members
+func (s byLatency) Len() int {
+	return len(s)
+}
+
+// Swap swaps member i and member j in the list
+func (s byLatency) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Less compares two members at position i and j based on latency
+func (s byLatency) Less(i, j int) bool {
+	return betterMember(s[i], s[j])
+}
+
+// betterMember reports whether a has a better latency than b, breaking ties
+// by error count.
+func betterMember(a, b *Member) bool {
+	if a.latency.Better(b.latency) {
+		return true
+	}
+	if b.latency.Better(a.latency) {
+		return false
+	}
+	return a.errorCount < b.errorCount
+}
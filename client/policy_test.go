@@ -0,0 +1,710 @@
+package client
+
+import (
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingPolicy always picks the last candidate and records observations.
+type recordingPolicy struct {
+	picks    int
+	observed map[*Member]error
+}
+
+func (p *recordingPolicy) Pick(candidates []*Member) (*Member, error) {
+	p.picks++
+	return candidates[len(candidates)-1], nil
+}
+
+func (p *recordingPolicy) Observe(m *Member, latency time.Duration, err error) {
+	if p.observed == nil {
+		p.observed = make(map[*Member]error)
+	}
+	p.observed[m] = err
+}
+
+func TestLatencyPolicyPick(t *testing.T) {
+	var members []*Member
+	for i := 0; i < 5; i++ {
+		m := &Member{}
+		if i < 4 {
+			m.latency.Update(time.Duration(i+1)*time.Millisecond, defaultLatencyAlpha)
+		}
+		members = append(members, m)
+	}
+	// list the unmeasured and slowest members first
+	members[0], members[4] = members[4], members[0]
+
+	var p LatencyPolicy
+	picked := make(map[*Member]bool)
+	for i := 0; i < 100; i++ {
+		m, err := p.Pick(members)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[m] = true
+	}
+	if len(picked) != 3 {
+		t.Fatalf("expected picks spread over the best 3 members, got %d", len(picked))
+	}
+	for m := range picked {
+		if d, ok := m.Latency(); !ok || d > 3*time.Millisecond {
+			t.Fatalf("picked member with latency %v, measured %v", d, ok)
+		}
+	}
+
+	if _, err := p.Pick(nil); err == nil {
+		t.Fatal("expected error picking from no candidates")
+	}
+}
+
+func TestPowerOfTwoPolicy(t *testing.T) {
+	var members []*Member
+	for i := 0; i < 4; i++ {
+		m := &Member{}
+		// near-uniform latencies with a single fastest member
+		latency := 10 * time.Millisecond
+		if i > 0 {
+			latency += 100 * time.Microsecond
+		}
+		m.latency.Update(latency, defaultLatencyAlpha)
+		members = append(members, m)
+	}
+	// the slowest members tie on latency, so errors decide between them
+	members[3].errorCount = 1
+
+	var p PowerOfTwoPolicy
+	counts := make(map[*Member]int)
+	const picks = 10000
+	for i := 0; i < picks; i++ {
+		m, err := p.Pick(members)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[m]++
+	}
+
+	share := float64(counts[members[0]]) / picks
+	if share > 0.6 {
+		t.Fatalf("fastest member received %.0f%% of picks", share*100)
+	}
+	if share < 0.4 {
+		t.Fatalf("fastest member should still be preferred, got %.0f%% of picks", share*100)
+	}
+	if counts[members[3]] >= counts[members[1]] || counts[members[3]] >= counts[members[2]] {
+		t.Fatalf("member with errors should be picked least: %v", counts)
+	}
+
+	if m, _ := p.Pick(members[:1]); m != members[0] {
+		t.Fatal("expected the only candidate to be picked")
+	}
+	if _, err := p.Pick(nil); err == nil {
+		t.Fatal("expected error picking from no candidates")
+	}
+}
+
+func TestInverseLatencyPolicy(t *testing.T) {
+	var members []*Member
+	for _, latency := range []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond} {
+		m := &Member{}
+		m.latency.Update(latency, defaultLatencyAlpha)
+		members = append(members, m)
+	}
+	unmeasured := &Member{}
+	unhealthy := &Member{failures: 1}
+	unhealthy.latency.Update(time.Microsecond, defaultLatencyAlpha)
+
+	var p InverseLatencyPolicy
+	counts := make(map[*Member]int)
+	const picks = 20000
+	for i := 0; i < picks; i++ {
+		m, err := p.Pick(append([]*Member{unmeasured, unhealthy}, members...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[m]++
+	}
+	if counts[unmeasured] != 0 || counts[unhealthy] != 0 {
+		t.Fatalf("expected only measured healthy members to be picked: %v", counts)
+	}
+	// the inverse latencies weigh 4:2:1
+	for i, want := range []float64{4.0 / 7, 2.0 / 7, 1.0 / 7} {
+		if share := float64(counts[members[i]]) / picks; math.Abs(share-want) > 0.02 {
+			t.Errorf("member %d: expected %.0f%% of picks, got %.0f%%", i, want*100, share*100)
+		}
+	}
+
+	// unmeasured members are picked uniformly while none is measured
+	counts = make(map[*Member]int)
+	other := &Member{}
+	for i := 0; i < 1000; i++ {
+		m, _ := p.Pick([]*Member{unmeasured, other})
+		counts[m]++
+	}
+	if counts[unmeasured] < 400 || counts[other] < 400 {
+		t.Fatalf("expected uniform picks of unmeasured members: %v", counts)
+	}
+	// unhealthy members are picked if all candidates are
+	if m, _ := p.Pick([]*Member{unhealthy}); m != unhealthy {
+		t.Fatal("expected the only candidate to be picked")
+	}
+	if _, err := p.Pick(nil); err == nil {
+		t.Fatal("expected error picking from no candidates")
+	}
+}
+
+func TestLatencyPolicyObserve(t *testing.T) {
+	m := &Member{}
+	p := LatencyPolicy{Alpha: 0.25}
+	p.Observe(m, 8*time.Millisecond, nil)
+	p.Observe(m, 16*time.Millisecond, nil)
+	if d, ok := m.Latency(); !ok || d != 10*time.Millisecond {
+		t.Fatalf("expected 10ms average with alpha 0.25, got %v", d)
+	}
+	p.Observe(m, 0, errors.New("ping failed"))
+	if _, ok := m.Latency(); ok {
+		t.Fatal("failed ping should reset the measurement")
+	}
+}
+
+func TestLatencyAlphaWarning(t *testing.T) {
+	logger := &memLogger{}
+	cl := newTestClient(t)
+	cl.Logger = logger
+	cl.LatencyAlpha = 2
+	g, err := NewGroup([]Remote{NewServer(newTestServer(t), "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	warnings := func() int {
+		logger.Lock()
+		defer logger.Unlock()
+		n := 0
+		for _, msg := range logger.messages {
+			if strings.Contains(msg, "latency alpha") {
+				n++
+			}
+		}
+		return n
+	}
+
+	// an out-of-range alpha is reported once, not on every sample
+	for i := 0; i < 3; i++ {
+		g.PingAll(cl, 1)
+	}
+	if n := warnings(); n != 1 {
+		t.Fatalf("expected the alpha of the Client to be reported once, got %d: %q", n, logger.messages)
+	}
+	g.SetPolicy(LatencyPolicy{Alpha: -1})
+	for i := 0; i < 3; i++ {
+		g.PingAll(cl, 1)
+	}
+	if n := warnings(); n != 2 {
+		t.Fatalf("expected the alpha of the Policy set to be reported once, got %d: %q", n, logger.messages)
+	}
+}
+
+func TestLatencyResetAfter(t *testing.T) {
+	cl := newTestClient(t)
+	cl.LatencyResetAfter = 3
+	r := &flakyRemote{Remote: NewServer(newTestServer(t), "localhost")}
+	g, err := NewGroup([]Remote{r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	latency := func() (time.Duration, bool) {
+		g.RLock()
+		defer g.RUnlock()
+		return g.remotes[0].Latency()
+	}
+
+	g.Observe(cl, r, 5*time.Millisecond, nil)
+	// a single failure keeps the measurement
+	g.Observe(cl, r, 0, errors.New("operation failed"))
+	if d, ok := latency(); !ok || d != 5*time.Millisecond {
+		t.Fatalf("expected a single failure to keep the latency, got %v (measured %v)", d, ok)
+	}
+	g.Observe(cl, r, 5*time.Millisecond, nil)
+	g.Observe(cl, r, 0, errors.New("operation failed"))
+	g.Observe(cl, r, 0, errors.New("operation failed"))
+	if _, ok := latency(); !ok {
+		t.Fatal("expected failures interrupted by a success not to reset the latency")
+	}
+	// the third failure in a row does
+	g.Observe(cl, r, 0, errors.New("operation failed"))
+	if _, ok := latency(); ok {
+		t.Fatal("expected 3 failures in a row to reset the latency")
+	}
+
+	// by default, any failure resets it
+	m := &Member{failures: 1}
+	m.latency.Update(time.Millisecond, defaultLatencyAlpha)
+	LatencyPolicy{}.Observe(m, 0, errors.New("ping failed"))
+	if _, ok := m.Latency(); ok {
+		t.Fatal("expected a failure to reset the latency by default")
+	}
+}
+
+func TestGroupPolicy(t *testing.T) {
+	g, err := NewGroup([]Remote{deadRemote, remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &recordingPolicy{}
+	g.SetPolicy(p)
+	g.lastPingAll = time.Now()
+
+	conn, err := g.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+	if p.picks != 1 {
+		t.Fatalf("expected a single pick of the working remote, got %d", p.picks)
+	}
+
+	g.PingAll(c, 2)
+	if len(p.observed) != 2 {
+		t.Fatalf("expected both members to be observed, got %d", len(p.observed))
+	}
+	if p.observed[g.remotes[0]] == nil || p.observed[g.remotes[1]] != nil {
+		t.Fatalf("unexpected observations: %v", p.observed)
+	}
+}
+
+func TestRoundRobinGroup(t *testing.T) {
+	cl := newTestClient(t)
+	var remotes []Remote
+	for i := 0; i < 4; i++ {
+		remotes = append(remotes, NewServer(newTestServer(t), "localhost"))
+	}
+	flaky := &flakyRemote{Remote: remotes[3]}
+	flaky.setFailing(true)
+	remotes[3] = flaky
+
+	g, err := NewRoundRobinGroup(remotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+
+	dial := func() map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 30; i++ {
+			conn, err := g.Dial(cl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[conn.addr]++
+			conn.KeepAlive()
+		}
+		return counts
+	}
+
+	addr := func(i int) string {
+		r := remotes[i]
+		if i == 3 {
+			r = flaky.Remote
+		}
+		return r.(*singleRemote).String()
+	}
+
+	// the failing member is skipped in favor of the next one
+	counts := dial()
+	if flaky.Dials() != 9 {
+		t.Fatalf("expected the failing member to be tried in each round, got %d dials", flaky.Dials())
+	}
+	for i := 0; i < 3; i++ {
+		if counts[addr(i)] != 10 {
+			t.Fatalf("expected even distribution over the healthy members, got %v", counts)
+		}
+	}
+
+	flaky.setFailing(false)
+	counts = dial()
+	for i := 0; i < 4; i++ {
+		if n := counts[addr(i)]; n < 7 || n > 8 {
+			t.Fatalf("expected even distribution over all members, got %v", counts)
+		}
+	}
+}
+
+func TestWeightedPolicy(t *testing.T) {
+	weights := []int{1, 3, 6, 0}
+	var members []*Member
+	for _, w := range weights {
+		members = append(members, &Member{weight: w})
+	}
+
+	var p WeightedPolicy
+	counts := make(map[*Member]int)
+	const picks = 20000
+	for i := 0; i < picks; i++ {
+		m, err := p.Pick(members)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[m]++
+	}
+	for i, m := range members {
+		share := float64(counts[m]) / picks
+		want := float64(weights[i]) / 10
+		if share < want-0.02 || share > want+0.02 {
+			t.Fatalf("member with weight %d got %.3f of picks, want %.3f", weights[i], share, want)
+		}
+	}
+	if counts[members[3]] != 0 {
+		t.Fatal("zero-weight member picked while others were available")
+	}
+
+	// zero-weight members are picked once nothing else is left
+	if m, err := p.Pick(members[3:]); err != nil || m != members[3] {
+		t.Fatal("zero-weight member not picked as the last resort")
+	}
+}
+
+func TestWeightedGroup(t *testing.T) {
+	flaky := &flakyRemote{Remote: remote}
+	flaky.setFailing(true)
+	backup := &flakyRemote{Remote: remote}
+	g, err := NewWeightedGroup(map[Remote]int{flaky: 1, backup: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.lastPingAll = time.Now()
+
+	// the zero-weight member takes over when the weighted member fails
+	conn, err := g.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+	if flaky.Dials() != 1 || backup.Dials() != 1 {
+		t.Fatalf("expected failover to the zero-weight member, got %d and %d dials", flaky.Dials(), backup.Dials())
+	}
+
+	if _, err := NewWeightedGroup(map[Remote]int{flaky: -1}); err == nil {
+		t.Fatal("expected an error for a negative weight")
+	}
+
+	// equal remotes make a single member of their weight
+	addr := newTestServer(t)
+	a, b := NewServer(addr, "localhost"), NewServer(addr, "localhost")
+	for i := 0; i < 10; i++ {
+		g, err := NewWeightedGroup(map[Remote]int{a: 3, b: 3, flaky: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(g.remotes) != 2 {
+			t.Fatalf("expected equal remotes to make one member, got %d members", len(g.remotes))
+		}
+		for _, m := range g.remotes {
+			want := 3
+			if m.Remote == flaky {
+				want = 1
+			}
+			if m.weight != want {
+				t.Fatalf("expected weight %d for %v, got %d", want, m.Remote, m.weight)
+			}
+		}
+	}
+	if _, err := NewWeightedGroup(map[Remote]int{a: 1, b: 2}); err == nil {
+		t.Fatal("expected an error for equal remotes of different weights")
+	}
+}
+
+func TestSRVPolicy(t *testing.T) {
+	srv := func(addr net.Addr, priority, weight uint16) *singleRemote {
+		return &singleRemote{Addr: addr, ServerName: "localhost", priority: priority, weight: weight}
+	}
+	dead := func() net.Addr {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		return l.Addr()
+	}
+
+	// within the top tier, picks are weighted
+	top := srv(newTestServer(t), 10, 1)
+	g, err := NewGroup([]Remote{srv(newTestServer(t), 20, 1), srv(newTestServer(t), 10, 0), top})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.SetPolicy(SRVPolicy{})
+	g.lastPingAll = time.Now()
+	for i := 0; i < 10; i++ {
+		conn, err := g.Dial(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.KeepAlive()
+		if conn.addr != top.String() {
+			t.Fatalf("expected the weighted member of the top tier to be dialed, got %s", conn.addr)
+		}
+	}
+
+	// the next tier is only used once the top tier can't be dialed
+	backup := srv(newTestServer(t), 20, 1)
+	g, err = NewGroup([]Remote{backup, srv(dead(), 10, 1), srv(dead(), 10, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.SetPolicy(SRVPolicy{})
+	g.lastPingAll = time.Now()
+	conn, err := g.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+	if conn.addr != backup.String() {
+		t.Fatalf("expected the backup tier to be dialed, got %s", conn.addr)
+	}
+	for _, m := range g.remotes {
+		if m.Remote != backup && m.dials != 1 {
+			t.Fatal("backup tier dialed before the top tier was exhausted")
+		}
+	}
+
+	// the backup tier is dialed even when the top tier has more members
+	// than a dial tries
+	backup = srv(newTestServer(t), 20, 1)
+	remotes := []Remote{backup}
+	for i := 0; i < 4; i++ {
+		remotes = append(remotes, srv(dead(), 10, 1))
+	}
+	g, err = NewGroup(remotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.SetPolicy(SRVPolicy{})
+	g.lastPingAll = time.Now()
+	conn, err = g.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+	if conn.addr != backup.String() {
+		t.Fatalf("expected the backup tier to be dialed, got %s", conn.addr)
+	}
+	dials := 0
+	for _, m := range g.remotes {
+		if m.Remote != backup {
+			dials += m.dials
+		}
+	}
+	if dials != 3 {
+		t.Fatalf("expected 3 dials of the top tier, got %d", dials)
+	}
+}
+
+func TestLeastConnectionsPolicy(t *testing.T) {
+	var remotes []Remote
+	for i := 0; i < 3; i++ {
+		remotes = append(remotes, NewServer(newTestServer(t), "localhost"))
+	}
+	g, err := NewGroup(remotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// checkout counts simulate operations in flight: 2, 1 and 0
+	var conns []*Conn
+	checkout := func(i int) {
+		conn, err := remotes[i].Dial(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	checkout(0)
+	checkout(0)
+	checkout(1)
+	defer func() {
+		for _, conn := range conns {
+			conn.KeepAlive()
+		}
+	}()
+
+	var p LeastConnectionsPolicy
+	// the least-loaded member wins despite a worse latency
+	g.remotes[0].latency.Update(time.Millisecond, 0.5)
+	g.remotes[2].latency.Update(time.Second, 0.5)
+	if m, err := p.Pick(g.remotes); err != nil || m != g.remotes[2] {
+		t.Fatal("least-loaded member not picked")
+	}
+
+	// ties are broken by latency
+	checkout(2)
+	g.remotes[1].latency.Update(100*time.Millisecond, 0.5)
+	if m, err := p.Pick(g.remotes); err != nil || m != g.remotes[1] {
+		t.Fatal("tie not broken by latency")
+	}
+	if n := g.remotes[0].InFlight(); n != 2 {
+		t.Fatalf("expected 2 operations in flight, got %d", n)
+	}
+}
+
+func TestDialForKey(t *testing.T) {
+	var remotes []Remote
+	for i := 0; i < 4; i++ {
+		remotes = append(remotes, NewServer(newTestServer(t), "localhost"))
+	}
+	g, err := NewGroup(remotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+
+	dialForKey := func(key string) string {
+		conn, err := g.DialForKey(c, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.KeepAlive()
+		return conn.addr
+	}
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	routes := make(map[string]string)
+	for _, key := range keys {
+		routes[key] = dialForKey(key)
+		for i := 0; i < 3; i++ {
+			if addr := dialForKey(key); addr != routes[key] {
+				t.Fatalf("key %s routed to %s, then %s", key, routes[key], addr)
+			}
+		}
+	}
+
+	// only the keys of the removed member are remapped
+	removed := routes["a"]
+	for _, r := range remotes {
+		if r.(*singleRemote).String() == removed {
+			g.Remove(r)
+		}
+	}
+	for _, key := range keys {
+		addr := dialForKey(key)
+		if addr == removed {
+			t.Fatalf("key %s routed to a removed member", key)
+		}
+		if routes[key] != removed && addr != routes[key] {
+			t.Fatalf("key %s remapped from %s to %s", key, routes[key], addr)
+		}
+		if again := dialForKey(key); again != addr {
+			t.Fatalf("key %s remapped nondeterministically", key)
+		}
+	}
+}
+
+func TestLatencyPolicyTies(t *testing.T) {
+	const members, picks = 6, 6000
+	counts := make(map[int]int)
+	var p LatencyPolicy
+	for i := 0; i < picks; i++ {
+		// a fresh group, in which nothing is measured yet
+		var candidates []*Member
+		for pos := 0; pos < members; pos++ {
+			candidates = append(candidates, &Member{pos: pos})
+		}
+		m, err := p.Pick(candidates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[m.pos]++
+	}
+	for pos := 0; pos < members; pos++ {
+		if n := counts[pos]; n < picks/members/2 || n > picks/members*2 {
+			t.Fatalf("member %d picked %d times out of %d, expected about %d", pos, n, picks, picks/members)
+		}
+	}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	// exponentially distributed latencies with a mean of 2ms, whose
+	// quantile q is -2ms * ln(1-q)
+	const mean = 2 * time.Millisecond
+	h := &latencyHistogram{}
+	const samples = 1000
+	for i := 0; i < samples; i++ {
+		q := (float64(i) + 0.5) / samples
+		h.Add(time.Duration(-float64(mean) * math.Log(1-q)))
+	}
+	g, err := NewGroup([]Remote{remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.remotes[0].percentiles = h
+
+	stat := g.Stats()[0]
+	for _, tc := range []struct {
+		q   float64
+		got time.Duration
+	}{
+		{0.50, stat.P50},
+		{0.95, stat.P95},
+		{0.99, stat.P99},
+	} {
+		want := -float64(mean) * math.Log(1-tc.q)
+		if math.Abs(float64(tc.got)-want) > 0.1*want {
+			t.Errorf("p%.0f: expected about %v, got %v", tc.q*100, time.Duration(want), tc.got)
+		}
+	}
+
+	// percentiles are only kept if enabled
+	cl := newTestClient(t)
+	g, err = NewGroup([]Remote{NewServer(newTestServer(t), "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.PingAll(cl, 0)
+	if stat := g.Stats()[0]; stat.P50 != 0 {
+		t.Fatalf("expected no percentiles by default, got p50 of %v", stat.P50)
+	}
+	cl.LatencyPercentiles = true
+	g.PingAll(cl, 0)
+	if stat := g.Stats()[0]; stat.P50 <= 0 || stat.P50 > stat.P99 {
+		t.Fatalf("expected percentiles of a successful ping, got p50 %v and p99 %v", stat.P50, stat.P99)
+	}
+}
+
+func TestLatencyPolicyPercentile(t *testing.T) {
+	// the first member is fast on average but has a long tail
+	steady, spiky := &Member{percentiles: &latencyHistogram{}}, &Member{percentiles: &latencyHistogram{}}
+	for i := 0; i < 100; i++ {
+		steady.percentiles.Add(5 * time.Millisecond)
+		d := time.Millisecond
+		if i%10 == 0 {
+			d = 50 * time.Millisecond
+		}
+		spiky.percentiles.Add(d)
+	}
+	spiky.latency.Update(time.Millisecond, defaultLatencyAlpha)
+	steady.latency.Update(5*time.Millisecond, defaultLatencyAlpha)
+
+	if !(LatencyPolicy{}).better(spiky, steady) {
+		t.Fatal("expected the lower moving average to be preferred by default")
+	}
+	p := LatencyPolicy{Percentile: 0.95}
+	if !p.better(steady, spiky) {
+		t.Fatal("expected the lower 95th percentile to be preferred")
+	}
+	// a member whose last ping failed isn't preferred for its history
+	steady.latency.Reset()
+	if p.better(steady, spiky) {
+		t.Fatal("expected a measured member to be preferred")
+	}
+}
@@ -0,0 +1,125 @@
+// Package prommetrics implements client.Metrics, client.ReuseMetrics and
+// client.HandshakeMetrics with Prometheus metrics.
+package prommetrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// buckets starting at 100 microseconds and doubling until reaching a
+	// maximum of ~3.3 seconds
+	durationBuckets = prometheus.ExponentialBuckets(1e-4, 2.0, 15)
+
+	labels = []string{"server", "addr"}
+	// handshakeLabels also tell whether the handshake resumed a session.
+	handshakeLabels = []string{"server", "addr", "resumed"}
+)
+
+// Metrics records client events as Prometheus metrics labeled by server name
+// and address. It is a prometheus.Collector, so it must be registered before
+// its metrics are exported:
+//
+//	m := prommetrics.New()
+//	prometheus.MustRegister(m)
+//	c.Metrics = m
+type Metrics struct {
+	dials               *prometheus.CounterVec
+	reuses              *prometheus.CounterVec
+	handshakes          *prometheus.CounterVec
+	dialFailures        *prometheus.CounterVec
+	pingFailures        *prometheus.CounterVec
+	blacklistRejections *prometheus.CounterVec
+	latency             *prometheus.HistogramVec
+}
+
+// New creates a new set of client metrics.
+func New() *Metrics {
+	return &Metrics{
+		dials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "keyless_client_dials",
+			Help: "Number of connections dialed to keyservers.",
+		}, labels),
+		reuses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "keyless_client_reuses",
+			Help: "Number of dials to keyservers served by a pooled connection.",
+		}, labels),
+		handshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "keyless_client_handshakes",
+			Help: "Number of TLS handshakes with keyservers, by whether they resumed a session.",
+		}, handshakeLabels),
+		dialFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "keyless_client_dial_failures",
+			Help: "Number of failed dials to keyservers.",
+		}, labels),
+		pingFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "keyless_client_ping_failures",
+			Help: "Number of failed health check pings to keyservers.",
+		}, labels),
+		blacklistRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "keyless_client_blacklist_rejections",
+			Help: "Number of dials refused because the keyserver is on the client blacklist.",
+		}, labels),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "keyless_client_ping_latency",
+			Help:    "Round trip time of successful health check pings to keyservers.",
+			Buckets: durationBuckets,
+		}, labels),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.dials, m.reuses, m.handshakes, m.dialFailures, m.pingFailures, m.blacklistRejections, m.latency}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// Dial implements client.Metrics.
+func (m *Metrics) Dial(serverName, addr string) {
+	m.dials.WithLabelValues(serverName, addr).Inc()
+}
+
+// Reuse implements client.ReuseMetrics.
+func (m *Metrics) Reuse(serverName, addr string) {
+	m.reuses.WithLabelValues(serverName, addr).Inc()
+}
+
+// Handshake implements client.HandshakeMetrics.
+func (m *Metrics) Handshake(serverName, addr string, resumed bool) {
+	m.handshakes.WithLabelValues(serverName, addr, strconv.FormatBool(resumed)).Inc()
+}
+
+// DialFailure implements client.Metrics.
+func (m *Metrics) DialFailure(serverName, addr string) {
+	m.dialFailures.WithLabelValues(serverName, addr).Inc()
+}
+
+// PingFailure implements client.Metrics.
+func (m *Metrics) PingFailure(serverName, addr string) {
+	m.pingFailures.WithLabelValues(serverName, addr).Inc()
+}
+
+// BlacklistRejection implements client.Metrics.
+func (m *Metrics) BlacklistRejection(serverName, addr string) {
+	m.blacklistRejections.WithLabelValues(serverName, addr).Inc()
+}
+
+// Latency implements client.Metrics.
+func (m *Metrics) Latency(serverName, addr string, d time.Duration) {
+	m.latency.WithLabelValues(serverName, addr).Observe(d.Seconds())
+}
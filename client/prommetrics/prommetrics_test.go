@@ -0,0 +1,63 @@
+package prommetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudflare/gokeyless/client"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	_ client.Metrics          = (*Metrics)(nil)
+	_ client.ReuseMetrics     = (*Metrics)(nil)
+	_ client.HandshakeMetrics = (*Metrics)(nil)
+)
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(m); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Dial("a.example", "192.0.2.1:2407")
+	m.Dial("a.example", "192.0.2.1:2407")
+	m.Reuse("a.example", "192.0.2.1:2407")
+	m.Handshake("a.example", "192.0.2.1:2407", false)
+	m.Handshake("a.example", "192.0.2.1:2407", true)
+	m.DialFailure("a.example", "192.0.2.1:2407")
+	m.PingFailure("b.example", "192.0.2.2:2407")
+	m.BlacklistRejection("c.example", "192.0.2.3:2407")
+	m.Latency("a.example", "192.0.2.1:2407", 5*time.Millisecond)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, f := range families {
+		for _, metric := range f.GetMetric() {
+			if metric.GetCounter() != nil {
+				got[f.GetName()] += metric.GetCounter().GetValue()
+			}
+			if metric.GetHistogram() != nil {
+				got[f.GetName()] += float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	want := map[string]float64{
+		"keyless_client_dials":                2,
+		"keyless_client_reuses":               1,
+		"keyless_client_handshakes":           2,
+		"keyless_client_dial_failures":        1,
+		"keyless_client_ping_failures":        1,
+		"keyless_client_blacklist_rejections": 1,
+		"keyless_client_ping_latency":         1,
+	}
+	for name, v := range want {
+		if got[name] != v {
+			t.Errorf("%s: got %v, want %v", name, got[name], v)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// dialProxy opens a raw connection to addr through c.Proxy. The connection
+// is established, but no TLS handshake has been made on it yet.
+func (c *Client) dialProxy(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("can't dial %s address %s through a proxy", network, addr)
+	}
+	proxyAddr := c.Proxy.Host
+	if c.Proxy.Port() == "" {
+		switch c.Proxy.Scheme {
+		case "http":
+			proxyAddr = net.JoinHostPort(c.Proxy.Hostname(), "80")
+		default:
+			proxyAddr = net.JoinHostPort(c.Proxy.Hostname(), "1080")
+		}
+	}
+
+	conn, err := c.netDialer().DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	// abort the proxy handshake once ctx is done
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := afterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+
+	switch c.Proxy.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, c.Proxy.User, addr)
+	case "http":
+		err = httpConnect(conn, c.Proxy.User, addr)
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %q", c.Proxy.Scheme)
+	}
+	if !stop() {
+		// report the cancelation rather than the resulting I/O error
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", proxyAddr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// afterFunc calls f in its own goroutine once ctx is done, as
+// context.AfterFunc does in Go 1.21 and later. The returned stop function
+// prevents the call, waiting for it to complete if it's already running, and
+// reports whether it did so.
+func afterFunc(ctx context.Context, f func()) (stop func() bool) {
+	var once sync.Once
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			once.Do(f)
+		case <-stopped:
+		}
+	}()
+	return func() bool {
+		ok := false
+		once.Do(func() {
+			ok = true
+			close(stopped)
+		})
+		return ok
+	}
+}
+
+// SOCKS5 protocol constants, as defined by RFC 1928 and RFC 1929.
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5CmdConnect   = 0x01
+	socks5IPv4         = 0x01
+	socks5Domain       = 0x03
+	socks5IPv6         = 0x04
+	socks5Succeeded    = 0x00
+)
+
+// socks5Connect asks the SOCKS5 server at the other end of conn to connect
+// to addr, authenticating with user if set.
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	method := byte(socks5AuthNone)
+	if user != nil {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", resp[0])
+	}
+	if resp[1] != method {
+		return errors.New("SOCKS5 server rejected the authentication method")
+	}
+	if method == socks5AuthPassword {
+		username := user.Username()
+		password, _ := user.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 username or password too long")
+		}
+		req := []byte{0x01, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return err
+		}
+		if resp[1] != socks5Succeeded {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long", host)
+		}
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != socks5Succeeded {
+		return fmt.Errorf("SOCKS5 connect to %s failed with code %d", addr, reply[1])
+	}
+	// skip the bound address and port
+	var n int
+	switch reply[3] {
+	case socks5IPv4:
+		n = net.IPv4len
+	case socks5IPv6:
+		n = net.IPv6len
+	case socks5Domain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS5 address type %d", reply[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+// httpConnect asks the HTTP proxy at the other end of conn to tunnel to addr
+// with the CONNECT method, authenticating with user if set.
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT to %s failed: %s", addr, resp.Status)
+	}
+	// the client speaks first in a TLS handshake, so nothing but the
+	// response should have been read
+	if br.Buffered() > 0 {
+		return errors.New("unexpected data after CONNECT response")
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// forwardingProxy is a proxy which tunnels each accepted connection to the
+// address requested by its handshake.
+type forwardingProxy struct {
+	net.Listener
+	tunnels int32
+}
+
+func (p *forwardingProxy) Tunnels() int {
+	return int(atomic.LoadInt32(&p.tunnels))
+}
+
+// serve accepts connections, running handshake on each to learn the address
+// to tunnel to.
+func (p *forwardingProxy) serve(handshake func(net.Conn, *bufio.Reader) (string, bool)) {
+	for {
+		conn, err := p.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			addr, ok := handshake(conn, br)
+			if !ok {
+				return
+			}
+			upstream, err := net.Dial("tcp", addr)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+			atomic.AddInt32(&p.tunnels, 1)
+			go io.Copy(upstream, br)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+// newSOCKS5Proxy starts a SOCKS5 proxy which requires username and password
+// if user is set.
+func newSOCKS5Proxy(t *testing.T, user *url.Userinfo) *forwardingProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &forwardingProxy{Listener: l}
+	go p.serve(func(conn net.Conn, br *bufio.Reader) (string, bool) {
+		var hdr [2]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return "", false
+		}
+		methods := make([]byte, hdr[1])
+		if _, err := io.ReadFull(br, methods); err != nil {
+			return "", false
+		}
+		want := byte(socks5AuthNone)
+		if user != nil {
+			want = socks5AuthPassword
+		}
+		found := false
+		for _, m := range methods {
+			found = found || m == want
+		}
+		if !found {
+			conn.Write([]byte{socks5Version, 0xff})
+			return "", false
+		}
+		conn.Write([]byte{socks5Version, want})
+		if user != nil {
+			readString := func() string {
+				var l [1]byte
+				io.ReadFull(br, l[:])
+				b := make([]byte, l[0])
+				io.ReadFull(br, b)
+				return string(b)
+			}
+			br.ReadByte()
+			username, password := readString(), readString()
+			wantPassword, _ := user.Password()
+			if username != user.Username() || password != wantPassword {
+				conn.Write([]byte{0x01, 0x01})
+				return "", false
+			}
+			conn.Write([]byte{0x01, socks5Succeeded})
+		}
+
+		var req [4]byte
+		if _, err := io.ReadFull(br, req[:]); err != nil || req[1] != socks5CmdConnect {
+			return "", false
+		}
+		var host string
+		switch req[3] {
+		case socks5IPv4, socks5IPv6:
+			ip := make(net.IP, net.IPv4len)
+			if req[3] == socks5IPv6 {
+				ip = make(net.IP, net.IPv6len)
+			}
+			io.ReadFull(br, ip)
+			host = ip.String()
+		default:
+			return "", false
+		}
+		var port [2]byte
+		io.ReadFull(br, port[:])
+		conn.Write([]byte{socks5Version, socks5Succeeded, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+		return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), true
+	})
+	return p
+}
+
+// newConnectProxy starts an HTTP proxy supporting the CONNECT method.
+func newConnectProxy(t *testing.T) *forwardingProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &forwardingProxy{Listener: l}
+	go p.serve(func(conn net.Conn, br *bufio.Reader) (string, bool) {
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return "", false
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host, true
+	})
+	return p
+}
+
+func TestProxy(t *testing.T) {
+	user := url.UserPassword("user", "secret")
+	socks := newSOCKS5Proxy(t, user)
+	defer socks.Close()
+	connect := newConnectProxy(t)
+	defer connect.Close()
+
+	for _, tc := range []struct {
+		proxy *forwardingProxy
+		url   *url.URL
+	}{
+		{socks, &url.URL{Scheme: "socks5", User: user, Host: socks.Addr().String()}},
+		{connect, &url.URL{Scheme: "http", Host: connect.Addr().String()}},
+	} {
+		cl := newTestClient(t)
+		cl.Proxy = tc.url
+		conn, err := NewServer(newTestServer(t), "localhost").Dial(cl)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.url.Scheme, err)
+		}
+		// the TLS handshake with the server worked through the tunnel
+		if err := conn.Ping(nil); err != nil {
+			t.Fatalf("%s: %v", tc.url.Scheme, err)
+		}
+		conn.Close()
+		if tc.proxy.Tunnels() != 1 {
+			t.Fatalf("%s: expected a single tunnel, got %d", tc.url.Scheme, tc.proxy.Tunnels())
+		}
+	}
+
+	// wrong credentials are rejected
+	cl := newTestClient(t)
+	cl.Proxy = &url.URL{Scheme: "socks5", User: url.UserPassword("user", "wrong"), Host: socks.Addr().String()}
+	if _, err := NewServer(newTestServer(t), "localhost").Dial(cl); err == nil {
+		t.Fatal("expected dial with wrong proxy credentials to fail")
+	}
+}
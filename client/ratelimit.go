@@ -0,0 +1,134 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lziest/ttlcache"
+)
+
+// A tokenBucket limits the rate of dials to a single server, or of the probes
+// of a Client. Tokens are added at a steady rate up to a burst, and each dial
+// or probe takes one.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last refill. b.mu must be held.
+func (b *tokenBucket) refill(rate float64, burst int, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+}
+
+// take takes a token if one is available, reporting whether it did.
+func (b *tokenBucket) take(rate float64, burst int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(rate, burst, timeNow())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// available reports whether a token is available, without taking it.
+func (b *tokenBucket) available(rate float64, burst int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(rate, burst, timeNow())
+	return b.tokens >= 1
+}
+
+// reserve takes a token if one is available and returns zero, and otherwise
+// returns how long until one is.
+func (b *tokenBucket) reserve(rate float64, burst int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(rate, burst, timeNow())
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// rateLimited reports whether a dial to the server at addr would exceed
+// c.PerRemoteRate. If take is set and it wouldn't, the dial is counted.
+func (c *Client) rateLimited(addr string, take bool) bool {
+	if c.PerRemoteRate <= 0 {
+		return false
+	}
+	burst := c.PerRemoteBurst
+	if burst < 1 {
+		burst = 1
+	}
+	b := c.rateLimits.get(addr, func() interface{} { return &tokenBucket{} }).(*tokenBucket)
+	if take {
+		return !b.take(c.PerRemoteRate, burst)
+	}
+	return !b.available(c.PerRemoteRate, burst)
+}
+
+// An addrCache holds state kept for each server address, such as the token
+// buckets of Client.PerRemoteRate. Entries expire with the TTL of the
+// connection pool, and the least recently used are evicted once there are as
+// many as the pool holds, so that the state of servers which went away doesn't
+// accumulate. The zero value is an empty addrCache.
+type addrCache struct {
+	mu    sync.Mutex
+	cache *ttlcache.LRU
+}
+
+// get returns the state of the server at addr, storing the one made by
+// newState if there is none or it expired.
+func (a *addrCache) get(addr string, newState func() interface{}) interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cache == nil {
+		a.cache = ttlcache.NewLRU(connPoolSize, defaultTTL, nil)
+	}
+	if v, stale := a.cache.Get(addr); v != nil && !stale {
+		return v
+	}
+	v := newState()
+	a.cache.Set(addr, v, defaultTTL)
+	return v
+}
+
+// probeSlot waits until c.ProbeRate allows another probe, reporting whether
+// it does before expired fires or closed is closed.
+func (c *Client) probeSlot(closed <-chan struct{}, expired <-chan time.Time) bool {
+	if c.ProbeRate <= 0 {
+		return true
+	}
+	burst := c.ProbeBurst
+	if burst < 1 {
+		burst = 1
+	}
+	for {
+		wait := c.probeLimit.reserve(c.ProbeRate, burst)
+		if wait <= 0 {
+			return true
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-closed:
+			timer.Stop()
+			return false
+		case <-expired:
+			timer.Stop()
+			return false
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// A reconnectBackoff spaces out the reconnects to a single server which keeps
+// closing connections shortly after they're established, so that it doesn't
+// put the client in a tight reconnect loop.
+type reconnectBackoff struct {
+	mu sync.Mutex
+	// flaps is the number of connections lost in a row before they were
+	// stable.
+	flaps int
+	// lostAt is when the last connection was lost.
+	lostAt time.Time
+}
+
+// lost records that a connection was closed by the server after lifetime.
+// A connection which lasted at least max was stable, resetting the backoff.
+func (b *reconnectBackoff) lost(lifetime, max time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if lifetime >= max {
+		b.flaps = 0
+	} else {
+		b.flaps++
+	}
+	b.lostAt = timeNow()
+}
+
+// wait returns how long to wait before reconnecting: initial after the first
+// connection lost in a row, doubling with each one after it up to max, and
+// counted from when the last one was lost.
+func (b *reconnectBackoff) wait(initial, max time.Duration) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.flaps == 0 {
+		return 0
+	}
+	d := initial
+	for i := 1; i < b.flaps && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return b.lostAt.Add(d).Sub(timeNow())
+}
+
+// reconnectBackoffFor returns the reconnectBackoff of the server at addr, or
+// nil unless c.ReconnectBackoff enables it.
+func (c *Client) reconnectBackoffFor(addr string) *reconnectBackoff {
+	if c.ReconnectBackoff <= 0 {
+		return nil
+	}
+	return c.reconnects.get(addr, func() interface{} { return &reconnectBackoff{} }).(*reconnectBackoff)
+}
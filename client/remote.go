@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -9,14 +10,15 @@ import (
 	"net"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudflare/backoff"
-	"github.com/cloudflare/cfssl/log"
 	"github.com/cloudflare/gokeyless/conn"
+	"github.com/cloudflare/gokeyless/protocol"
 	"github.com/lziest/ttlcache"
-	"github.com/miekg/dns"
 )
 
 const (
@@ -25,30 +27,184 @@ const (
 )
 
 // connPoolType is a async safe pool of established gokeyless Conn
-// so we don't need to do TLS handshake unnecessarily.
+// so we don't need to do TLS handshake unnecessarily. Each key maps to a
+// connSet holding up to Client.MaxConnsPerRemote connections.
 type connPoolType struct {
+	sync.Mutex
 	pool *ttlcache.LRU
 }
 
+// connSet is the set of connections that the pool holds for a single key.
+// It must only be accessed with the pool mutex held.
+type connSet struct {
+	conns []*Conn
+	// pending is the number of dials in progress which will add a
+	// connection to the set once they complete.
+	pending int
+	// changed is closed (and replaced) whenever a pending dial completes,
+	// or a connection is returned or removed.
+	changed chan struct{}
+	// acquirers are the Acquire calls waiting for a connection, in arrival
+	// order. Only the first of them may take one, so that none starves.
+	acquirers []*int
+}
+
 // connPool keeps all active Conn
 var connPool *connPoolType
 
 // A Remote represents some number of remote keyless server(s)
 type Remote interface {
 	Dial(*Client) (*Conn, error)
+	DialContext(context.Context, *Client) (*Conn, error)
 	PingAll(*Client, int)
+	// IsHealthy reports whether the remote is currently considered usable
+	// by the client, without dialing it.
+	IsHealthy(*Client) bool
+	Close() error
+}
+
+// An Identifier is a Remote with an identity, by which a Group tells whether
+// two remotes are the same, e.g. to ignore adding one which is already a
+// member, or to find the member to remove. Remotes which don't implement it
+// are only the same as themselves.
+type Identifier interface {
+	// ID returns the identity of the remote, which is the same for any two
+	// remotes denoting the same server or set of servers.
+	ID() string
+}
+
+var (
+	// ErrBlacklisted is the error of a dial to a server on the client
+	// blacklist.
+	ErrBlacklisted = errors.New("server on client blacklist")
+	// ErrGroupEmpty is the error of a dial to a Group without members.
+	ErrGroupEmpty = errors.New("remote group empty")
+	// ErrBreakerOpen is the error of a dial to a Group whose members all
+	// have their circuit breaker open.
+	ErrBreakerOpen = errors.New("circuit breaker open for every remote in group")
+	// ErrAllBlacklisted is the error of a dial to a Group whose members
+	// all are servers on the client blacklist. No dial is attempted.
+	ErrAllBlacklisted = errors.New("every remote in group on client blacklist")
+	// ErrClosed is the error of a dial to a Group which was aborted by a
+	// call to Group.Close.
+	ErrClosed = errors.New("remote group closed")
+	// ErrRateLimited is the error of a dial to a server, or to a Group
+	// whose members all are, over Client.PerRemoteRate.
+	ErrRateLimited = errors.New("dial rate limit exceeded")
+	// ErrAllDrained is the error of a dial to a Group whose members all
+	// are drained by Group.Drain, or on the client blacklist. No dial is
+	// attempted.
+	ErrAllDrained = errors.New("every remote in group drained")
+)
+
+// A DialError is the error of a failed dial to a single server. Err is
+// ErrBlacklisted if the server is on the client blacklist, and otherwise the
+// error of the TLS dial.
+type DialError struct {
+	Remote Remote
+	Err    error
+}
+
+func (e *DialError) Error() string {
+	if s, ok := e.Remote.(*singleRemote); ok {
+		return fmt.Sprintf("dial %s (%s): %v", s.String(), s.ServerName, e.Err)
+	}
+	return "dial: " + e.Err.Error()
+}
+
+// Unwrap returns e.Err.
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// A VerificationError is the error of a dial to a server which
+// Client.VerifyServer rejected, wrapped in a DialError.
+type VerificationError struct {
+	Err error
+}
+
+func (e *VerificationError) Error() string {
+	return "server verification failed: " + e.Err.Error()
+}
+
+// Unwrap returns e.Err.
+func (e *VerificationError) Unwrap() error {
+	return e.Err
 }
 
 // A Conn represents a long-lived client connection to a keyserver.
 type Conn struct {
 	*conn.Conn
 	addr string
+	// serverName is the TLS server name the connection was dialed with.
+	serverName string
+	// checkouts is the number of callers currently using the connection.
+	// It is protected by the connPool mutex.
+	checkouts int
+	// removed is set once the connection has been removed from the pool,
+	// after which it's never added back. It is protected by the connPool
+	// mutex.
+	removed bool
+	// lastUsed is when the connection was last checked out or released. It
+	// is protected by the connPool mutex.
+	lastUsed time.Time
+	// expires is when the connection is retired, or zero if it never is. A
+	// retired connection isn't handed out by the pool anymore, and is
+	// closed once it's no longer in use.
+	expires time.Time
+	// closed is closed once Close is called.
+	closed    chan struct{}
+	closeOnce sync.Once
+	// logger logs the messages about the connection, with the Logger of
+	// the Client which dialed it.
+	logger Logger
+	// resumed is whether the TLS handshake resumed a session.
+	resumed bool
+	// onClose is called once the connection is closed, with the reason,
+	// if the Client which dialed it has an OnConnClose.
+	onClose func(conn *Conn, reason string)
 }
 
+// The reasons Client.OnConnClose is called with.
+const (
+	// CloseReasonClosed is the reason of a call to Conn.Close.
+	CloseReasonClosed = "closed"
+	// CloseReasonLifetime is the reason of a connection retired after
+	// Client.MaxConnLifetime.
+	CloseReasonLifetime = "lifetime"
+	// CloseReasonReap is the reason of a connection idle for
+	// Client.MaxIdleTime.
+	CloseReasonReap = "reap"
+	// CloseReasonShutdown is the reason of a connection of a remote which
+	// was closed, or removed from its Group.
+	CloseReasonShutdown = "shutdown"
+	// CloseReasonPingFailed is the reason of a connection whose health
+	// check, keepalive or validation ping failed.
+	CloseReasonPingFailed = "ping-failed"
+	// CloseReasonOpFailed is the reason of a connection on which an
+	// operation failed, other than with an error of the server.
+	CloseReasonOpFailed = "op-failed"
+	// CloseReasonBroken is the reason of a connection which failed to read
+	// from the server, or was closed by it.
+	CloseReasonBroken = "broken"
+)
+
 // A singleRemote is an individual remote server
 type singleRemote struct {
 	net.Addr          // actual address
 	ServerName string // hostname for TLS verification
+
+	// priority and weight of the SRV record the remote was discovered
+	// through, if any.
+	priority, weight uint16
+	// zone is the zone the server is located in, if known.
+	zone string
+	// failing is set, atomically, while the last dial or ping of the
+	// server failed.
+	failing int32
+	// reused and opened count, atomically, the dials served by a pooled
+	// connection and those which opened a new one.
+	reused, opened int64
 }
 
 func init() {
@@ -61,10 +217,7 @@ func init() {
 // periodically check that it is healthy. This goroutine will automatically
 // quit if it detects that the connection has been closed.
 func NewConn(addr string, conn *conn.Conn) *Conn {
-	c := &Conn{
-		Conn: conn,
-		addr: addr,
-	}
+	c := NewStandaloneConn(addr, conn)
 	go healthchecker(c)
 	return c
 }
@@ -73,22 +226,155 @@ func NewConn(addr string, conn *conn.Conn) *Conn {
 // no health-checking goroutine is spawned.
 func NewStandaloneConn(addr string, conn *conn.Conn) *Conn {
 	return &Conn{
-		Conn: conn,
-		addr: addr,
+		Conn:   conn,
+		addr:   addr,
+		closed: make(chan struct{}),
+		logger: defaultLogger,
 	}
 }
 
+// DidResume reports whether the TLS handshake of the connection resumed a
+// session rather than making a full handshake. It is false for connections
+// which weren't dialed by a Client.
+func (conn *Conn) DidResume() bool {
+	return conn.resumed
+}
+
 // Close closes a Conn and remove it from the conn pool
 func (conn *Conn) Close() error {
+	return conn.closeFor(CloseReasonClosed)
+}
+
+// closeFor is Close, reporting reason to Client.OnConnClose.
+func (conn *Conn) closeFor(reason string) error {
 	// TODO(joshlf): This function seems fishy because it's meant to interact with
 	// the pool, and thus could close a connection out from somebody else's feet.
-	connPool.Remove(conn.addr)
-	return conn.Conn.Close()
+	connPool.Remove(conn.addr, conn)
+	return conn.close(reason)
+}
+
+// close closes a Conn which was already removed from the conn pool. Only the
+// reason of the first call is reported to Client.OnConnClose.
+func (conn *Conn) close(reason string) error {
+	first := false
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		first = true
+	})
+	err := conn.Conn.Close()
+	if first && conn.onClose != nil {
+		conn.onClose(conn, reason)
+	}
+	return err
+}
+
+// expired reports whether conn has exceeded its lifetime at now.
+func (conn *Conn) expired(now time.Time) bool {
+	return !conn.expires.IsZero() && !now.Before(conn.expires)
 }
 
-// KeepAlive keeps Conn reusable in the conn pool
+// KeepAlive returns Conn to the conn pool once the caller is done with it,
+// keeping it reusable.
 func (conn *Conn) KeepAlive() {
-	connPool.Add(conn.addr, conn)
+	connPool.Release(conn.addr, conn)
+}
+
+// jittered returns interval randomized by up to the fraction jitter of it in
+// either direction.
+func jittered(interval time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return time.Duration(float64(interval) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+// keepalive pings c about every interval while it's idle, so that
+// intermediaries don't drop it for inactivity. Each interval is randomized by
+// up to the fraction jitter. If a ping fails or isn't answered within
+// interval, c is closed so that the next Dial reconnects. keepalive returns
+// once c is closed.
+func keepalive(c *Conn, interval time.Duration, jitter float64) {
+	tick := time.NewTimer(jittered(interval, jitter))
+	defer tick.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-tick.C:
+		}
+		tick.Reset(jittered(interval, jitter))
+		if !connPool.Idle(c) {
+			continue
+		}
+
+		result := make(chan error, 1)
+		go func() { result <- c.Conn.Ping(nil) }()
+		timer := time.NewTimer(interval)
+		var err error
+		select {
+		case err = <-result:
+		case <-timer.C:
+			err = errors.New("keepalive ping timed out")
+		case <-c.closed:
+		}
+		timer.Stop()
+		if err != nil {
+			if err != conn.ErrClosed {
+				c.logger.Infof("keepalive ping to %s failed: %v", c.addr, err)
+			}
+			c.closeFor(CloseReasonPingFailed)
+			return
+		}
+	}
+}
+
+// probeWithin runs probe, failing if it doesn't complete within timeout,
+// unless it's zero. The probe is abandoned on timeout, so a wedged server
+// can't block the caller.
+func probeWithin(probe func() error, timeout time.Duration) error {
+	if timeout <= 0 {
+		return probe()
+	}
+	result := make(chan error, 1)
+	go func() { result <- probe() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("probe timed out after %v", timeout)
+	}
+}
+
+// validate pings the server of conn, failing if it isn't answered within
+// timeout.
+func (conn *Conn) validate(timeout time.Duration) error {
+	return probeWithin(func() error { return conn.Conn.Ping(nil) }, timeout)
+}
+
+// ping probes the server of conn for a health check, with c.ProbeOp if set
+// and otherwise with a ping of c.PingPayload, bounded by c.PingTimeout. It's
+// traced with the Tracer of c.
+func (conn *Conn) ping(c *Client) error {
+	_, span := c.tracer().Start(context.Background(), spanPing)
+	span.SetAttribute("server.name", conn.serverName)
+	span.SetAttribute("server.addr", conn.addr)
+	probe := func() error { return conn.Conn.Ping(c.PingPayload) }
+	if c.ProbeOp != nil {
+		probe = func() error { return c.ProbeOp(conn) }
+	}
+	err := probeWithin(probe, c.PingTimeout)
+	endSpan(span, err)
+	return err
+}
+
+// discard is like KeepAlive for a connection which misbehaved: it's closed,
+// for reason, unless other callers are still using it.
+func (conn *Conn) discard(reason string) {
+	if connPool.Discard(conn.addr, conn) {
+		conn.closeFor(reason)
+	}
 }
 
 // healthchecker is a recurrent timer function that tests the connections
@@ -106,381 +392,2988 @@ func healthchecker(c *Conn) {
 				// somebody else closed the connection while we were sleeping
 				return
 			}
-			log.Debug("health check ping failed:", err)
+			c.logger.Debugf("health check ping failed: %v", err)
 			// shut down the conn and remove it from the conn pool.
-			c.Close()
+			c.closeFor(CloseReasonPingFailed)
 			return
 		}
 
-		log.Debug("start a new health check timer")
+		c.logger.Debugf("start a new health check timer")
 	}
 }
 
-// Get returns a Conn from the pool if there is any.
-func (p *connPoolType) Get(key string) *Conn {
+func (p *connPoolType) set(key string) *connSet {
 	// ignore stale indicator
 	value, _ := p.pool.Get(key)
-	conn, ok := value.(*Conn)
-	if ok {
-		return conn
+	set, ok := value.(*connSet)
+	if !ok {
+		set = &connSet{changed: make(chan struct{})}
+		p.pool.Set(key, set, defaultTTL)
 	}
-	return nil
-}
-
-// Add adds a Conn to the pool.
-func (p *connPoolType) Add(key string, conn *Conn) {
-	p.pool.Set(key, conn, defaultTTL)
-	log.Debug("add conn with key:", key)
+	return set
 }
 
-// Remove removes a Conn keyed by key.
-func (p *connPoolType) Remove(key string) {
-	p.pool.Remove(key)
-	log.Debug("remove conn with key:", key)
+// Checkout returns a Conn from the pool keyed by key and marks it as in
+// use, along with how long it had been idle, which is zero if it was in use
+// already. An idle connection is preferred; if there is none and fewer than max
+// connections exist, Checkout returns nil and reserves a slot, in which case
+// the caller must dial and then call either Fill or Cancel. Once the set is
+// full, the least-loaded connection is shared. If every slot is still being
+// dialed, Checkout waits for one of those dials to complete or for ctx to be
+// done. Expired connections are never returned, nor counted against max;
+// idle ones are closed.
+func (p *connPoolType) Checkout(ctx context.Context, key string, max int) (*Conn, time.Duration, error) {
+	return p.checkout(ctx, key, max, false)
 }
 
-// NewServer creates a new remote based a given addr and server name.
-func NewServer(addr net.Addr, serverName string) Remote {
-	return &singleRemote{
-		Addr:       addr,
-		ServerName: serverName,
-	}
+// Acquire is like Checkout, but only returns a Conn which isn't in use:
+// once the set is full, it waits for a connection to be returned or removed
+// instead of sharing one. Waiting calls are served in the order they arrived.
+func (p *connPoolType) Acquire(ctx context.Context, key string, max int) (*Conn, time.Duration, error) {
+	return p.checkout(ctx, key, max, true)
 }
 
-// UnixRemote returns a Remote constructed from the Unix address
-func UnixRemote(unixAddr, serverName string) (Remote, error) {
-	addr, err := net.ResolveUnixAddr("unix", unixAddr)
-	if err != nil {
-		return nil, err
+// checkout implements Checkout, and Acquire if exclusive is set.
+func (p *connPoolType) checkout(ctx context.Context, key string, max int, exclusive bool) (*Conn, time.Duration, error) {
+	if max < 1 {
+		max = 1
 	}
 
-	return NewServer(addr, serverName), nil
-}
-
-// LookupIPs resolves host with resolvers list sequentially unitl one resolver
-// can answer the request. It falls back to use system default for final
-// resolution if none of resolvers can answer.
-func LookupIPs(resolvers []string, host string) (ips []net.IP, err error) {
-	m := new(dns.Msg)
-	dnsClient := new(dns.Client)
-	dnsClient.Net = "tcp"
-	for _, resolver := range resolvers {
-		m.SetQuestion(dns.Fqdn(host), dns.TypeA)
-		if in, _, err := dnsClient.Exchange(m, resolver); err == nil {
-			for _, rr := range in.Answer {
-				if a, ok := rr.(*dns.A); ok {
-					log.Debugf("resolve %s to %s", host, a)
-					ips = append(ips, a.A)
-				}
+	p.Lock()
+	defer p.Unlock()
+	// ticket is the place of the call in the queue of acquirers, once it
+	// had to wait
+	var ticket *int
+	for {
+		set := p.set(key)
+		if exclusive && len(set.acquirers) > 0 && set.acquirers[0] != ticket {
+			// others were waiting first
+			if ticket == nil {
+				ticket = new(int)
+				set.acquirers = append(set.acquirers, ticket)
 			}
-		} else {
-			log.Warningf("fail to get A records for %s with %s: %v", host, resolver, err)
+			if !p.wait(ctx, set, ticket) {
+				return nil, 0, ctx.Err()
+			}
+			continue
 		}
-
-		m.SetQuestion(dns.Fqdn(host), dns.TypeAAAA)
-		if in, _, err := dnsClient.Exchange(m, resolver); err == nil {
-			for _, rr := range in.Answer {
-				if aaaa, ok := rr.(*dns.AAAA); ok {
-					log.Debugf("resolve %s to %s", host, aaaa)
-					ips = append(ips, aaaa.AAAA)
+		now := timeNow()
+		var best *Conn
+		var live int
+		for i := 0; i < len(set.conns); i++ {
+			cn := set.conns[i]
+			if cn.expired(now) {
+				if cn.checkouts == 0 {
+					p.retire(set, i)
+					i--
 				}
+				continue
+			}
+			live++
+			if exclusive && cn.checkouts > 0 {
+				continue
+			}
+			if best == nil || cn.checkouts < best.checkouts {
+				best = cn
 			}
-		} else {
-			log.Warningf("fail to get AAAA records for %s with %s: %v", host, resolver, err)
 		}
-	}
-	if len(ips) != 0 {
-		return ips, nil
-	}
-
-	return net.LookupIP(host)
-}
+		if best != nil && (best.checkouts == 0 || live+set.pending >= max) {
+			var idle time.Duration
+			if best.checkouts == 0 {
+				idle = now.Sub(best.lastUsed)
+			}
+			best.checkouts++
+			best.lastUsed = now
+			set.leave(ticket)
+			return best, idle, nil
+		}
+		if live+set.pending < max {
+			set.pending++
+			set.leave(ticket)
+			return nil, 0, nil
+		}
 
-// LookupServerWithName uses DNS to look up an a group of Remote servers with
-// optional TLS server name.
-func (c *Client) LookupServerWithName(serverName, host, port string) (Remote, error) {
-	if serverName == "" {
-		serverName = host
+		if exclusive && ticket == nil {
+			ticket = new(int)
+			set.acquirers = append(set.acquirers, ticket)
+		}
+		if !p.wait(ctx, set, ticket) {
+			return nil, 0, ctx.Err()
+		}
 	}
+}
 
-	ips, err := LookupIPs(c.Resolvers, host)
-	if err != nil {
-		return nil, err
+// wait waits for set to change, with p unlocked, and reports whether it did
+// before ctx was done. An acquirer holding ticket gives up its place in the
+// queue if ctx was done first.
+func (p *connPoolType) wait(ctx context.Context, set *connSet, ticket *int) bool {
+	changed := set.changed
+	p.Unlock()
+	select {
+	case <-changed:
+		p.Lock()
+		return true
+	case <-ctx.Done():
+		p.Lock()
+		set.leave(ticket)
+		return false
 	}
+}
 
-	if len(ips) == 0 {
-		return nil, fmt.Errorf("fail to resolve %s", host)
+// leave removes ticket, if any, from the queue of acquirers of set. The next
+// acquirer is woken if ticket was first, since it may now be served.
+func (set *connSet) leave(ticket *int) {
+	if ticket == nil {
+		return
 	}
-
-	portNumber, err := strconv.Atoi(port)
-	if err != nil {
-		return nil, err
+	for i, t := range set.acquirers {
+		if t == ticket {
+			set.acquirers = append(set.acquirers[:i], set.acquirers[i+1:]...)
+			if i == 0 && len(set.acquirers) > 0 {
+				set.notify()
+			}
+			return
+		}
 	}
+}
 
-	var servers []Remote
-	for _, ip := range ips {
-		addr := &net.TCPAddr{IP: ip, Port: portNumber}
-		if !c.Blacklist.Contains(addr) {
-			servers = append(servers, NewServer(addr, serverName))
+// Peek is like Checkout, but only returns an established Conn, the
+// least-loaded one, and never reserves a slot or waits for a dial. It
+// reports whether there was one.
+func (p *connPoolType) Peek(key string) (*Conn, bool) {
+	p.Lock()
+	defer p.Unlock()
+	now := timeNow()
+	var best *Conn
+	for _, cn := range p.set(key).conns {
+		if !cn.expired(now) && (best == nil || cn.checkouts < best.checkouts) {
+			best = cn
 		}
 	}
-	log.Infof("server lookup: %s has %d usable upstream", host, len(servers))
-	return NewGroup(servers)
+	if best == nil {
+		return nil, false
+	}
+	best.checkouts++
+	best.lastUsed = now
+	return best, true
 }
 
-// LookupServer with default ServerName.
-func (c *Client) LookupServer(hostport string) (Remote, error) {
-	host, port, err := net.SplitHostPort(hostport)
-	if err != nil {
-		return nil, err
+// Fill completes a dial reserved by Checkout by adding conn, checked out
+// once, to the pool.
+func (p *connPoolType) Fill(key string, conn *Conn) {
+	p.Lock()
+	defer p.Unlock()
+	set := p.set(key)
+	if set.pending > 0 {
+		set.pending--
 	}
-
-	return c.LookupServerWithName(host, host, port)
+	conn.checkouts++
+	conn.lastUsed = timeNow()
+	set.conns = append(set.conns, conn)
+	set.notify()
+	p.pool.Set(key, set, defaultTTL)
+	conn.logger.Debugf("add conn with key: %s", key)
 }
 
-// Dial dials a remote server, returning an existing connection if possible.
-func (s *singleRemote) Dial(c *Client) (*Conn, error) {
-	if c.Blacklist.Contains(s.Addr) {
-		return nil, fmt.Errorf("server %s on client blacklist", s.String())
+// Cancel releases a dial reserved by Checkout that failed.
+func (p *connPoolType) Cancel(key string) {
+	p.Lock()
+	defer p.Unlock()
+	set := p.set(key)
+	if set.pending > 0 {
+		set.pending--
 	}
+	set.notify()
+}
 
-	cn := connPool.Get(s.String())
-	if cn != nil {
-		return cn, nil
+// Release marks one use of conn as finished and keeps it in the pool, unless
+// it was removed from the pool in the meantime.
+func (p *connPoolType) Release(key string, conn *Conn) {
+	p.Lock()
+	defer p.Unlock()
+	if conn.checkouts > 0 {
+		conn.checkouts--
 	}
-
-	config := c.Config.Clone()
-	config.ServerName = s.ServerName
-	log.Debugf("Dialing %s at %s\n", s.ServerName, s.String())
-	inner, err := tls.DialWithDialer(c.Dialer, s.Network(), s.String(), config)
-	if err != nil {
-		return nil, err
+	conn.lastUsed = timeNow()
+	if conn.checkouts == 0 {
+		// wakes callers of Acquire waiting for an idle connection
+		defer p.set(key).notify()
 	}
-
-	cn = NewConn(s.String(), conn.NewConn(inner))
-	connPool.Add(s.String(), cn)
-	go func() {
-		for {
-			err := cn.Conn.DoRead()
-			if err != nil {
-				if err == io.EOF {
-					log.Debug("connection closed by server")
-				} else {
-					log.Errorf("failed to read next header from %v: %v", s.String(), err)
-				}
-				break
+	if conn.removed {
+		// the connection was closed while checked out
+		return
+	}
+	set := p.set(key)
+	for i, cn := range set.conns {
+		if cn == conn {
+			if conn.checkouts == 0 && conn.expired(timeNow()) {
+				p.retire(set, i)
+				return
 			}
+			p.pool.Set(key, set, defaultTTL)
+			return
 		}
+	}
+	// the set expired from the pool while conn was checked out
+	set.conns = append(set.conns, conn)
+	p.pool.Set(key, set, defaultTTL)
+	conn.logger.Debugf("add conn with key: %s", key)
+}
 
-		cn.Close()
-	}()
-
-	return cn, nil
+// retire removes the expired connection at index i of set and closes it.
+// The pool must be locked.
+func (p *connPoolType) retire(set *connSet, i int) {
+	cn := set.conns[i]
+	cn.removed = true
+	set.conns = append(set.conns[:i], set.conns[i+1:]...)
+	cn.logger.Debugf("retire expired conn with key: %s", cn.addr)
+	// closing may block on the network, so it's done without the lock
+	go cn.close(CloseReasonLifetime)
 }
 
-// PingAll simply attempts to ping the singleRemote
-func (s *singleRemote) PingAll(c *Client, concurrency int) {
-	cn, err := s.Dial(c)
-	if err != nil {
-		return
+// ReapIdle closes the Conns keyed by key which haven't been used for maxIdle.
+func (p *connPoolType) ReapIdle(key string, maxIdle time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	set := p.set(key)
+	now := timeNow()
+	for i := 0; i < len(set.conns); i++ {
+		cn := set.conns[i]
+		if cn.checkouts == 0 && now.Sub(cn.lastUsed) >= maxIdle {
+			cn.removed = true
+			set.conns = append(set.conns[:i], set.conns[i+1:]...)
+			i--
+			cn.logger.Debugf("close idle conn with key: %s", key)
+			go cn.close(CloseReasonReap)
+		}
 	}
+}
 
-	err = cn.Conn.Ping(nil)
-	if err != nil {
-		cn.Close()
+// Remove removes conn from the set of Conns keyed by key.
+func (p *connPoolType) Remove(key string, conn *Conn) {
+	p.Lock()
+	defer p.Unlock()
+	conn.removed = true
+	set := p.set(key)
+	for i, cn := range set.conns {
+		if cn == conn {
+			set.conns = append(set.conns[:i], set.conns[i+1:]...)
+			break
+		}
 	}
+	set.notify()
+	conn.logger.Debugf("remove conn with key: %s", key)
 }
 
-// ewmaLatency is exponentially weighted moving average of latency
-type ewmaLatency struct {
-	val      time.Duration
-	measured bool
+// RemoveAll removes and returns all Conns keyed by key.
+func (p *connPoolType) RemoveAll(key string) []*Conn {
+	p.Lock()
+	defer p.Unlock()
+	set := p.set(key)
+	conns := set.conns
+	set.conns = nil
+	set.notify()
+	for _, cn := range conns {
+		cn.removed = true
+		cn.logger.Debugf("remove conn with key: %s", key)
+	}
+	return conns
 }
 
-func (l ewmaLatency) Update(val time.Duration) {
-	l.measured = true
-	l.val /= 2
-	l.val += (val / 2)
+// Discard marks one use of conn as finished after it misbehaved and removes
+// it from the pool, unless it's still checked out by another caller. It
+// reports whether conn was removed, in which case the caller should close it.
+func (p *connPoolType) Discard(key string, conn *Conn) bool {
+	p.Lock()
+	defer p.Unlock()
+	if conn.checkouts > 0 {
+		conn.checkouts--
+	}
+	if conn.checkouts > 0 {
+		return false
+	}
+	conn.removed = true
+	set := p.set(key)
+	for i, cn := range set.conns {
+		if cn == conn {
+			set.conns = append(set.conns[:i], set.conns[i+1:]...)
+			break
+		}
+	}
+	set.notify()
+	return true
 }
 
-func (l ewmaLatency) Reset() {
-	l.val = 0
-	l.measured = false
+// Idle reports whether conn is not checked out.
+func (p *connPoolType) Idle(conn *Conn) bool {
+	p.Lock()
+	defer p.Unlock()
+	return conn.checkouts == 0
 }
 
-func (l ewmaLatency) Better(r ewmaLatency) bool {
-	// if l is not measured (it also means last measurement was
-	// a failure), any updated/measured latency is better than
-	// l. Also if neither l or r is measured, l can't be better
-	// than r.
-	if !l.measured {
-		return false
+// InFlight returns the number of checkouts of the Conns keyed by key.
+func (p *connPoolType) InFlight(key string) int {
+	p.Lock()
+	defer p.Unlock()
+	var n int
+	for _, cn := range p.set(key).conns {
+		n += cn.checkouts
 	}
+	return n
+}
 
-	if l.measured && !r.measured {
-		return true
+// WaitIdle waits until conn isn't checked out anymore, or deadline passes.
+// It reports whether conn is idle.
+func (p *connPoolType) WaitIdle(conn *Conn, deadline time.Time) bool {
+	for !p.Idle(conn) {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(drainPollInterval)
 	}
-
-	return l.val < r.val
+	return true
 }
 
-// mRemote denotes Remote with latency measurements.
-type mRemote struct {
-	Remote
-	latency ewmaLatency
-}
+// drainPollInterval is how often draining connections are checked for
+// outstanding operations.
+const drainPollInterval = 10 * time.Millisecond
 
-type mRemoteSorter []mRemote
+// Len returns the number of Conns keyed by key.
+func (p *connPoolType) Len(key string) int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.set(key).conns)
+}
 
-// A Group is a Remote consisting of a load-balanced set of external servers.
-type Group struct {
-	sync.RWMutex
-	remotes     []mRemote
-	lastPingAll time.Time
+func (set *connSet) notify() {
+	close(set.changed)
+	set.changed = make(chan struct{})
 }
 
-// NewGroup creates a new group from a set of remotes.
-func NewGroup(remotes []Remote) (*Group, error) {
-	if len(remotes) == 0 {
-		return nil, errors.New("attempted to create empty remote group")
+// NewServer creates a new remote based a given addr and server name. Unlike
+// a Group, a server used on its own is never probed in the background: dials
+// are served by its pooled connection, and only a failed one dials again.
+// The inputs aren't checked, see NewServerChecked.
+func NewServer(addr net.Addr, serverName string) Remote {
+	return &singleRemote{
+		Addr:       addr,
+		ServerName: serverName,
 	}
-	g := new(Group)
+}
 
-	for _, r := range remotes {
-		g.remotes = append(g.remotes, mRemote{Remote: r})
+// NewServerChecked is like NewServer, but fails if addr can't be dialed, e.g.
+// a TCP address without an IP or with a port outside of 1-65535, or if
+// serverName is neither a DNS name nor an IP address, rather than making a
+// remote whose dials fail.
+func NewServerChecked(addr net.Addr, serverName string) (Remote, error) {
+	switch a := addr.(type) {
+	case nil:
+		return nil, errors.New("missing server address")
+	case *net.TCPAddr:
+		if a == nil || a.IP == nil {
+			return nil, errors.New("server address has no IP")
+		}
+		if err := checkPort(a.Port); err != nil {
+			return nil, err
+		}
+	case *net.UnixAddr:
+		if a == nil || a.Name == "" {
+			return nil, errors.New("server address has no path")
+		}
 	}
-
-	return g, nil
+	if err := checkServerName(serverName); err != nil {
+		return nil, err
+	}
+	return NewServer(addr, serverName), nil
 }
 
-// Dial returns a connection with best latency measurement.
-func (g *Group) Dial(c *Client) (conn *Conn, err error) {
-	g.RLock()
-	if len(g.remotes) == 0 {
-		err = errors.New("remote group empty")
-		return nil, err
+// parsePort parses the port of a server address.
+func parsePort(port string) (int, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q: not a number", port)
 	}
-	// n is the number of trials.
-	// Because of potential expensive fresh tls dial operation,
-	// we limit total dial candidates to a small number.
-	// Also it solves a subtle problem of test 'localhost'
-	// server discovery due to dual ipv6/ipv4 ip resolution.
-	n := 3
-	if len(g.remotes) < n {
-		n = len(g.remotes)
+	if err := checkPort(n); err != nil {
+		return 0, err
 	}
+	return n, nil
+}
 
-	remotes := make([]mRemote, n)
-	// copy and shuffle first n remotes for load balancing
-	for i := 0; i < n; i++ {
-		j := rand.Intn(i + 1)
-		if i != j {
-			remotes[i] = remotes[j]
-		}
-		remotes[j] = g.remotes[i]
+func checkPort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %d: not between 1 and 65535", port)
 	}
-	g.RUnlock()
+	return nil
+}
 
-	defer func() {
-		g.Lock()
-		if time.Since(g.lastPingAll) > 30*time.Minute {
-			g.lastPingAll = time.Now()
-			go g.PingAll(c, 1)
+// checkServerName returns an error unless name is an IP address or a DNS
+// name, with an optional trailing dot, which a TLS certificate can be
+// verified against.
+func checkServerName(name string) error {
+	if name == "" {
+		return errors.New("missing server name")
+	}
+	if net.ParseIP(name) != nil {
+		return nil
+	}
+	invalid := func(reason string) error {
+		return fmt.Errorf("invalid server name %q: %s", name, reason)
+	}
+	host := strings.TrimSuffix(name, ".")
+	if len(host) > 253 {
+		return invalid("longer than 253 characters")
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" {
+			return invalid("empty label")
 		}
-		g.Unlock()
-
-	}()
-
-	for _, r := range remotes {
-		conn, err = r.Dial(c)
-		if err != nil {
-			log.Debugf("retry due to dial failure: %v", err)
-		} else {
-			break
+		if len(label) > 63 {
+			return invalid("label longer than 63 characters")
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return invalid("label starting or ending with a hyphen")
+		}
+		for _, r := range label {
+			if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_') {
+				return invalid(fmt.Sprintf("invalid character %q", r))
+			}
 		}
 	}
+	return nil
+}
 
-	return conn, err
+// NewServerInZone is like NewServer for a server located in the given zone,
+// e.g. a region or data center. Groups prefer servers in the zone of
+// Client.PreferredZone.
+func NewServerInZone(addr net.Addr, serverName, zone string) Remote {
+	return &singleRemote{
+		Addr:       addr,
+		ServerName: serverName,
+		zone:       zone,
+	}
 }
 
-// PingAll loops through all remote servers for performance measurement
-// in a separate goroutine. It allows a separate goroutine to
-// asynchronously sort remotes by ping latencies. It also serves
-// as a service discovery tool.
-func (g *Group) PingAll(c *Client, concurrency int) {
-	g.RLock()
-	remotes := make([]mRemote, len(g.remotes))
-	copy(remotes, g.remotes)
-	g.RUnlock()
+// NewUnixServer creates a new remote for a keyserver listening on the Unix
+// socket at path. Since no host name can be derived from a path, serverName
+// is required to verify the server's TLS certificate.
+func NewUnixServer(path, serverName string) Remote {
+	return NewServer(&net.UnixAddr{Name: path, Net: "unix"}, serverName)
+}
 
+// UnixRemote returns a Remote constructed from the Unix address
+func UnixRemote(unixAddr, serverName string) (Remote, error) {
+	addr, err := net.ResolveUnixAddr("unix", unixAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewServer(addr, serverName), nil
+}
+
+// LookupServerWithName uses DNS to look up an a group of Remote servers with
+// optional TLS server name. If host is an IP address, possibly in brackets,
+// no lookup is made and a single server at that address is returned. An IPv6
+// link-local address may be scoped with a zone, e.g. fe80::1%eth0, which
+// takes precedence over Client.LinkLocalZone. The members of the Group are
+// the distinct addresses host resolves to, IPv4 first and then in byte order
+// (before Client.IPPreference applies), so that the same answers always make
+// the same Group. An empty host, a port outside of 1-65535, or a server name
+// which is neither a DNS name nor an IP address fails without a lookup.
+func (c *Client) LookupServerWithName(serverName, host, port string) (Remote, error) {
+	return c.LookupServerWithNameContext(context.Background(), serverName, host, port)
+}
+
+// LookupServerWithNameContext is like LookupServerWithName, but the lookup is
+// traced with a span started from ctx, and aborted once ctx is done,
+// returning ctx.Err().
+func (c *Client) LookupServerWithNameContext(ctx context.Context, serverName, host, port string) (Remote, error) {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	// the zone of a scoped IPv6 address, e.g. fe80::1%eth0, isn't part of
+	// the server's name
+	literal, zone := host, ""
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		literal, zone = host[:i], host[i+1:]
+	}
+	if serverName == "" {
+		serverName = literal
+	}
+
+	if ip := net.ParseIP(literal); ip != nil {
+		portNumber, err := parsePort(port)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkServerName(serverName); err != nil {
+			return nil, err
+		}
+		addr := &net.TCPAddr{IP: ip, Port: portNumber, Zone: zone}
+		if zone == "" {
+			var ok bool
+			if addr, ok = c.serverAddr(ip, portNumber); !ok {
+				return nil, fmt.Errorf("link-local address %s requires a zone, e.g. %s%%eth0, or Client.LinkLocalZone", host, host)
+			}
+		}
+		if c.Blacklist.Contains(addr) {
+			return nil, &DialError{Remote: NewServer(addr, serverName), Err: ErrBlacklisted}
+		}
+		if c.ServerNameForIP != nil {
+			if override := c.ServerNameForIP(ip); override != "" {
+				serverName = override
+			}
+		}
+		return NewServer(addr, serverName), nil
+	}
+
+	servers, err := c.lookupServers(ctx, serverName, host, port)
+	if err != nil {
+		return nil, err
+	}
+	g, err := NewGroup(servers)
+	if err != nil {
+		return nil, err
+	}
+	g.origin = &lookupOrigin{serverName: serverName, host: host, port: port}
+	c.warmupInitial(g)
+	return g, nil
+}
+
+// serverAddr returns the address of the server at ip and port. IPv6
+// link-local addresses are scoped to c.LinkLocalZone, since they can't be
+// dialed without a zone; it reports false for them if it's unset.
+func (c *Client) serverAddr(ip net.IP, port int) (*net.TCPAddr, bool) {
+	addr := &net.TCPAddr{IP: ip, Port: port}
+	if ip.To4() == nil && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()) {
+		if c.LinkLocalZone == "" {
+			return nil, false
+		}
+		addr.Zone = c.LinkLocalZone
+	}
+	return addr, true
+}
+
+// lookupServers resolves host to the servers which LookupServerWithName
+// makes a Group of.
+func (c *Client) lookupServers(ctx context.Context, serverName, host, port string) ([]Remote, error) {
+	// malformed inputs are caught before a lookup, which would make a
+	// confusing error of them
+	if host == "" {
+		return nil, errors.New("missing server host")
+	}
+	portNumber, err := parsePort(port)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkServerName(serverName); err != nil {
+		return nil, err
+	}
+
+	ips, err := c.lookupIPs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips = c.IPPreference.apply(sortIPs(ips))
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("fail to resolve %s", host)
+	}
+
+	var servers []Remote
+	for _, ip := range ips {
+		addr, ok := c.serverAddr(ip, portNumber)
+		if !ok {
+			c.logger().Warningf("server lookup: skipping link-local address %s of %s without Client.LinkLocalZone", ip, host)
+			continue
+		}
+		if c.Blacklist.Contains(addr) {
+			continue
+		}
+		if c.MaxRemotes > 0 && len(servers) >= c.MaxRemotes {
+			c.logger().Warningf("server lookup: %s has more than %d upstream, ignoring the rest", host, c.MaxRemotes)
+			break
+		}
+		name := serverName
+		if c.ServerNameForIP != nil {
+			if override := c.ServerNameForIP(ip); override != "" {
+				name = override
+			}
+		}
+		servers = append(servers, NewServer(addr, name))
+	}
+	c.logger().Infof("server lookup: %s has %d usable upstream", host, len(servers))
+	return servers, nil
+}
+
+// LookupServer with default ServerName.
+func (c *Client) LookupServer(hostport string) (Remote, error) {
+	return c.LookupServerContext(context.Background(), hostport)
+}
+
+// LookupServerContext is like LookupServer, but the lookup is traced with a
+// span started from ctx, and aborted once ctx is done, returning ctx.Err().
+func (c *Client) LookupServerContext(ctx context.Context, hostport string) (Remote, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.LookupServerWithNameContext(ctx, "", host, port)
+}
+
+// NewGroupFromAddrs makes a Group of the servers at addrs, host:port
+// strings, e.g. from a service discovery system other than DNS, verified with
+// serverName as TLS server name, or the host of each entry if it's empty.
+// Entries whose host is an IP literal make a single server each, without a
+// lookup, and the other hosts are looked up as by LookupServerWithName.
+// Servers on the client blacklist and duplicates are left out. The errors of
+// the entries which are malformed or fail to resolve are combined into the
+// returned error, along with a Group of the others, unless none is left.
+func (c *Client) NewGroupFromAddrs(addrs []string, serverName string) (Remote, error) {
+	return c.NewGroupFromAddrsContext(context.Background(), addrs, serverName)
+}
+
+// NewGroupFromAddrsContext is like NewGroupFromAddrs, but the lookups are
+// aborted once ctx is done, returning ctx.Err().
+func (c *Client) NewGroupFromAddrsContext(ctx context.Context, addrs []string, serverName string) (Remote, error) {
+	var servers []Remote
+	var errs []error
+	add := func(r Remote) {
+		for _, server := range servers {
+			if sameRemote(server, r) {
+				return
+			}
+		}
+		servers = append(servers, r)
+	}
+	for _, hostport := range addrs {
+		host, port, err := net.SplitHostPort(hostport)
+		if err == nil {
+			_, err = parsePort(port)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid server address %q: %v", hostport, err))
+			continue
+		}
+		literal := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if i := strings.LastIndex(literal, "%"); i >= 0 {
+			literal = literal[:i]
+		}
+		if net.ParseIP(literal) != nil {
+			// a literal isn't looked up
+			r, err := c.LookupServerWithNameContext(ctx, serverName, host, port)
+			if errors.Is(err, ErrBlacklisted) {
+				continue
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("server address %q: %v", hostport, err))
+				continue
+			}
+			add(r)
+			continue
+		}
+		name := serverName
+		if name == "" {
+			name = host
+		}
+		found, err := c.lookupServers(ctx, name, host, port)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("server address %q: %v", hostport, err))
+			continue
+		}
+		for _, r := range found {
+			add(r)
+		}
+	}
+	if len(servers) == 0 {
+		if len(errs) == 0 {
+			return nil, errors.New("no server address left to make a group of")
+		}
+		return nil, combineErrors(errs)
+	}
+	g, err := NewGroup(servers)
+	if err != nil {
+		return nil, err
+	}
+	c.warmupInitial(g)
+	return g, combineErrors(errs)
+}
+
+// LookupServerSRV uses DNS SRV records to look up a group of Remote servers
+// for the given service, e.g. LookupServerSRV("keyless", "tcp", "example.com")
+// looks up _keyless._tcp.example.com. Each target's addresses are resolved and
+// verified with the target name as TLS server name. Targets which fail to
+// resolve are skipped. The group dials targets as their priorities and
+// weights direct, see SRVPolicy.
+func (c *Client) LookupServerSRV(service, proto, domain string) (Remote, error) {
+	return c.LookupServerSRVContext(context.Background(), service, proto, domain)
+}
+
+// LookupServerSRVContext is like LookupServerSRV, but the lookups are traced
+// with spans started from ctx, and aborted once ctx is done, returning
+// ctx.Err().
+func (c *Client) LookupServerSRVContext(ctx context.Context, service, proto, domain string) (Remote, error) {
+	name := "_" + service + "._" + proto + "." + domain
+	srvs, err := lookupSRV(ctx, c.logger(), c.resolvers(), name, c.DNSTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// with too many targets, those of the best priorities are kept
+	sort.SliceStable(srvs, func(i, j int) bool { return srvs[i].Priority < srvs[j].Priority })
+	var servers []Remote
+	seen := make(map[string]bool)
+	full := func() bool { return c.MaxRemotes > 0 && len(servers) >= c.MaxRemotes }
+	var truncated bool
+	for _, srv := range srvs {
+		if full() {
+			truncated = true
+			break
+		}
+		target := strings.TrimSuffix(srv.Target, ".")
+		ips, err := c.lookupIPs(ctx, target)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			c.logger().Warningf("server lookup: skipping SRV target %s: %v", target, err)
+			continue
+		}
+
+		for _, ip := range c.IPPreference.apply(ips) {
+			addr, ok := c.serverAddr(ip, int(srv.Port))
+			if !ok {
+				c.logger().Warningf("server lookup: skipping link-local address %s of %s without Client.LinkLocalZone", ip, target)
+				continue
+			}
+			if seen[addr.String()] || c.Blacklist.Contains(addr) {
+				continue
+			}
+			if full() {
+				truncated = true
+				break
+			}
+			seen[addr.String()] = true
+			servers = append(servers, &singleRemote{
+				Addr:       addr,
+				ServerName: target,
+				priority:   srv.Priority,
+				weight:     srv.Weight,
+			})
+		}
+	}
+	if truncated {
+		c.logger().Warningf("server lookup: %s has more than %d upstream, ignoring the rest", name, c.MaxRemotes)
+	}
+	c.logger().Infof("server lookup: %s has %d usable upstream", name, len(servers))
+	g, err := NewGroup(servers)
+	if err != nil {
+		return nil, err
+	}
+	g.policy = SRVPolicy{c.latencyPolicy()}
+	c.warmupInitial(g)
+	return g, nil
+}
+
+// warmupInitial probes a Group made by a lookup within c.InitialProbeTimeout,
+// if it's set.
+func (c *Client) warmupInitial(g *Group) {
+	if c.InitialProbeTimeout > 0 {
+		g.WarmupWithin(c, c.InitialProbeTimeout)
+	}
+}
+
+// Dial dials a remote server, returning an existing connection if possible.
+func (s *singleRemote) Dial(c *Client) (*Conn, error) {
+	return s.DialContext(context.Background(), c)
+}
+
+// DialContext is like Dial, but the TLS dial is aborted once ctx is done.
+func (s *singleRemote) DialContext(ctx context.Context, c *Client) (*Conn, error) {
+	return s.dialTraced(ctx, c, false)
+}
+
+// AcquireContext is like DialContext, but returns a connection which no
+// other caller is using, waiting for one to be returned, or until ctx is
+// done, once Client.MaxConnsPerRemote are open.
+func (s *singleRemote) AcquireContext(ctx context.Context, c *Client) (*Conn, error) {
+	return s.dialTraced(ctx, c, true)
+}
+
+// dialTraced implements DialContext, and AcquireContext if exclusive is set.
+func (s *singleRemote) dialTraced(ctx context.Context, c *Client, exclusive bool) (*Conn, error) {
+	ctx, span := c.tracer().Start(ctx, spanDial)
+	span.SetAttribute("server.name", s.ServerName)
+	span.SetAttribute("server.addr", s.String())
+	cn, err := s.dial(ctx, c, exclusive)
+	switch {
+	case err == nil:
+		atomic.StoreInt32(&s.failing, 0)
+	case ctx.Err() == nil && !errors.Is(err, ErrBlacklisted) && !errors.Is(err, ErrRateLimited):
+		// rejections say nothing about the server itself
+		atomic.StoreInt32(&s.failing, 1)
+	}
+	endSpan(span, err)
+	return cn, err
+}
+
+// IsHealthy reports whether the singleRemote isn't on the client blacklist,
+// and whether its last dial or ping, if any, succeeded.
+func (s *singleRemote) IsHealthy(c *Client) bool {
+	return !c.Blacklist.Contains(s.Addr) && atomic.LoadInt32(&s.failing) == 0
+}
+
+// ID implements Identifier: single servers are the same if they have the
+// same network, address and server name.
+func (s *singleRemote) ID() string {
+	return s.ServerName + "@" + s.Network() + "/" + s.String()
+}
+
+// Conn returns an established connection to the server, if there is one,
+// without dialing. Like a dialed connection, it must be returned with
+// KeepAlive or Close once done with.
+func (s *singleRemote) Conn() (*Conn, bool) {
+	return connPool.Peek(s.String())
+}
+
+// A conner is a Remote which can return one of its established connections
+// without dialing.
+type conner interface {
+	Conn() (*Conn, bool)
+}
+
+// An acquirer is a Remote which can hand out connections exclusively, see
+// Group.AcquireContext.
+type acquirer interface {
+	AcquireContext(context.Context, *Client) (*Conn, error)
+}
+
+// dial implements dialTraced.
+func (s *singleRemote) dial(ctx context.Context, c *Client, exclusive bool) (*Conn, error) {
+	metrics := c.metrics()
+	if c.Blacklist.Contains(s.Addr) {
+		metrics.BlacklistRejection(s.ServerName, s.String())
+		return nil, &DialError{Remote: s, Err: ErrBlacklisted}
+	}
+	if c.rateLimited(s.String(), true) {
+		return nil, &DialError{Remote: s, Err: ErrRateLimited}
+	}
+
+	var cn *Conn
+	var err error
+	for {
+		var idle time.Duration
+		if exclusive {
+			cn, idle, err = connPool.Acquire(ctx, s.String(), c.MaxConnsPerRemote)
+		} else {
+			cn, idle, err = connPool.Checkout(ctx, s.String(), c.MaxConnsPerRemote)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cn == nil {
+			break
+		}
+		if c.ValidateAfter <= 0 || idle < c.ValidateAfter {
+			s.reuse(c)
+			return cn, nil
+		}
+		// the server may have gone away silently while the connection
+		// was idle, so it's checked before being handed out
+		err = cn.validate(c.validateTimeout())
+		if err == nil {
+			s.reuse(c)
+			return cn, nil
+		}
+		c.logger().Infof("pooled connection to %s failed validation, reconnecting: %v", s.String(), err)
+		cn.discard(CloseReasonPingFailed)
+	}
+
+	reconnect := c.reconnectBackoffFor(s.String())
+	if reconnect != nil {
+		if wait := reconnect.wait(c.ReconnectBackoff, c.maxReconnectBackoff()); wait > 0 {
+			c.logger().Debugf("waiting %v before reconnecting to %s", wait, s.String())
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				connPool.Cancel(s.String())
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	config := c.tlsConfigFor(s.ServerName)
+	if config.ClientSessionCache == nil {
+		config.ClientSessionCache = c.sessionCacheFor(s.String())
+	}
+	c.logger().Debugf("Dialing %s at %s\n", s.ServerName, s.String())
+	metrics.Dial(s.ServerName, s.String())
+	dialCtx := ctx
+	if c.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, c.DialTimeout)
+		defer cancel()
+	}
+	inner, err := s.dialTLS(dialCtx, c, config)
+	if err != nil {
+		metrics.DialFailure(s.ServerName, s.String())
+		connPool.Cancel(s.String())
+		return nil, &DialError{Remote: s, Err: err}
+	}
+
+	atomic.AddInt64(&s.opened, 1)
+	var resumed bool
+	if stater, ok := inner.(connectionStater); ok {
+		resumed = stater.ConnectionState().DidResume
+		if m, ok := metrics.(HandshakeMetrics); ok {
+			m.Handshake(s.ServerName, s.String(), resumed)
+		}
+	}
+	kc := conn.NewConn(inner)
+	kc.SetMaxInflight(c.MaxInflightPerConn)
+	// like NewConn, but the health checker only starts once cn is set up
+	cn = NewStandaloneConn(s.String(), kc)
+	cn.serverName = s.ServerName
+	cn.logger = c.logger()
+	cn.resumed = resumed
+	if c.OnConnClose != nil {
+		cn.onClose = func(cn *Conn, reason string) { c.OnConnClose(s, cn, reason) }
+	}
+	if c.MaxConnLifetime > 0 {
+		cn.expires = timeNow().Add(c.MaxConnLifetime)
+	}
+	go healthchecker(cn)
+	connPool.Fill(s.String(), cn)
+	if c.KeepaliveInterval > 0 {
+		go keepalive(cn, c.KeepaliveInterval, c.healthCheckJitter())
+	}
+	dialed := timeNow()
+	go func() {
+		for {
+			err := cn.Conn.DoRead()
+			if err != nil {
+				if err == io.EOF {
+					c.logger().Debugf("connection closed by server")
+				} else {
+					c.logger().Errorf("failed to read next header from %v: %v", s.String(), err)
+				}
+				break
+			}
+		}
+
+		select {
+		case <-cn.closed:
+			// closed by the client
+		default:
+			if reconnect != nil {
+				reconnect.lost(timeNow().Sub(dialed), c.maxReconnectBackoff())
+			}
+		}
+		cn.closeFor(CloseReasonBroken)
+	}()
+
+	return cn, nil
+}
+
+// reuse counts a dial of s served by a pooled connection.
+func (s *singleRemote) reuse(c *Client) {
+	atomic.AddInt64(&s.reused, 1)
+	if m, ok := c.metrics().(ReuseMetrics); ok {
+		m.Reuse(s.ServerName, s.String())
+	}
+}
+
+// A connectionStater is a connection with a TLS connection state, such as a
+// *tls.Conn or a wrapper of one returned by Client.DialFunc.
+type connectionStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// dialTLS connects to the singleRemote, with c.DialContextFunc or c.DialFunc
+// if set, or through c.Proxy if set, then makes the TLS handshake with it,
+// which c.VerifyServer may reject.
+func (s *singleRemote) dialTLS(ctx context.Context, c *Client, config *tls.Config) (net.Conn, error) {
+	release, err := c.dialSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var tlsConn *tls.Conn
+	if c.DialContextFunc != nil || c.DialFunc != nil {
+		var nc net.Conn
+		if c.DialContextFunc != nil {
+			nc, err = c.DialContextFunc(ctx, s.Network(), s.String(), config)
+		} else {
+			nc, err = c.DialFunc(s.Network(), s.String(), config)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if tlsConn, ok = nc.(*tls.Conn); !ok {
+			return s.verifyConn(c, nc)
+		}
+	} else {
+		var raw net.Conn
+		if c.Proxy != nil {
+			raw, err = c.dialProxy(ctx, s.Network(), s.String())
+		} else {
+			raw, err = c.netDialer().DialContext(ctx, s.Network(), s.String())
+		}
+		if err != nil {
+			return nil, err
+		}
+		tlsConn = tls.Client(raw, config)
+	}
+	handshakeCtx := ctx
+	if c.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		handshakeCtx, cancel = context.WithTimeout(ctx, c.HandshakeTimeout)
+		defer cancel()
+	}
+	if err := handshake(handshakeCtx, tlsConn); err != nil {
+		tlsConn.Close()
+		if ctx.Err() == nil && handshakeCtx.Err() != nil {
+			return nil, fmt.Errorf("TLS handshake timed out after %v: %w", c.HandshakeTimeout, err)
+		}
+		return nil, err
+	}
+	return s.verifyConn(c, tlsConn)
+}
+
+// verifyConn checks conn, a connection to the singleRemote whose handshake is
+// complete, with c.VerifyServer if set, closing it if it's rejected. A
+// connection without a TLS connection state, e.g. a mock transport returned
+// by c.DialFunc, can't be verified, and is rejected if c.VerifyServer is set.
+func (s *singleRemote) verifyConn(c *Client, conn net.Conn) (net.Conn, error) {
+	if c.VerifyServer == nil {
+		return conn, nil
+	}
+	stater, ok := conn.(connectionStater)
+	if !ok {
+		conn.Close()
+		return nil, &VerificationError{Err: fmt.Errorf("connection of type %T has no TLS state", conn)}
+	}
+	if err := c.VerifyServer(stater.ConnectionState(), s); err != nil {
+		conn.Close()
+		return nil, &VerificationError{Err: err}
+	}
+	return conn, nil
+}
+
+// dialSlot waits for one of the c.MaxConcurrentDials dials to complete, if
+// as many are in progress, or for ctx to be done. It returns the function
+// which gives the slot back once the dial completes.
+func (c *Client) dialSlot(ctx context.Context) (func(), error) {
+	if c.MaxConcurrentDials <= 0 {
+		return func() {}, nil
+	}
+	c.dialSlotsOnce.Do(func() {
+		c.dialSlots = make(chan struct{}, c.MaxConcurrentDials)
+	})
+	select {
+	case c.dialSlots <- struct{}{}:
+		return func() { <-c.dialSlots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for one of %d dials in progress: %w", c.MaxConcurrentDials, ctx.Err())
+	}
+}
+
+// handshake runs the TLS handshake of conn, giving up with ctx.Err() once ctx
+// is done, as tls.Conn.HandshakeContext does in Go 1.17 and later.
+func handshake(ctx context.Context, conn *tls.Conn) error {
+	stop := afterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	err := conn.Handshake()
+	if !stop() {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// tlsConfigFor returns a copy of the client TLS config for dialing the server
+// with the given name. The copy is made with Clone so that no field, such as
+// a VerifyPeerCertificate callback used for pinning, is dropped.
+func (c *Client) tlsConfigFor(serverName string) *tls.Config {
+	config := c.tlsConfig()
+	config.ServerName = serverName
+	return config
+}
+
+// tlsConfig returns a copy of the client TLS config which, once
+// SetClientCertificate was called, fetches the latest client certificate for
+// each handshake.
+func (c *Client) tlsConfig() *tls.Config {
+	config := c.Config.Clone()
+	if cert, _ := c.clientCertificate(); cert != nil {
+		config.Certificates = nil
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := c.clientCertificate()
+			return cert, nil
+		}
+	}
+	return config
+}
+
+// sessionCacheFor returns the shared session cache of c for dialing the
+// server at addr, or nil if c.SessionCacheSize disables it.
+func (c *Client) sessionCacheFor(addr string) tls.ClientSessionCache {
+	c.sessionCacheOnce.Do(func() {
+		size := c.SessionCacheSize
+		if size == 0 {
+			size = defaultSessionCacheSize
+		}
+		if size > 0 {
+			c.sessionCache = tls.NewLRUClientSessionCache(size)
+		}
+	})
+	if c.sessionCache == nil {
+		return nil
+	}
+	if _, generation := c.clientCertificate(); generation > 0 {
+		addr = fmt.Sprintf("%s #%d", addr, generation)
+	}
+	return addrSessionCache{cache: c.sessionCache, addr: addr}
+}
+
+// addrSessionCache scopes a ClientSessionCache, which crypto/tls keys by
+// server name, to the server at addr, so that servers sharing a name, such
+// as the backends of a DNS name, don't attempt to resume each other's
+// sessions.
+type addrSessionCache struct {
+	cache tls.ClientSessionCache
+	addr  string
+}
+
+func (c addrSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return c.cache.Get(c.addr + " " + sessionKey)
+}
+
+func (c addrSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.cache.Put(c.addr+" "+sessionKey, cs)
+}
+
+// PingAll simply attempts to ping the singleRemote
+func (s *singleRemote) PingAll(c *Client, concurrency int) {
+	cn, err := s.Dial(c)
+	if err != nil {
+		return
+	}
+
+	start := time.Now()
+	err = cn.ping(c)
+	if err != nil {
+		atomic.StoreInt32(&s.failing, 1)
+		c.metrics().PingFailure(cn.serverName, cn.addr)
+		cn.discard(CloseReasonPingFailed)
+		return
+	}
+	c.metrics().Latency(cn.serverName, cn.addr, time.Since(start))
+	cn.KeepAlive()
+}
+
+// inFlight returns the number of callers using a connection to the
+// singleRemote.
+func (s *singleRemote) inFlight() int {
+	return connPool.InFlight(s.String())
+}
+
+// closeGracefully is like Close, but each connection is only closed once the
+// operations in flight on it complete, or timeout elapses.
+func (s *singleRemote) closeGracefully(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var errs []error
+	for _, cn := range connPool.RemoveAll(s.String()) {
+		if !connPool.WaitIdle(cn, deadline) {
+			cn.logger.Warningf("closing connection to %s with operations in flight after draining for %v", s.String(), timeout)
+		}
+		if err := cn.close(CloseReasonShutdown); err != nil && err != conn.ErrClosed {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+// reapIdle closes the pooled connections to the singleRemote which haven't
+// been used for maxIdle.
+func (s *singleRemote) reapIdle(maxIdle time.Duration) {
+	connPool.ReapIdle(s.String(), maxIdle)
+}
+
+// Close closes all pooled connections to the singleRemote. Since the pool is
+// keyed by address, this includes connections dialed through other Remotes
+// with the same address. Close may be called more than once, and the
+// singleRemote can still be dialed afterwards.
+func (s *singleRemote) Close() error {
+	var errs []error
+	for _, cn := range connPool.RemoveAll(s.String()) {
+		if err := cn.closeFor(CloseReasonShutdown); err != nil && err != conn.ErrClosed {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+// combineErrors returns nil if errs is empty, the only error if there is one,
+// and otherwise an error listing all of them.
+func combineErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Errorf("%d errors: %s", len(errs), strings.Join(msgs, "; "))
+}
+
+// ewmaLatency is exponentially weighted moving average of latency
+type ewmaLatency struct {
+	val      time.Duration
+	measured bool
+}
+
+// Update folds a new measurement into the moving average, weighting it by
+// the smoothing factor alpha.
+func (l *ewmaLatency) Update(val time.Duration, alpha float64) {
+	// the first measurement seeds the average instead of being
+	// weighted against a meaningless zero value.
+	if !l.measured {
+		l.val = val
+		l.measured = true
+		return
+	}
+	l.val = time.Duration(alpha*float64(val) + (1-alpha)*float64(l.val))
+}
+
+// Reset discards the current measurement, e.g. after a failed dial or ping.
+func (l *ewmaLatency) Reset() {
+	l.val = 0
+	l.measured = false
+}
+
+// Better reports whether l should be preferred over r.
+func (l ewmaLatency) Better(r ewmaLatency) bool {
+	// if l is not measured (it also means last measurement was
+	// a failure), any updated/measured latency is better than
+	// l. Also if neither l or r is measured, l can't be better
+	// than r.
+	if !l.measured {
+		return false
+	}
+
+	if l.measured && !r.measured {
+		return true
+	}
+
+	return l.val < r.val
+}
+
+// A Member is a Remote in a Group, along with the measurements the Group
+// keeps about it. Apart from the embedded Remote, its fields are protected by
+// the lock of the Group which holds it.
+type Member struct {
+	Remote
+	// pos is the position of the member in its Group.
+	pos int
+	// weight is the relative share of dials WeightedPolicy gives the member.
+	weight  int
+	latency ewmaLatency
+	// percentiles is the histogram of ping latencies, kept if
+	// Client.LatencyPercentiles is set.
+	percentiles *latencyHistogram
+	// errorCount is the number of failed dials and pings, halved by each
+	// success so that a recovered member regains parity with the others.
+	errorCount int
+	// failures is the number of consecutive failed dials and pings.
+	failures int
+	// transportFailures and protocolFailures split failures into those of
+	// unreachable servers and those of servers answering with an error.
+	transportFailures, protocolFailures int
+	// openedAt is when the circuit breaker last opened, or zero if it's
+	// closed.
+	openedAt time.Time
+
+	// slow is whether the latency of the member was last checked above
+	// Client.LatencyThreshold.
+	slow bool
+	// drained is set while the member is taken out of rotation by
+	// Group.Drain.
+	drained bool
+
+	// probeInterval is how long after its last probe the member is probed
+	// again by an adaptive health check, and nextProbe when.
+	probeInterval time.Duration
+	nextProbe     time.Time
+
+	// counters reported by Group.Stats
+	dials, dialFailures    int
+	pings, pingFailures    int
+	transportErrors        int
+	protocolErrors         int
+	lastErr                error
+	lastSuccess, lastErrAt time.Time
+}
+
+// Latency returns the moving average of the ping latencies of m, and whether
+// there is a measurement at all. It must only be called by a Policy.
+func (m *Member) Latency() (time.Duration, bool) {
+	return m.latency.val, m.latency.measured
+}
+
+// Percentile returns an estimate of the q-th quantile, in (0, 1], of the ping
+// latencies of m, e.g. 0.99 for the 99th percentile, and whether there is a
+// measurement at all. Percentiles are only measured if
+// Client.LatencyPercentiles is set. It must only be called by a Policy.
+func (m *Member) Percentile(q float64) (time.Duration, bool) {
+	if m.percentiles == nil {
+		return 0, false
+	}
+	return m.percentiles.Percentile(q)
+}
+
+// ErrorCount returns the number of failed dials and pings of m, which is
+// halved by each successful one. It must only be called by a Policy.
+func (m *Member) ErrorCount() int {
+	return m.errorCount
+}
+
+// An inFlighter is a Remote which can tell how many callers are using its
+// connections.
+type inFlighter interface {
+	inFlight() int
+}
+
+// InFlight returns the number of callers which dialed m and haven't returned
+// their connection yet, with KeepAlive or Close. It's zero for remotes which
+// don't keep track, such as custom Remote implementations.
+func (m *Member) InFlight() int {
+	if r, ok := m.Remote.(inFlighter); ok {
+		return r.inFlight()
+	}
+	return 0
+}
+
+// available reports whether m may be dialed according to its circuit
+// breaker. Once an open breaker's cooldown has elapsed, a single trial is let
+// through by re-arming the cooldown, so concurrent callers keep skipping m
+// until the trial's outcome is recorded.
+func (m *Member) available(c *Client) bool {
+	if m.openedAt.IsZero() {
+		return true
+	}
+	if time.Since(m.openedAt) < c.breakerCooldown() {
+		return false
+	}
+	m.openedAt = time.Now()
+	return true
+}
+
+// healthy reports whether the last dial or ping of m succeeded and its
+// circuit breaker is closed.
+func (m *Member) healthy() bool {
+	return m.failures == 0 && m.openedAt.IsZero()
+}
+
+// recordSuccess closes the circuit breaker of m. It reports whether m was
+// unhealthy before.
+func (m *Member) recordSuccess(c *Client) bool {
+	changed := !m.healthy()
+	if !m.openedAt.IsZero() {
+		c.publish(m, BreakerClosed, nil)
+	}
+	m.errorCount /= 2
+	m.failures = 0
+	m.transportFailures = 0
+	m.protocolFailures = 0
+	m.openedAt = time.Time{}
+	m.lastSuccess = time.Now()
+	if changed {
+		c.publish(m, RemoteUp, nil)
+	}
+	return changed
+}
+
+// recordLatency adds a successful ping or operation of m which took d to its
+// histogram, if c.LatencyPercentiles is set.
+func (m *Member) recordLatency(c *Client, d time.Duration) {
+	if !c.LatencyPercentiles {
+		return
+	}
+	if m.percentiles == nil {
+		m.percentiles = &latencyHistogram{}
+	}
+	m.percentiles.Add(d)
+}
+
+// recordFailure counts a failure of m with err, opening its circuit breaker
+// once c.BreakerThreshold consecutive failures are reached. It reports
+// whether m was healthy before.
+func (m *Member) recordFailure(c *Client, err error) bool {
+	changed := m.healthy()
+	m.errorCount++
+	m.failures++
+	if isProtocolError(err) {
+		m.protocolErrors++
+		m.protocolFailures++
+	} else {
+		m.transportErrors++
+		m.transportFailures++
+	}
+	m.lastErr = err
+	m.lastErrAt = time.Now()
+	if changed {
+		c.publish(m, RemoteDown, err)
+	}
+	if m.breakerTripped(c) {
+		if m.openedAt.IsZero() {
+			c.logger().Infof("circuit breaker opened after %d failures", m.failures)
+			c.publish(m, BreakerOpened, err)
+		}
+		m.openedAt = time.Now()
+	}
+	return changed
+}
+
+// breakerTripped reports whether the consecutive failures of m reached the
+// thresholds of c at which its circuit breaker opens.
+func (m *Member) breakerTripped(c *Client) bool {
+	if c.ProtocolBreakerThreshold <= 0 {
+		return c.BreakerThreshold > 0 && m.failures >= c.BreakerThreshold
+	}
+	if c.BreakerThreshold > 0 && m.transportFailures >= c.BreakerThreshold {
+		return true
+	}
+	return m.protocolFailures >= c.ProtocolBreakerThreshold
+}
+
+// isProtocolError reports whether err was returned by a server which was
+// reached but rejected the operation, rather than by a failure to reach it.
+func isProtocolError(err error) bool {
+	var serverErr protocol.Error
+	return errors.As(err, &serverErr)
+}
+
+// stateChanged calls c.OnStateChange, if set, for a member of a Group which
+// became healthy or unhealthy. It must be called without the Group locked.
+func (c *Client) stateChanged(m *Member, healthy bool) {
+	if c.OnStateChange == nil {
+		return
+	}
+	var addr net.Addr
+	var serverName string
+	if single, ok := m.Remote.(*singleRemote); ok {
+		addr, serverName = single.Addr, single.ServerName
+	}
+	c.OnStateChange(addr, serverName, healthy)
+}
+
+// A Group is a Remote consisting of a load-balanced set of external servers.
+type Group struct {
+	sync.RWMutex
+	// id is the identity of the Group, see ID. It is set on creation and
+	// never changes, so it's read without the lock.
+	id          string
+	remotes     []*Member
+	policy      Policy
+	lastPingAll time.Time
+	// policyCheck checks the Policy set by SetPolicy on its first use.
+	policyCheck *sync.Once
+	// nextPos is the position of the next member added.
+	nextPos int
+	// sweep is closed when the PingAll in progress, if any, completes.
+	sweep chan struct{}
+
+	// hcStop and hcDone control the goroutine started by StartHealthCheck.
+	hcStop, hcDone chan struct{}
+	// hcInterval is the interval given to StartHealthCheck, which adaptive
+	// probe intervals start from.
+	hcInterval time.Duration
+	// drainTimeout is how long Close and Remove wait for operations in
+	// flight to complete.
+	drainTimeout time.Duration
+	// reapStop and reapDone control the goroutine closing idle
+	// connections, which is started by the first dial if
+	// Client.MaxIdleTime is set.
+	reapStop, reapDone chan struct{}
+	// closing is canceled by Close to abort the dials and sweeps in
+	// progress, and replaced by the next one.
+	closing       context.Context
+	cancelClosing context.CancelFunc
+	// closed is set by Close, after which dials no longer start the
+	// background goroutines of g.
+	closed bool
+	// origin is how LookupServerWithName found the members, so that they
+	// can be looked up again, or nil for other Groups.
+	origin *lookupOrigin
+}
+
+// A lookupOrigin is the host name and port a Group was looked up from, and
+// the TLS server name of its members.
+type lookupOrigin struct {
+	serverName, host, port string
+}
+
+// NewGroup creates a new group from a set of remotes. Duplicate remotes are
+// only added once, and nil ones are skipped.
+func NewGroup(remotes []Remote) (*Group, error) {
+	if len(remotes) == 0 {
+		return nil, errors.New("attempted to create empty remote group")
+	}
+	g := new(Group)
+
+	for _, r := range remotes {
+		g.add(r)
+	}
+	if len(g.remotes) == 0 {
+		return nil, errors.New("attempted to create remote group of nil remotes")
+	}
+	g.id = g.membersID()
+
+	return g, nil
+}
+
+// add appends r to the members of g, unless it's nil or already a member,
+// returning the member added, or the one r matches with added false, or nil
+// if r is nil. g must be locked.
+func (g *Group) add(r Remote) (m *Member, added bool) {
+	if r == nil {
+		return nil, false
+	}
+	for _, m := range g.remotes {
+		if sameRemote(m.Remote, r) {
+			return m, false
+		}
+	}
+	m = &Member{Remote: r, pos: g.nextPos, weight: 1}
+	g.remotes = append(g.remotes, m)
+	g.nextPos++
+	return m, true
+}
+
+// NewWeightedGroup creates a new group from a set of remotes which spreads
+// dials between them in proportion to their weights, regardless of latency.
+// Remotes with a weight of zero are only dialed if no other remote can be. A
+// nil remote is skipped. Remotes which match each other, as described for
+// Remove, make a single member, and must be given the same weight.
+func NewWeightedGroup(weights map[Remote]int) (*Group, error) {
+	if len(weights) == 0 {
+		return nil, errors.New("attempted to create empty remote group")
+	}
+	g := new(Group)
+	for r, weight := range weights {
+		if weight < 0 {
+			return nil, fmt.Errorf("negative weight %d", weight)
+		}
+		if r == nil {
+			continue
+		}
+		m, added := g.add(r)
+		if !added && m.weight != weight {
+			return nil, fmt.Errorf("remote %v given both weights %d and %d", r, m.weight, weight)
+		}
+		m.weight = weight
+	}
+	if len(g.remotes) == 0 {
+		return nil, errors.New("attempted to create remote group of nil remotes")
+	}
+	g.id = g.membersID()
+	g.policy = WeightedPolicy{}
+	return g, nil
+}
+
+// Add adds r to the group. Adding a remote which matches a member, as
+// described for Remove, a nil remote, or the group itself, which would make
+// dials recurse forever, is a no-op. It is safe to call concurrently with
+// dials.
+func (g *Group) Add(r Remote) {
+	if r == Remote(g) {
+		return
+	}
+	g.Lock()
+	g.add(r)
+	g.Unlock()
+}
+
+// Remove removes the member matching r from the group and closes its
+// connections. Remotes match if they have the same Identifier ID, e.g.
+// single servers with the same address and server name; other remotes only
+// match themselves. It reports whether a member was removed.
+func (g *Group) Remove(r Remote) bool {
+	g.Lock()
+	var removed *Member
+	for i, m := range g.remotes {
+		if sameRemote(m.Remote, r) {
+			removed = m
+			// copy rather than shift in place, so that snapshots of
+			// the members taken under the lock stay intact
+			g.remotes = append(g.remotes[:i:i], g.remotes[i+1:]...)
+			break
+		}
+	}
+	g.Unlock()
+
+	if removed == nil {
+		return false
+	}
+	g.RLock()
+	timeout := g.drainTimeout
+	g.RUnlock()
+	if err := closeRemote(removed.Remote, timeout); err != nil {
+		defaultLogger.Warningf("failed to close removed remote: %v", err)
+	}
+	return true
+}
+
+// Drain takes the member matching r, as described for Remove, out of
+// rotation, e.g. for the maintenance of a server: dials of the group no
+// longer pick it, while the operations in flight on its connections
+// complete. Unlike Remove, it is still health checked and keeps its
+// measurements, and unlike the client blacklist, it only affects g. It
+// reports whether a member matched.
+func (g *Group) Drain(r Remote) bool {
+	return g.setDrained(r, true)
+}
+
+// Undrain puts the member matching r, as described for Remove, back into
+// rotation after Drain. It reports whether a member matched.
+func (g *Group) Undrain(r Remote) bool {
+	return g.setDrained(r, false)
+}
+
+func (g *Group) setDrained(r Remote, drained bool) bool {
+	g.Lock()
+	defer g.Unlock()
+	for _, m := range g.remotes {
+		if sameRemote(m.Remote, r) {
+			m.drained = drained
+			return true
+		}
+	}
+	return false
+}
+
+// SetDrainTimeout sets how long Close and Remove let the operations in
+// flight on the connections they close complete, after which those
+// connections are closed regardless. The members are drained at once, so
+// that Close takes at most about timeout. No new operations are started on
+// draining connections. Zero, the default, closes connections immediately.
+func (g *Group) SetDrainTimeout(timeout time.Duration) {
+	g.Lock()
+	g.drainTimeout = timeout
+	g.Unlock()
+}
+
+// A gracefulCloser is a Remote which can close its connections once the operations
+// in flight on them complete, or timeout elapses.
+type gracefulCloser interface {
+	closeGracefully(timeout time.Duration) error
+}
+
+// closeRemote closes r, draining its connections for up to timeout if it's
+// positive.
+func closeRemote(r Remote, timeout time.Duration) error {
+	if d, ok := r.(gracefulCloser); ok && timeout > 0 {
+		return d.closeGracefully(timeout)
+	}
+	return r.Close()
+}
+
+// A RemoteStat is a snapshot of the state of a member of a Group.
+type RemoteStat struct {
+	// Remote is the member itself, e.g. to pass to Group.Remove.
+	Remote Remote
+	// Network, Addr, ServerName and Zone describe a single server. They
+	// are empty for other remotes, such as nested groups.
+	Network, Addr, ServerName, Zone string
+	// Latency is the moving average of ping latencies, if Measured.
+	Latency  time.Duration
+	Measured bool
+	// ErrorCount is the number of failed dials and pings, halved by each
+	// successful one. Stats has the totals.
+	ErrorCount int
+	// Healthy is false if the last dial or ping failed, or the circuit
+	// breaker is open.
+	Healthy bool
+	// Drained is whether the member is taken out of rotation by
+	// Group.Drain.
+	Drained bool
+	// LastError is the error of the last failed dial or ping, e.g. why
+	// the TLS handshake with the server failed, and LastErrorAt when it
+	// happened. It's kept once the member recovers.
+	LastError   error
+	LastErrorAt time.Time
+	// Reused is the number of dials of a single server served by a pooled
+	// connection, and Opened the number of those which opened a new one,
+	// e.g. to tell whether connections are churned by MaxConnLifetime or
+	// failures. They count the dials made outside of the group too.
+	Reused, Opened int
+	// P50, P95 and P99 are the 50th, 95th and 99th percentiles of ping
+	// latencies, if Client.LatencyPercentiles is set. They're zero until
+	// the member was pinged successfully.
+	P50, P95, P99 time.Duration
+}
+
+// Remotes returns a snapshot of the members of g, in the order they were
+// added.
+func (g *Group) Remotes() []RemoteStat {
+	g.RLock()
+	defer g.RUnlock()
+	stats := make([]RemoteStat, len(g.remotes))
+	for i, m := range g.remotes {
+		stats[i] = m.stat()
+	}
+	return stats
+}
+
+// stat returns a snapshot of m. The Group holding m must be locked.
+func (m *Member) stat() RemoteStat {
+	stat := RemoteStat{
+		Remote:      m.Remote,
+		Latency:     m.latency.val,
+		Measured:    m.latency.measured,
+		ErrorCount:  m.errorCount,
+		Healthy:     m.healthy(),
+		Drained:     m.drained,
+		LastError:   m.lastErr,
+		LastErrorAt: m.lastErrAt,
+	}
+	if single, ok := m.Remote.(*singleRemote); ok {
+		stat.Network = single.Network()
+		stat.Addr = single.String()
+		stat.ServerName = single.ServerName
+		stat.Zone = single.zone
+		stat.Reused = int(atomic.LoadInt64(&single.reused))
+		stat.Opened = int(atomic.LoadInt64(&single.opened))
+	}
+	stat.P50, _ = m.Percentile(0.50)
+	stat.P95, _ = m.Percentile(0.95)
+	stat.P99, _ = m.Percentile(0.99)
+	return stat
+}
+
+// RemoteStats holds the cumulative counters of a member of a Group, in
+// addition to its current state.
+type RemoteStats struct {
+	RemoteStat
+	// Dials is the number of times the member was dialed by the group,
+	// including dials served by a pooled connection, and DialFailures how
+	// many of them failed.
+	Dials, DialFailures int
+	// Pings is the number of successful health check pings of the member by
+	// PingAll, and PingFailures the number of failed ones.
+	Pings, PingFailures int
+	// TransportErrors is the number of failed dials, pings and operations
+	// for want of reaching the server, e.g. refused connections, failed
+	// handshakes and timeouts, and ProtocolErrors the number of those the
+	// server answered with an error, see protocol.Error.
+	TransportErrors, ProtocolErrors int
+	// ConsecutiveFailures is the number of failed dials and pings since the
+	// last success.
+	ConsecutiveFailures int
+	// LastSuccess is when the member was last dialed or pinged
+	// successfully. It's zero if it never was, as is LastErrorAt if the
+	// member never failed.
+	LastSuccess time.Time
+}
+
+// Stats returns the counters of the members of g, in the order they were
+// added.
+func (g *Group) Stats() []RemoteStats {
+	g.RLock()
+	defer g.RUnlock()
+	stats := make([]RemoteStats, len(g.remotes))
+	for i, m := range g.remotes {
+		stats[i] = RemoteStats{
+			RemoteStat:          m.stat(),
+			Dials:               m.dials,
+			DialFailures:        m.dialFailures,
+			Pings:               m.pings,
+			PingFailures:        m.pingFailures,
+			TransportErrors:     m.transportErrors,
+			ProtocolErrors:      m.protocolErrors,
+			ConsecutiveFailures: m.failures,
+			LastSuccess:         m.lastSuccess,
+		}
+	}
+	return stats
+}
+
+// AggregateLatency summarizes the health of g in a single measurement, e.g.
+// for a dashboard or an alert on the whole group: it returns the lowest
+// moving average of the ping latencies of its healthy members, or zero if
+// none is measured, and the number of healthy members. Drained members
+// aren't counted.
+func (g *Group) AggregateLatency() (time.Duration, int) {
+	g.RLock()
+	defer g.RUnlock()
+	var best time.Duration
+	var measured bool
+	healthy := 0
+	for _, m := range g.remotes {
+		if m.drained || !m.healthy() {
+			continue
+		}
+		healthy++
+		if m.latency.measured && (!measured || m.latency.val < best) {
+			best, measured = m.latency.val, true
+		}
+	}
+	return best, healthy
+}
+
+// Conn returns an established connection to the best member of g which has
+// one, without dialing, e.g. for a best-effort operation which isn't worth a
+// TLS handshake. Healthy members are preferred, and then members are ranked
+// as by LatencyPolicy. Members which can't tell, such as custom Remote
+// implementations, are skipped. Like a dialed connection, it must be
+// returned with KeepAlive or Close once done with.
+func (g *Group) Conn() (*Conn, bool) {
+	g.RLock()
+	ranked := append([]*Member(nil), g.remotes...)
+	sort.Stable(byLatency(ranked))
+	healthy := make(map[*Member]bool)
+	for _, m := range ranked {
+		healthy[m] = m.healthy()
+	}
+	g.RUnlock()
+	sort.SliceStable(ranked, func(i, j int) bool { return healthy[ranked[i]] && !healthy[ranked[j]] })
+
+	// nested remotes are asked without the lock, like they are dialed
+	for _, m := range ranked {
+		if r, ok := m.Remote.(conner); ok {
+			if cn, ok := r.Conn(); ok {
+				return cn, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// readyTimeout bounds the ping of Group.Ready, including the dial it may
+// take.
+const readyTimeout = 5 * time.Second
+
+// Ready returns nil if a member of g answers a ping within 5 seconds, and an
+// error describing why none did otherwise, e.g. for the readiness endpoint of
+// a service embedding the client. An established connection is pinged if g
+// has one, as returned by Conn, so that probing readiness doesn't cost a TLS
+// handshake each time; otherwise a member is dialed as by Dial.
+func (g *Group) Ready(c *Client) error {
+	deadline := time.Now().Add(readyTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if conn, ok := g.Conn(); ok {
+		err := conn.validate(time.Until(deadline))
+		if err == nil {
+			conn.KeepAlive()
+			return nil
+		}
+		conn.discard(CloseReasonPingFailed)
+		c.logger().Debugf("readiness ping of %s failed: %v", conn.addr, err)
+	}
+
+	conn, err := g.DialContext(ctx, c)
+	if err != nil {
+		return fmt.Errorf("not ready: no remote could be dialed: %v", err)
+	}
+	if err := conn.validate(time.Until(deadline)); err != nil {
+		conn.discard(CloseReasonPingFailed)
+		return fmt.Errorf("not ready: ping of %s failed: %v", conn.addr, err)
+	}
+	conn.KeepAlive()
+	return nil
+}
+
+// IsHealthy reports whether any member of g is healthy: its last dial or
+// ping through g succeeded, its circuit breaker is closed, and the member
+// itself reports being healthy.
+func (g *Group) IsHealthy(c *Client) bool {
+	g.RLock()
+	members := append([]*Member(nil), g.remotes...)
+	healthy := make([]bool, len(members))
+	for i, m := range members {
+		healthy[i] = m.healthy()
+	}
+	g.RUnlock()
+
+	// nested remotes are asked without the lock, like they are dialed
+	for i, m := range members {
+		if healthy[i] && m.Remote.IsHealthy(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the members of g for debugging, best first as ranked by
+// LatencyPolicy regardless of the Policy of g: the address and server name
+// of each single server, its latency, or "unmeasured", its error count, and
+// its position in g, e.g. "[127.0.0.1:2407 (localhost) latency=1.2ms
+// errors=0 pos=0, ...]".
+func (g *Group) String() string {
+	g.RLock()
+	defer g.RUnlock()
+	ranked := append([]*Member(nil), g.remotes...)
+	sort.Stable(byLatency(ranked))
+
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, m := range ranked {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		switch r := m.Remote.(type) {
+		case *singleRemote:
+			fmt.Fprintf(&b, "%s (%s)", r.String(), r.ServerName)
+		case *Group:
+			b.WriteString(r.String())
+		default:
+			fmt.Fprintf(&b, "%T", r)
+		}
+		if m.latency.measured {
+			fmt.Fprintf(&b, " latency=%v", m.latency.val)
+		} else {
+			b.WriteString(" unmeasured")
+		}
+		fmt.Fprintf(&b, " errors=%d pos=%d", m.errorCount, m.pos)
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// sameRemote reports whether a and b denote the same remote, as described
+// for Identifier.
+func sameRemote(a, b Remote) bool {
+	if a == b {
+		return true
+	}
+	ia, ok := a.(Identifier)
+	ib, okb := b.(Identifier)
+	return ok && okb && ia.ID() == ib.ID()
+}
+
+// ID implements Identifier: Groups are the same if they were created with
+// the same members, regardless of their order. The identity of a Group is
+// fixed on creation, so that members added or removed since don't change it.
+// Groups created with a member which isn't an Identifier are only the same as
+// themselves.
+func (g *Group) ID() string {
+	if g.id == "" {
+		return fmt.Sprintf("group %p", g)
+	}
+	return g.id
+}
+
+// membersID returns the aggregate identity of the members of g, or the empty
+// string if one of them isn't an Identifier. g must be locked.
+func (g *Group) membersID() string {
+	ids := make([]string, 0, len(g.remotes))
+	for _, m := range g.remotes {
+		id, ok := m.Remote.(Identifier)
+		if !ok {
+			return ""
+		}
+		ids = append(ids, id.ID())
+	}
+	sort.Strings(ids)
+	return "group[" + strings.Join(ids, ", ") + "]"
+}
+
+// NewRoundRobinGroup creates a new group from a set of remotes which dials
+// them in turn, regardless of latency.
+func NewRoundRobinGroup(remotes []Remote) (*Group, error) {
+	g, err := NewGroup(remotes)
+	if err != nil {
+		return nil, err
+	}
+	g.SetPolicy(&RoundRobinPolicy{})
+	return g, nil
+}
+
+// SetPolicy sets the Policy by which g picks the members to dial. A nil
+// Policy restores the default, a LatencyPolicy using the Client's
+// LatencyAlpha.
+func (g *Group) SetPolicy(p Policy) {
+	g.Lock()
+	g.policy = p
+	g.policyCheck = new(sync.Once)
+	g.Unlock()
+}
+
+// policyFor returns the Policy of g, warning through the logger of c once if
+// the one set by SetPolicy is misconfigured. g must be locked.
+func (g *Group) policyFor(c *Client) Policy {
+	if g.policy == nil {
+		return c.latencyPolicy()
+	}
+	if g.policyCheck != nil {
+		g.policyCheck.Do(func() { checkAlpha(g.policy, c.logger()) })
+	}
+	return g.policy
+}
+
+// latencyPolicy returns the LatencyPolicy configured by c.LatencyAlpha and
+// c.LatencyResetAfter, warning through the logger of c on its first use if
+// LatencyAlpha is out of range.
+func (c *Client) latencyPolicy() LatencyPolicy {
+	p := LatencyPolicy{Alpha: c.LatencyAlpha, ResetAfter: c.LatencyResetAfter}
+	c.latencyAlphaOnce.Do(func() { checkAlpha(p, c.logger()) })
+	return p
+}
+
+// Dial returns a connection to a member picked by the Group's Policy, which
+// by default prefers the best latency measurement. If no member could be
+// dialed, the error of the last dial is returned, which is a *DialError for
+// single servers. Concurrent dials picking the same server share its pooled
+// connections, and wait for one being dialed rather than making another TLS
+// handshake once Client.MaxConnsPerRemote are open or being dialed: a burst
+// of dials to a cold Group thus makes up to MaxConnsPerRemote handshakes with
+// each server, not one per dial.
+func (g *Group) Dial(c *Client) (conn *Conn, err error) {
+	return g.DialContext(context.Background(), c)
+}
+
+// DialContext is like Dial, but gives up on the remaining candidates and
+// retries, returning ctx.Err(), once ctx is done.
+func (g *Group) DialContext(ctx context.Context, c *Client) (conn *Conn, err error) {
+	conn, _, err = g.dial(ctx, c, nil, false)
+	return conn, err
+}
+
+// DialRemote is like Dial, but also returns the member of g which was
+// dialed, e.g. to log which server handled a request, or to report the
+// outcome of an operation with Observe. If the member is itself a Group, the
+// member returned is that Group rather than the server dialed within it.
+func (g *Group) DialRemote(c *Client) (*Conn, Remote, error) {
+	return g.DialRemoteContext(context.Background(), c)
+}
+
+// DialRemoteContext is like DialRemote, with DialContext's handling of ctx.
+func (g *Group) DialRemoteContext(ctx context.Context, c *Client) (*Conn, Remote, error) {
+	conn, m, err := g.dial(ctx, c, nil, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, m.Remote, nil
+}
+
+// AcquireContext is like DialContext, but returns a connection which no other
+// caller is using, e.g. to bound the operations sent to a server at once
+// along with Client.MaxInflightPerConn. If the member picked already has
+// Client.MaxConnsPerRemote connections open, all of them in use,
+// AcquireContext waits for one to be returned with KeepAlive or closed, and
+// returns ctx.Err() once ctx is done. Members which can't hand out
+// connections exclusively, such as custom Remote implementations, are
+// dialed as by DialContext.
+func (g *Group) AcquireContext(ctx context.Context, c *Client) (*Conn, error) {
+	conn, _, err := g.dial(ctx, c, nil, true)
+	return conn, err
+}
+
+// DialForKey is like Dial, but consistently routes dials for the same key,
+// e.g. the SKI of a private key, to the same member, so that servers caching
+// state per key see a better hit rate. Members are ranked by rendezvous
+// hashing, so adding or removing one only remaps the keys routed to it. If
+// the first ranked member can't be dialed, the next ones are tried.
+func (g *Group) DialForKey(c *Client, key []byte) (*Conn, error) {
+	conn, _, err := g.dial(context.Background(), c, rendezvousPolicy{key: key}, false)
+	return conn, err
+}
+
+// dial implements DialContext, picking the members to dial with p, or with
+// the Group's Policy if p is nil.
+func (g *Group) dial(ctx context.Context, c *Client, p Policy, exclusive bool) (conn *Conn, m *Member, err error) {
+	ctx, span := c.tracer().Start(ctx, spanGroupDial)
+	defer func() { endSpan(span, err) }()
+
+	g.RLock()
+	empty := len(g.remotes) == 0
+	lone := c.SingleMemberFastPath && len(g.remotes) == 1
+	g.RUnlock()
+	if empty {
+		return nil, nil, ErrGroupEmpty
+	}
+
+	// the dial is aborted by Close
+	g.Lock()
+	closing := g.closingContext()
+	g.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := afterFunc(closing, cancel)
+	defer stop()
+	defer func() {
+		if err != nil && closing.Err() != nil {
+			conn, m, err = nil, nil, ErrClosed
+		}
+	}()
+
+	defer func() {
+		g.Lock()
+		defer g.Unlock()
+		if g.closed {
+			// the background goroutines stay stopped
+			return
+		}
+		if !lone && time.Since(g.lastPingAll) > 30*time.Minute {
+			g.lastPingAll = time.Now()
+			go g.PingAll(c, 0)
+		}
+		if c.MaxIdleTime > 0 && g.reapStop == nil {
+			g.startReaper(c.MaxIdleTime)
+		}
+	}()
+
+	var b *backoff.Backoff
+	for retry := 0; ; retry++ {
+		conn, m, err = g.dialOnce(ctx, c, p, exclusive, lone)
+		if err != nil && ctx.Err() == nil && g.reResolve(ctx, c) {
+			// the members changed, so g may no longer be lone
+			conn, m, err = g.dialOnce(ctx, c, p, exclusive, false)
+		}
+		if err == nil || retry >= c.DialRetries || ctx.Err() != nil || err == ErrAllBlacklisted || err == ErrAllDrained {
+			return conn, m, err
+		}
+
+		if b == nil {
+			b = backoff.New(maxDialBackoff, c.dialBackoff())
+		}
+		wait := b.Duration()
+		c.logger().Debugf("retrying group dial in %v: %v", wait, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// reResolve looks up the host g was looked up from again if
+// c.ReResolveOnFailure is set and no member of g is healthy, replacing the
+// members of g with the servers found. It reports whether the members
+// changed.
+func (g *Group) reResolve(ctx context.Context, c *Client) bool {
+	if !c.ReResolveOnFailure {
+		return false
+	}
+	g.RLock()
+	origin := g.origin
+	failing := true
+	for _, m := range g.remotes {
+		failing = failing && !m.healthy()
+	}
+	g.RUnlock()
+	if origin == nil || !failing {
+		return false
+	}
+
+	servers, err := c.lookupServers(ctx, origin.serverName, origin.host, origin.port)
+	if err != nil || len(servers) == 0 {
+		c.logger().Warningf("server lookup: failed to look up %s again: %v", origin.host, err)
+		return false
+	}
+	return g.replace(servers)
+}
+
+// replace makes remotes the members of g. Members matching one of remotes
+// are kept, along with their state, and the others are removed and closed.
+// It reports whether the members changed.
+func (g *Group) replace(remotes []Remote) bool {
+	g.Lock()
+	kept := make(map[*Member]bool)
+	var members []*Member
+	added := 0
+	for _, r := range remotes {
+		var member *Member
+		for _, m := range g.remotes {
+			if sameRemote(m.Remote, r) {
+				member = m
+				break
+			}
+		}
+		if member == nil {
+			member = &Member{Remote: r, pos: g.nextPos, weight: 1}
+			g.nextPos++
+			added++
+		} else if kept[member] {
+			continue
+		}
+		kept[member] = true
+		members = append(members, member)
+	}
+	var removed []*Member
+	for _, m := range g.remotes {
+		if !kept[m] {
+			removed = append(removed, m)
+		}
+	}
+	if added > 0 || len(removed) > 0 {
+		g.remotes = members
+	}
+	timeout := g.drainTimeout
+	g.Unlock()
+
+	for _, m := range removed {
+		if err := closeRemote(m.Remote, timeout); err != nil {
+			defaultLogger.Warningf("failed to close removed remote: %v", err)
+		}
+	}
+	return added > 0 || len(removed) > 0
+}
+
+// dialOnce makes a single pass over the members of g picked by p, or by the
+// Group's Policy if p is nil. If exclusive is set, connections are acquired
+// as by AcquireContext. If lone is set, g has a single member which is dialed
+// without consulting the Policy, see Client.SingleMemberFastPath.
+func (g *Group) dialOnce(ctx context.Context, c *Client, p Policy, exclusive, lone bool) (conn *Conn, m *Member, err error) {
+	g.Lock()
+	var candidates []*Member
+	blacklisted, drained := 0, 0
+	for _, m := range g.remotes {
+		// blacklisted servers are skipped without a dial, which would
+		// fail anyway
+		if single, ok := m.Remote.(*singleRemote); ok && c.Blacklist.Contains(single.Addr) {
+			blacklisted++
+			continue
+		}
+		if m.drained {
+			drained++
+			continue
+		}
+		if m.available(c) {
+			candidates = append(candidates, m)
+		}
+	}
+	all := len(g.remotes)
+	g.Unlock()
+
+	if blacklisted > 0 && blacklisted == all {
+		return nil, nil, ErrAllBlacklisted
+	}
+	if drained > 0 && blacklisted+drained == all {
+		return nil, nil, ErrAllDrained
+	}
+	if len(candidates) == 0 {
+		return nil, nil, ErrBreakerOpen
+	}
+	// servers over their rate limit are left out while others are not
+	if c.PerRemoteRate > 0 {
+		var allowed []*Member
+		for _, m := range candidates {
+			if single, ok := m.Remote.(*singleRemote); !ok || !c.rateLimited(single.String(), false) {
+				allowed = append(allowed, m)
+			}
+		}
+		if len(allowed) == 0 {
+			return nil, nil, ErrRateLimited
+		}
+		candidates = allowed
+	}
+
+	// members outside of the preferred zone are only tried once every
+	// member in it failed
+	if c.PreferredZone != "" {
+		var local, others []*Member
+		for _, m := range candidates {
+			if single, ok := m.Remote.(*singleRemote); ok && single.zone == c.PreferredZone {
+				local = append(local, m)
+			} else {
+				others = append(others, m)
+			}
+		}
+		if len(local) != 0 && len(others) != 0 {
+			conn, m, err = g.dialCandidates(ctx, c, p, local, exclusive, lone)
+			if err == nil || ctx.Err() != nil {
+				return conn, m, err
+			}
+			c.logger().Debugf("no server in zone %s could be dialed: %v", c.PreferredZone, err)
+			candidates = others
+		}
+	}
+	return g.dialCandidates(ctx, c, p, candidates, exclusive, lone)
+}
+
+// dialCandidates dials members among candidates picked by p, or by the
+// Group's Policy if p is nil, until one succeeds. It takes the same flags as
+// dialOnce.
+func (g *Group) dialCandidates(ctx context.Context, c *Client, p Policy, candidates []*Member, exclusive, lone bool) (conn *Conn, m *Member, err error) {
+	// n is the number of trials.
+	// Because of potential expensive fresh tls dial operation,
+	// we limit total dial candidates to a small number.
+	// Also it solves a subtle problem of test 'localhost'
+	// server discovery due to dual ipv6/ipv4 ip resolution.
+	n := 3
+	// policy returns the Policy picking the candidates; g must be locked.
+	policy := func() Policy {
+		if p == nil {
+			return g.policyFor(c)
+		}
+		return p
+	}
+	for i := 0; len(candidates) > 0; i++ {
+		if i == n {
+			// each tier of SRV priorities gets n trials of its own, so
+			// that failing members of one don't keep the next from being
+			// dialed
+			g.Lock()
+			candidates = nextSRVTiers(policy(), candidates, m)
+			g.Unlock()
+			if len(candidates) == 0 {
+				break
+			}
+			i = 0
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		var perr error
+		if lone {
+			m = candidates[0]
+		} else {
+			g.Lock()
+			m, perr = policy().Pick(candidates)
+			g.Unlock()
+		}
+		if perr != nil {
+			if err == nil {
+				err = perr
+			}
+			return nil, nil, err
+		}
+		candidates = removeMember(candidates, m)
+
+		if a, ok := m.Remote.(acquirer); ok && exclusive {
+			conn, err = a.AcquireContext(ctx, c)
+			if err != nil && ctx.Err() != nil {
+				// waiting for a connection says nothing about the
+				// health of m
+				return nil, nil, ctx.Err()
+			}
+		} else {
+			conn, err = m.DialContext(ctx, c)
+		}
+		if errors.Is(err, ErrRateLimited) {
+			// the limit was reached concurrently; it says nothing about
+			// the health of m
+			c.logger().Debugf("retry due to dial rate limit: %v", err)
+			continue
+		}
+		g.recordDial(c, m, err)
+		if err != nil {
+			c.logger().Debugf("retry due to dial failure: %v", err)
+		} else {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, m, nil
+}
+
+// Observe records the outcome of an operation on a connection to r, a member
+// of g, e.g. a signing request, so that routing reflects the answers to real
+// traffic rather than only health check pings. latency is how long the
+// operation took, and err why it failed, if it did. Successes and failures
+// feed the moving average of latencies, through the Policy of g, and the
+// circuit breaker of the member as pings do: a member which answers slowly
+// is demoted, and one which keeps failing is ejected until its breaker
+// closes again. Errors from the server about the request itself, such as an
+// unknown key, aren't failures of the member and should be reported with a
+// nil err. Remotes which aren't members of g are ignored.
+func (g *Group) Observe(c *Client, r Remote, latency time.Duration, err error) {
+	g.observe(c, func(m *Member) bool { return m.Remote == r }, latency, err)
+}
+
+// observeAddr is like Observe for the single server of g at addr, e.g. the
+// address of the connection an operation ran on.
+func (g *Group) observeAddr(c *Client, addr string, latency time.Duration, err error) {
+	g.observe(c, func(m *Member) bool {
+		single, ok := m.Remote.(*singleRemote)
+		return ok && single.String() == addr
+	}, latency, err)
+}
+
+// observe implements Observe for the first member of g which match accepts.
+func (g *Group) observe(c *Client, match func(*Member) bool, latency time.Duration, err error) {
+	g.Lock()
+	var observed *Member
+	for _, m := range g.remotes {
+		if match(m) {
+			observed = m
+			break
+		}
+	}
+	if observed == nil {
+		g.Unlock()
+		return
+	}
+	var changed bool
+	if err != nil {
+		changed = observed.recordFailure(c, err)
+	} else {
+		changed = observed.recordSuccess(c)
+		observed.recordLatency(c, latency)
+	}
+	g.policyFor(c).Observe(observed, latency, err)
+	observed.checkLatency(c)
+	g.Unlock()
+	if changed {
+		c.stateChanged(observed, err == nil)
+	}
+}
+
+// recordDial records the outcome of a dial of m, a member of g, which failed
+// with err unless it's nil.
+func (g *Group) recordDial(c *Client, m *Member, err error) {
+	var changed bool
+	g.Lock()
+	m.dials++
+	if err != nil {
+		m.dialFailures++
+		changed = m.recordFailure(c, err)
+	} else {
+		changed = m.recordSuccess(c)
+	}
+	g.Unlock()
+	if changed {
+		c.stateChanged(m, err == nil)
+	}
+}
+
+// removeMember returns a copy of members without m.
+func removeMember(members []*Member, m *Member) []*Member {
+	rest := make([]*Member, 0, len(members))
+	for _, other := range members {
+		if other != m {
+			rest = append(rest, other)
+		}
+	}
+	return rest
+}
+
+// DialAll dials every member of g concurrently, e.g. to broadcast an
+// operation to all servers, and returns the connections established, in no
+// particular order. Members whose circuit breaker is open, drained members,
+// and single servers on the client blacklist, are skipped. The errors of
+// failed dials are combined into the returned error, which is nil if all
+// dials succeeded. At most c.ProbeConcurrency members are dialed at once.
+func (g *Group) DialAll(c *Client) ([]*Conn, error) {
+	g.Lock()
+	var members []*Member
+	for _, m := range g.remotes {
+		if single, ok := m.Remote.(*singleRemote); ok && c.Blacklist.Contains(single.Addr) {
+			continue
+		}
+		if !m.drained && m.available(c) {
+			members = append(members, m)
+		}
+	}
+	g.Unlock()
+
+	type result struct {
+		m    *Member
+		conn *Conn
+		err  error
+	}
+	ch := make(chan result, len(members))
+	jobs := newJobQueue(c, 0)
+	for _, m := range members {
+		jobs.take(nil, nil)
+		go func(m *Member) {
+			defer jobs.release()
+			conn, err := m.Dial(c)
+			ch <- result{m: m, conn: conn, err: err}
+		}(m)
+	}
+
+	var conns []*Conn
+	var errs []error
+	for range members {
+		res := <-ch
+		if res.err != nil {
+			errs = append(errs, res.err)
+		} else {
+			conns = append(conns, res.conn)
+		}
+		if !errors.Is(res.err, ErrRateLimited) {
+			g.recordDial(c, res.m, res.err)
+		}
+	}
+	return conns, combineErrors(errs)
+}
+
+// Warmup dials and pings each member of g once, as PingAll does, so that the
+// first operations on g neither pay for TLS handshakes nor are routed before
+// any latency is measured. At most c.ProbeConcurrency members are dialed at
+// once, and members on the client blacklist aren't dialed.
+func (g *Group) Warmup(c *Client) {
+	g.PingAll(c, 0)
+}
+
+// Refresh measures the members of g as PingAll does, e.g. after a known
+// network event, and returns once the measurements are reported to the
+// Group's Policy. Unlike PingAll, it doesn't settle for a sweep already in
+// progress, which may predate the call, but waits for it to complete and
+// then starts another. At most c.ProbeConcurrency members are probed at once.
+func (g *Group) Refresh(c *Client) {
+	g.RLock()
+	sweep := g.sweep
+	g.RUnlock()
+	if sweep != nil {
+		<-sweep
+	}
+	g.PingAll(c, 0)
+}
+
+// PingAll loops through all remote servers for performance measurement
+// in a separate goroutine. The results are reported to the Group's Policy,
+// which allows it to asynchronously rank remotes by ping latencies. It also
+// serves as a service discovery tool. Remotes whose circuit breaker is open
+// are skipped. Concurrent calls are coalesced: a call made while a sweep is
+// in progress waits for that sweep instead of starting another. At most
+// concurrency remotes are probed at once; if concurrency isn't positive,
+// c.ProbeConcurrency is used instead.
+func (g *Group) PingAll(c *Client, concurrency int) {
+	g.sweepFor(c, concurrency, 0, nil)
+}
+
+// WarmupWithin is like Warmup, but returns once timeout elapsed even if some
+// members haven't answered yet, e.g. to bound the start of a service, such
+// that the first dials are routed by whatever measurements completed in
+// time. The members still being probed are measured once they answer.
+func (g *Group) WarmupWithin(c *Client, timeout time.Duration) {
+	g.sweepFor(c, 0, timeout, nil)
+}
+
+// A jobQueue bounds how many probes or dials of members run at once.
+type jobQueue chan struct{}
+
+// newJobQueue returns a jobQueue running up to concurrency jobs at once, or
+// c.ProbeConcurrency if concurrency isn't positive, and at least one.
+func newJobQueue(c *Client, concurrency int) jobQueue {
+	if concurrency <= 0 {
+		concurrency = c.ProbeConcurrency
+	}
 	if concurrency <= 0 {
 		concurrency = 1
 	}
-	// ch receives all tested remote back
-	ch := make(chan mRemote, len(remotes))
-	// jobQueue controls concurrency
-	jobQueue := make(chan bool, concurrency)
-	// fill the queue
-	for i := 0; i < cap(jobQueue); i++ {
-		jobQueue <- true
+	return make(jobQueue, concurrency)
+}
+
+// take waits for a job slot, which must be given back with release. It
+// returns false without one if closed is closed or expired fires first.
+func (q jobQueue) take(closed <-chan struct{}, expired <-chan time.Time) bool {
+	select {
+	case q <- struct{}{}:
+		return true
+	case <-closed:
+		return false
+	case <-expired:
+		return false
+	}
+}
+
+// release gives back a job slot acquired by take.
+func (q jobQueue) release() {
+	<-q
+}
+
+// A probeResult is the outcome of the probe of a member by a sweep.
+type probeResult struct {
+	m        *Member
+	duration time.Duration
+	err      error
+}
+
+// sweepFor implements PingAll, but if timeout is positive, it only waits
+// that long for the probes to complete. The sweep is then over, and the
+// results which were late are recorded as they come in. If due is set, only
+// the members it reports are probed. A sweep is abandoned by Close, without
+// recording its results, so that the background sweeps started by dials
+// don't outlive the group.
+func (g *Group) sweepFor(c *Client, concurrency int, timeout time.Duration, due func(*Member) bool) {
+	g.Lock()
+	if g.sweep != nil {
+		done := g.sweep
+		g.Unlock()
+		<-done
+		return
+	}
+	done := make(chan struct{})
+	g.sweep = done
+	closing := g.closingContext()
+	var members []*Member
+	for _, m := range g.remotes {
+		if (due == nil || due(m)) && m.available(c) {
+			members = append(members, m)
+		}
+	}
+	g.Unlock()
+
+	// ch receives all test results back
+	ch := make(chan probeResult, len(members))
+	jobs := newJobQueue(c, concurrency)
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
 	}
 
 	// each goroutine dials a remote
-	for _, r := range remotes {
-		// take a job slot from the queue
-		<-jobQueue
-		go func(r mRemote) {
-			// defer returns a job slot to the queue
-			defer func() { jobQueue <- true }()
-			cn, err := r.Dial(c)
+	launched := 0
+launch:
+	for _, m := range members {
+		if !jobs.take(closing.Done(), expired) {
+			break launch
+		}
+		if !c.probeSlot(closing.Done(), expired) {
+			jobs.release()
+			break launch
+		}
+		launched++
+		go func(m *Member) {
+			defer jobs.release()
+			cn, err := m.DialContext(closing, c)
 			if err != nil {
-				r.latency.Reset()
-				log.Infof("PingAll's dial failed: %v", err)
-				ch <- r
+				c.logger().Infof("PingAll's dial failed: %v", err)
+				ch <- probeResult{m: m, err: err}
 				return
 			}
 
 			start := time.Now()
-			err = cn.Conn.Ping(nil)
+			err = cn.ping(c)
 			duration := time.Since(start)
 
 			if err != nil {
-				defer cn.Close()
-				r.latency.Reset()
-				log.Infof("PingAll's ping failed: %v", err)
+				// the connection may be shared with callers of Dial,
+				// so it's only closed once they're done with it
+				defer cn.discard(CloseReasonPingFailed)
+				c.logger().Infof("PingAll's ping failed: %v", err)
+				c.metrics().PingFailure(cn.serverName, cn.addr)
 			} else {
-				r.latency.Update(duration)
+				c.metrics().Latency(cn.serverName, cn.addr, duration)
+				cn.KeepAlive()
 			}
-			ch <- r
-		}(r)
+			ch <- probeResult{m: m, duration: duration, err: err}
+		}(m)
 	}
 
-	for i := 0; i < len(remotes); i++ {
-		remotes[i] = <-ch
+	// wait for all results before locking, so that dials aren't blocked
+	var results []probeResult
+collect:
+	for len(results) < launched {
+		select {
+		case res := <-ch:
+			results = append(results, res)
+		case <-closing.Done():
+			break collect
+		case <-expired:
+			break collect
+		}
+	}
+	late := launched - len(results)
+	if closing.Err() != nil {
+		// the probes still in flight don't block, ch having room for
+		// all of them
+		g.Lock()
+		g.sweep = nil
+		close(done)
+		g.Unlock()
+		return
 	}
-
-	sort.Sort(mRemoteSorter(remotes))
 
 	g.Lock()
-	g.remotes = remotes
+	changed := g.recordProbes(c, results)
 	g.lastPingAll = time.Now()
+	g.sweep = nil
+	close(done)
+	g.Unlock()
+	for _, res := range changed {
+		c.stateChanged(res.m, res.err == nil)
+	}
+
+	if late > 0 {
+		go func() {
+			for ; late > 0; late-- {
+				res := <-ch
+				g.Lock()
+				changed := g.recordProbes(c, []probeResult{res})
+				g.Unlock()
+				for _, res := range changed {
+					c.stateChanged(res.m, res.err == nil)
+				}
+			}
+		}()
+	}
+}
+
+// recordProbes records the results of a sweep, returning those which changed
+// the health of their member. g must be locked.
+func (g *Group) recordProbes(c *Client, results []probeResult) []probeResult {
+	var changed []probeResult
+	policy := g.policyFor(c)
+	for _, res := range results {
+		if errors.Is(res.err, ErrRateLimited) {
+			continue
+		}
+		var flipped bool
+		if res.err != nil {
+			res.m.pingFailures++
+			flipped = res.m.recordFailure(c, res.err)
+		} else {
+			res.m.pings++
+			flipped = res.m.recordSuccess(c)
+			res.m.recordLatency(c, res.duration)
+		}
+		if flipped {
+			changed = append(changed, res)
+		}
+		policy.Observe(res.m, res.duration, res.err)
+		res.m.checkLatency(c)
+		g.scheduleProbe(c, res.m, res.err == nil)
+	}
+	return changed
+}
+
+// scheduleProbe sets when m is probed next by an adaptive health check, see
+// Client.HealthCheckMaxInterval, after a probe which succeeded if ok. g must
+// be locked.
+func (g *Group) scheduleProbe(c *Client, m *Member, ok bool) {
+	if c.HealthCheckMaxInterval <= 0 || g.hcInterval <= 0 {
+		return
+	}
+	switch {
+	case !ok:
+		m.probeInterval = g.hcMinInterval(c)
+	case m.probeInterval == 0:
+		m.probeInterval = g.hcInterval
+	default:
+		m.probeInterval *= 2
+	}
+	if m.probeInterval > c.HealthCheckMaxInterval {
+		m.probeInterval = c.HealthCheckMaxInterval
+	}
+	m.nextProbe = timeNow().Add(m.probeInterval)
+}
+
+// probeDue reports whether the adaptive health check of g is due to probe m.
+// g must be locked.
+func (g *Group) probeDue(m *Member) bool {
+	return !timeNow().Before(m.nextProbe)
+}
+
+// hcMinInterval returns the shortest interval between the probes of a member
+// by the health check of g. g must be locked.
+func (g *Group) hcMinInterval(c *Client) time.Duration {
+	if c.HealthCheckMinInterval > 0 && c.HealthCheckMinInterval < g.hcInterval {
+		return c.HealthCheckMinInterval
+	}
+	return g.hcInterval
+}
+
+// Close aborts the dials to g in progress, which fail with ErrClosed, stops
+// the health check and idle connection goroutines, if any, and closes the
+// connections of every remote in the group, draining them as set by
+// SetDrainTimeout. Errors from individual remotes are combined into the
+// returned error. Later dials reconnect as usual, but no longer start the
+// background PingAll and idle connection goroutines.
+func (g *Group) Close() error {
+	g.RLock()
+	timeout := g.drainTimeout
+	g.RUnlock()
+	return g.closeGracefully(timeout)
+}
+
+// closingContext returns the context canceled by Close. g must be locked.
+func (g *Group) closingContext() context.Context {
+	if g.closing == nil {
+		g.closing, g.cancelClosing = context.WithCancel(context.Background())
+	}
+	return g.closing
+}
+
+// closeGracefully is like Close, but drains the connections of every member
+// for up to timeout instead.
+func (g *Group) closeGracefully(timeout time.Duration) error {
+	g.Lock()
+	g.closed = true
+	if g.cancelClosing != nil {
+		g.cancelClosing()
+		g.closing, g.cancelClosing = nil, nil
+	}
 	g.Unlock()
+	g.StopHealthCheck()
+	g.stopReaper()
+
+	g.RLock()
+	remotes := make([]Remote, len(g.remotes))
+	for i, m := range g.remotes {
+		remotes[i] = m.Remote
+	}
+	g.RUnlock()
+
+	// the members are drained at once, so that timeout bounds Close
+	// regardless of their number
+	results := make([]error, len(remotes))
+	var wg sync.WaitGroup
+	for i, r := range remotes {
+		wg.Add(1)
+		go func(i int, r Remote) {
+			defer wg.Done()
+			results[i] = closeRemote(r, timeout)
+		}(i, r)
+	}
+	wg.Wait()
+	var errs []error
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+// An idleReaper is a Remote which can close its pooled connections which
+// haven't been used for maxIdle.
+type idleReaper interface {
+	reapIdle(maxIdle time.Duration)
+}
+
+// inFlight returns the number of callers using a connection to a member of
+// g.
+func (g *Group) inFlight() int {
+	g.RLock()
+	members := append([]*Member(nil), g.remotes...)
+	g.RUnlock()
+
+	var n int
+	for _, m := range members {
+		n += m.InFlight()
+	}
+	return n
+}
+
+// reapIdle closes the idle connections of every member of g.
+func (g *Group) reapIdle(maxIdle time.Duration) {
+	g.RLock()
+	remotes := make([]Remote, len(g.remotes))
+	for i, m := range g.remotes {
+		remotes[i] = m.Remote
+	}
+	g.RUnlock()
+
+	for _, r := range remotes {
+		if reaper, ok := r.(idleReaper); ok {
+			reaper.reapIdle(maxIdle)
+		}
+	}
+}
+
+// startReaper starts a goroutine which closes the connections of members
+// which haven't been used for maxIdle. g must be locked.
+func (g *Group) startReaper(maxIdle time.Duration) {
+	stop, done := make(chan struct{}), make(chan struct{})
+	g.reapStop, g.reapDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(maxIdle / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				g.reapIdle(maxIdle)
+			}
+		}
+	}()
 }
 
-// Len(), Less(i, j) and Swap(i,j) implements sort.Interface
+// stopReaper stops the goroutine started by startReaper, if any, and waits
+// for it to exit.
+func (g *Group) stopReaper() {
+	g.Lock()
+	stop, done := g.reapStop, g.reapDone
+	g.reapStop, g.reapDone = nil, nil
+	g.Unlock()
 
-// Len returns the number of remote
-func (s mRemoteSorter) Len() int {
-	return len(s)
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
 }
 
-// Swap swaps remote i and remote j in the list
-func (s mRemoteSorter) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
+// StartHealthCheck starts a goroutine which runs PingAll about every
+// interval, so that the ordering of the group stays current even when it is
+// rarely dialed. Each interval is randomized as configured by
+// c.HealthCheckJitter. If c.HealthCheckMaxInterval is set, members are
+// instead probed on adaptive schedules starting at interval. It does nothing
+// if a health check is already running.
+func (g *Group) StartHealthCheck(c *Client, interval time.Duration) {
+	g.Lock()
+	defer g.Unlock()
+	if g.hcStop != nil {
+		return
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	g.hcStop, g.hcDone = stop, done
+	g.hcInterval = interval
+	var due func(*Member) bool
+	if c.HealthCheckMaxInterval > 0 {
+		// members are checked for a due probe at the shortest interval
+		interval = g.hcMinInterval(c)
+		due = g.probeDue
+	}
+	go func() {
+		defer close(done)
+		jitter := c.healthCheckJitter()
+		tick := time.NewTimer(jittered(interval, jitter))
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+				// sweeps run one at a time; the next interval starts
+				// once a long sweep completes.
+				g.sweepFor(c, 0, 0, due)
+				tick.Reset(jittered(interval, jitter))
+			}
+		}
+	}()
 }
 
-// Less compares two Remotes at position i and j based on latency
-func (s mRemoteSorter) Less(i, j int) bool {
-	pi, pj := s[i].latency, s[j].latency
-	return pi.Better(pj)
+// StopHealthCheck stops the goroutine started by StartHealthCheck and waits
+// for it to exit, including any sweep it's in the middle of.
+func (g *Group) StopHealthCheck() {
+	g.Lock()
+	stop, done := g.hcStop, g.hcDone
+	g.hcStop, g.hcDone = nil, nil
+	g.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
 }
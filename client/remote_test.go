@@ -1,18 +1,37 @@
 package client
 
 import (
+	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/cloudflare/cfssl/helpers"
 	"github.com/cloudflare/cfssl/helpers/derhelpers"
+	"github.com/cloudflare/gokeyless/protocol"
 	"github.com/cloudflare/gokeyless/server"
 )
 
@@ -168,69 +187,3709 @@ func TestUnixRemote(t *testing.T) {
 	conn.Close()
 }
 
+func TestNewUnixServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokeyless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyless.socket")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	g, err := NewGroup([]Remote{NewUnixServer(path, "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	conn, err := g.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Conn.Ping(nil); err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+}
+
 func TestBadRemote(t *testing.T) {
 	// clear cached remotes and set a bad remote for the client
 	c.DefaultRemote = deadRemote
 
-	_, err := deadRemote.Dial(c)
-	if err == nil {
-		t.Fatal("dialing bad remote should fail.")
+	_, err := deadRemote.Dial(c)
+	if err == nil {
+		t.Fatal("dialing bad remote should fail.")
+	}
+}
+
+func TestSlowServer(t *testing.T) {
+	// Setup a slow keyless server
+	cfg := server.DefaultServeConfig().WithTCPTimeout(time.Second * 30)
+	s2, err := server.NewServerFromFile(cfg, serverCert, serverKey, keylessCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2.TLSConfig().Time = fixedCurrentTime
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := slowListener{l}
+
+	go func() {
+		if err := s2.Serve(&sl); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// wait for server to come up
+	time.Sleep(100 * time.Millisecond)
+
+	// clear cached remotes and set a remote group of normal and slow servers
+	host, p, _ := net.SplitHostPort(sAddr)
+	remote, err = c.LookupServerWithName("localhost", host, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s2host, s2port, _ := net.SplitHostPort(sl.Addr().String())
+	slowRemote, err := c.LookupServerWithName("localhost", s2host, s2port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("slow server is at %s:%s", s2host, s2port)
+
+	g, _ := NewGroup([]Remote{remote, slowRemote})
+	c.DefaultRemote = g
+	t.Log("c.DefaultRemote size:", len(c.DefaultRemote.(*Group).remotes))
+
+	// collect the garbage of starting the slow server now, since with few
+	// CPUs a collection during the pings would skew their latencies
+	runtime.GC()
+	g.PingAll(c, 1)
+
+	// After ping checks, 1st remote must be the normal server.
+	firstRemote := bestMember(g)
+	conn, err := firstRemote.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.addr != sAddr {
+		t.Fatal("bad 1st remote addr:", conn.addr)
+	}
+}
+
+func TestSlowServerRepeatedPings(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(&slowListener{l})
+	addr := newTestServer(t)
+
+	g, err := NewGroup([]Remote{NewServer(l.Addr(), "localhost"), NewServer(addr, "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	cl := newTestClient(t)
+	cl.LatencyAlpha = 0.5
+
+	// once the first, slow pings of the new connections are averaged out,
+	// the slow server must still rank behind the normal one
+	for i := 0; i < 5; i++ {
+		g.PingAll(cl, 1)
+	}
+	conn, err := bestMember(g).Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.KeepAlive()
+	if conn.addr != addr.String() {
+		t.Fatal("bad 1st remote addr:", conn.addr)
+	}
+}
+
+func TestEWMALatency(t *testing.T) {
+	var l ewmaLatency
+	if l.measured {
+		t.Fatal("zero value should be unmeasured")
+	}
+
+	l.Update(80*time.Millisecond, defaultLatencyAlpha)
+	if !l.measured || l.val != 80*time.Millisecond {
+		t.Fatalf("first measurement should seed the average, got %v", l.val)
+	}
+
+	// feeding a constant sample must converge to that sample
+	for i := 0; i < 20; i++ {
+		l.Update(10*time.Millisecond, defaultLatencyAlpha)
+	}
+	if diff := l.val - 10*time.Millisecond; diff < 0 || diff > time.Microsecond {
+		t.Fatalf("average did not converge to 10ms: %v", l.val)
+	}
+
+	// a smaller alpha gives a new sample less weight
+	l.Update(110*time.Millisecond, 0.1)
+	if diff := l.val - 20*time.Millisecond; diff < -time.Microsecond || diff > time.Microsecond {
+		t.Fatalf("expected 20ms with alpha 0.1, got %v", l.val)
+	}
+
+	var unmeasured ewmaLatency
+	if !l.Better(unmeasured) || unmeasured.Better(l) {
+		t.Fatal("measured latency should be better than unmeasured")
+	}
+
+	l.Reset()
+	if l.measured || l.val != 0 {
+		t.Fatal("Reset should clear the measurement")
+	}
+}
+
+func TestPingAllDemotesFailedRemote(t *testing.T) {
+	// put the dead remote first so that it must be ranked last after PingAll
+	g, err := NewGroup([]Remote{deadRemote, remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.PingAll(c, 2)
+
+	if bestMember(g).Remote != remote {
+		t.Fatal("working remote was not ranked first")
+	}
+	if !g.remotes[1].latency.measured {
+		t.Fatal("working remote has no latency measurement")
+	}
+	if g.remotes[0].latency.measured {
+		t.Fatal("failed remote should not have a latency measurement")
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	// a listener that accepts TCP connections but never completes a TLS
+	// handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	stuck := NewServer(l.Addr(), "localhost")
+	g, err := NewGroup([]Remote{stuck})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []Remote{stuck, g} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		_, err = r.DialContext(ctx, c)
+		cancel()
+		if err == nil {
+			t.Fatal("dial to a stuck server should fail")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("dial was not bounded by the context deadline: %v", elapsed)
+		}
+	}
+
+	// an already canceled context should abandon the group immediately
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = g.DialContext(ctx, c); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestConnPoolCap(t *testing.T) {
+	addr := newTestServer(t)
+	cl := newTestClient(t)
+	cl.MaxConnsPerRemote = 3
+	r := NewServer(addr, "localhost")
+
+	// hold on to every connection so that none of them is idle
+	var mtx sync.Mutex
+	var conns []*Conn
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := r.Dial(cl)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mtx.Lock()
+			conns = append(conns, conn)
+			mtx.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if n := connPool.Len(addr.String()); n != cl.MaxConnsPerRemote {
+		t.Fatalf("expected %d pooled connections, got %d", cl.MaxConnsPerRemote, n)
+	}
+	distinct := make(map[*Conn]bool)
+	for _, conn := range conns {
+		distinct[conn] = true
+	}
+	if len(distinct) > cl.MaxConnsPerRemote {
+		t.Fatalf("got %d distinct connections, cap is %d", len(distinct), cl.MaxConnsPerRemote)
+	}
+
+	// once returned, connections are idle and get reused
+	for _, conn := range conns {
+		conn.KeepAlive()
+	}
+	conn, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !distinct[conn] {
+		t.Fatal("dial did not reuse an idle pooled connection")
+	}
+	if err := conn.Ping(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := connPool.Len(addr.String()); n != cl.MaxConnsPerRemote {
+		t.Fatalf("expected %d pooled connections, got %d", cl.MaxConnsPerRemote, n)
+	}
+}
+
+func TestConnPoolDefaultSharesConn(t *testing.T) {
+	addr := newTestServer(t)
+	cl := newTestClient(t)
+	r := NewServer(addr, "localhost")
+
+	first, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("default pool should share a single connection")
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	g, err := NewGroup([]Remote{deadRemote, remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.StartHealthCheck(c, 20*time.Millisecond)
+	// starting twice must not spawn a second goroutine
+	g.StartHealthCheck(c, 20*time.Millisecond)
+	done := g.hcDone
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		best := bestMember(g)
+		g.RLock()
+		sorted := best.Remote == remote && best.latency.measured
+		g.RUnlock()
+		if sorted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("health check did not measure the group")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	g.StopHealthCheck()
+	select {
+	case <-done:
+	default:
+		t.Fatal("StopHealthCheck returned before the goroutine exited")
+	}
+	// stopping again is a no-op
+	g.StopHealthCheck()
+}
+
+func TestHealthCheckJitter(t *testing.T) {
+	interval := time.Second
+	for _, tc := range []struct {
+		jitter float64
+		want   float64
+	}{
+		{0, 0.2},
+		{0.3, 0.3},
+		{-1, 0},
+		{2, 0.99},
+	} {
+		cl := newTestClient(t)
+		cl.HealthCheckJitter = tc.jitter
+		jitter := cl.healthCheckJitter()
+		if jitter != tc.want {
+			t.Fatalf("jitter %v: expected %v, got %v", tc.jitter, tc.want, jitter)
+		}
+
+		lo := time.Duration(float64(interval) * (1 - jitter))
+		hi := time.Duration(float64(interval) * (1 + jitter))
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 100; i++ {
+			d := jittered(interval, jitter)
+			if d < lo || d > hi {
+				t.Fatalf("jitter %v: interval %v out of [%v, %v]", tc.jitter, d, lo, hi)
+			}
+			seen[d] = true
+		}
+		if jitter > 0 && len(seen) < 2 {
+			t.Fatalf("jitter %v: successive intervals didn't vary", tc.jitter)
+		}
+		if jitter == 0 && len(seen) != 1 {
+			t.Fatal("intervals varied with jitter disabled")
+		}
+	}
+}
+
+func TestAdaptiveHealthCheck(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	cl := newTestClient(t)
+	cl.HealthCheckMinInterval = 10 * time.Millisecond
+	cl.HealthCheckMaxInterval = 160 * time.Millisecond
+	var probes, failing int32
+	cl.ProbeOp = func(cn *Conn) error {
+		atomic.AddInt32(&probes, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.New("probe failed")
+		}
+		return cn.Ping(nil)
+	}
+
+	g, err := NewGroup([]Remote{NewServer(newTestServer(t), "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.Lock()
+	g.hcInterval = 20 * time.Millisecond
+	m := g.remotes[0]
+	g.Unlock()
+
+	// sweep runs the sweeps of the health check over d, as it would every
+	// HealthCheckMinInterval, returning the number of probes they made
+	sweep := func(d time.Duration) int {
+		before := atomic.LoadInt32(&probes)
+		for end := now.Add(d); now.Before(end); {
+			now = now.Add(cl.HealthCheckMinInterval)
+			g.sweepFor(cl, 0, 0, g.probeDue)
+		}
+		return int(atomic.LoadInt32(&probes) - before)
+	}
+
+	// a stable member is probed less and less often: 20ms after its first
+	// probe, then 40ms, 80ms and 160ms after the others
+	if n := sweep(800 * time.Millisecond); n != 8 {
+		t.Fatalf("expected probes of a stable member to back off, got %d in 800ms", n)
+	}
+	if m.probeInterval != cl.HealthCheckMaxInterval {
+		t.Fatalf("expected the probe interval to grow to 160ms, got %v", m.probeInterval)
+	}
+
+	// and watched closely once it fails, starting with its next due probe
+	// at 950ms
+	atomic.StoreInt32(&failing, 1)
+	if n := sweep(400 * time.Millisecond); n != 26 {
+		t.Fatalf("expected a failing member to be probed every 10ms, got %d probes in 400ms", n)
+	}
+	if m.probeInterval != cl.HealthCheckMinInterval {
+		t.Fatalf("expected the probe interval to drop after a failure, got %v", m.probeInterval)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cl := newTestClient(t)
+	cl.BreakerThreshold = 2
+	cl.BreakerCooldown = 100 * time.Millisecond
+
+	flaky := &flakyRemote{Remote: remote}
+	g, err := NewGroup([]Remote{flaky})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keep Dial from kicking off a background PingAll
+	g.lastPingAll = time.Now()
+
+	flaky.setFailing(true)
+	for i := 0; i < cl.BreakerThreshold; i++ {
+		if _, err := g.Dial(cl); err == nil {
+			t.Fatal("expected flaky remote to fail")
+		}
+	}
+	// the breaker is open, so the remote is ejected without being dialed
+	dials := flaky.Dials()
+	if _, err := g.Dial(cl); err == nil {
+		t.Fatal("expected dial to fail with an open breaker")
+	}
+	if flaky.Dials() != dials {
+		t.Fatal("remote dialed while its breaker was open")
+	}
+
+	// after the cooldown a failed trial re-opens the breaker
+	time.Sleep(cl.BreakerCooldown)
+	if _, err := g.Dial(cl); err == nil {
+		t.Fatal("expected trial dial to fail")
+	}
+	if flaky.Dials() != dials+1 {
+		t.Fatalf("expected a single trial dial, got %d", flaky.Dials()-dials)
+	}
+	dials = flaky.Dials()
+	g.Dial(cl)
+	if flaky.Dials() != dials {
+		t.Fatal("remote dialed after its trial failed")
+	}
+
+	// a successful trial closes the breaker again
+	flaky.setFailing(false)
+	time.Sleep(cl.BreakerCooldown)
+	for i := 0; i < 2; i++ {
+		conn, err := g.Dial(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.KeepAlive()
+	}
+	// each success halves the error count: 3, then 1, then 0
+	if g.remotes[0].errorCount != 0 {
+		t.Fatalf("expected no errors, got %d", g.remotes[0].errorCount)
+	}
+}
+
+func TestSingleMemberFastPath(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingListener{Listener: l}
+	go s.Serve(counting)
+	cl := newTestClient(t)
+	cl.SingleMemberFastPath = true
+	g, err := NewGroup([]Remote{NewServer(l.Addr(), "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	for i := 0; i < 5; i++ {
+		conn, err := g.Dial(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.KeepAlive()
+	}
+	// a background sweep would be started right after the first dial
+	time.Sleep(100 * time.Millisecond)
+	if n := counting.Accepted(); n != 1 {
+		t.Fatalf("expected the dials to reuse a single connection, got %d", n)
+	}
+	if st := g.Stats()[0]; st.Pings != 0 || st.PingFailures != 0 {
+		t.Fatalf("expected no probes, got %d", st.Pings+st.PingFailures)
+	}
+	if st := g.Stats()[0]; st.Dials != 5 {
+		t.Fatalf("expected 5 dials, got %d", st.Dials)
+	}
+
+	// a Group of several members still dials through its Policy when a
+	// single one is left to dial
+	drained := NewServer(newTestServer(t), "localhost")
+	g, err = NewGroup([]Remote{NewServer(newTestServer(t), "localhost"), drained})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+	policy := &recordingPolicy{}
+	g.SetPolicy(policy)
+	g.Drain(drained)
+	conn, err := g.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+	if policy.picks != 1 {
+		t.Fatalf("expected the Policy to pick the remaining member, got %d picks", policy.picks)
+	}
+}
+
+func TestDialRemote(t *testing.T) {
+	cl := newTestClient(t)
+	remotes := []Remote{NewServer(newTestServer(t), "localhost"), NewServer(newTestServer(t), "localhost")}
+	g, err := NewGroup(remotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	for i := 0; i < 10; i++ {
+		conn, r, err := g.DialRemote(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != remotes[0] && r != remotes[1] {
+			t.Fatalf("expected a member of the group, got %v", r)
+		}
+		if want := r.(*singleRemote).String(); conn.addr != want {
+			t.Fatalf("expected a connection to %s, got one to %s", want, conn.addr)
+		}
+		conn.KeepAlive()
+	}
+
+	for _, r := range remotes {
+		g.Remove(r)
+	}
+	if conn, r, err := g.DialRemote(cl); err != ErrGroupEmpty || conn != nil || r != nil {
+		t.Fatalf("expected ErrGroupEmpty and no remote, got %v, %v, %v", conn, r, err)
+	}
+}
+
+func TestErrorClasses(t *testing.T) {
+	addr := newTestServer(t)
+	cl := newTestClient(t)
+	probeErr := error(protocol.ErrKeyNotFound)
+	cl.ProbeOp = func(cn *Conn) error { return probeErr }
+	g, err := NewGroup([]Remote{NewServer(addr, "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	g.Refresh(cl)
+	if st := g.Stats()[0]; st.ProtocolErrors != 1 || st.TransportErrors != 0 {
+		t.Fatalf("expected a protocol error, got %d protocol and %d transport errors", st.ProtocolErrors, st.TransportErrors)
+	}
+	probeErr = fmt.Errorf("probe timed out after %v", time.Second)
+	g.Refresh(cl)
+	if st := g.Stats()[0]; st.ProtocolErrors != 1 || st.TransportErrors != 1 {
+		t.Fatalf("expected a transport error, got %d protocol and %d transport errors", st.ProtocolErrors, st.TransportErrors)
+	}
+
+	// transport failures open the breaker sooner than protocol ones
+	cl.BreakerThreshold = 1
+	cl.ProtocolBreakerThreshold = 2
+	m := &Member{}
+	m.recordFailure(cl, protocol.ErrInternal)
+	if !m.openedAt.IsZero() {
+		t.Fatal("breaker opened after a single protocol error")
+	}
+	m.recordFailure(cl, protocol.ErrInternal)
+	if m.openedAt.IsZero() {
+		t.Fatal("expected the breaker to open after 2 protocol errors")
+	}
+	m.recordSuccess(cl)
+	m.recordFailure(cl, errors.New("connection refused"))
+	if m.openedAt.IsZero() {
+		t.Fatal("expected the breaker to open after a transport error")
+	}
+}
+
+func TestErrorCountDecay(t *testing.T) {
+	m := &Member{}
+	for i := 0; i < 8; i++ {
+		m.recordFailure(c, errors.New("failure"))
+	}
+	if m.ErrorCount() != 8 {
+		t.Fatalf("expected 8 errors, got %d", m.ErrorCount())
+	}
+	for _, want := range []int{4, 2, 1, 0, 0} {
+		m.recordSuccess(c)
+		if m.ErrorCount() != want {
+			t.Fatalf("expected %d errors after a success, got %d", want, m.ErrorCount())
+		}
+	}
+}
+
+func TestGroupClose(t *testing.T) {
+	addr := newTestServer(t)
+	cl := newTestClient(t)
+	g, err := NewGroup([]Remote{NewServer(addr, "localhost"), deadRemote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.StartHealthCheck(cl, time.Hour)
+
+	conn, err := g.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := connPool.Len(addr.String()); n != 0 {
+		t.Fatalf("expected no pooled connections after Close, got %d", n)
+	}
+	if err := conn.Conn.Ping(nil); err == nil {
+		t.Fatal("connection still usable after Close")
+	}
+	if g.hcStop != nil {
+		t.Fatal("Close did not stop the health check")
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal("second Close failed:", err)
+	}
+
+	// Close may race with Dial
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if conn, err := g.Dial(cl); err == nil {
+				conn.KeepAlive()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			g.Close()
+		}()
+	}
+	wg.Wait()
+	g.Close()
+}
+
+func TestMetrics(t *testing.T) {
+	addr := newTestServer(t)
+	cl := newTestClient(t)
+	m := &countingMetrics{}
+	cl.Metrics = m
+	blacklisted := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 65433}
+	cl.Blacklist.Add(blacklisted, blacklisted.Port)
+
+	g, err := NewGroup([]Remote{NewServer(addr, "localhost"), NewServer(blacklisted, "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.PingAll(cl, 2)
+
+	m.Lock()
+	defer m.Unlock()
+	if m.dials != 1 || m.dialFailures != 0 {
+		t.Fatalf("expected a single successful dial, got %d dials and %d failures", m.dials, m.dialFailures)
+	}
+	if m.latencies != 1 || m.pingFailures != 0 {
+		t.Fatalf("expected a single latency sample, got %d samples and %d ping failures", m.latencies, m.pingFailures)
+	}
+	if m.rejections != 1 {
+		t.Fatalf("expected a blacklist rejection, got %d", m.rejections)
+	}
+}
+
+func TestConnReuse(t *testing.T) {
+	cl := newTestClient(t)
+	m := &countingMetrics{}
+	cl.Metrics = m
+	g, err := NewGroup([]Remote{NewServer(newTestServer(t), "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+
+	for i := 1; i <= 5; i++ {
+		conn, err := g.Dial(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.KeepAlive()
+		if st := g.Stats()[0]; st.Opened != 1 || st.Reused != i-1 {
+			t.Fatalf("expected 1 connection opened and %d reused after %d dials, got %d and %d", i-1, i, st.Opened, st.Reused)
+		}
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.dials != 1 || m.reuses != 4 {
+		t.Fatalf("expected 1 dial and 4 reuses reported, got %d and %d", m.dials, m.reuses)
+	}
+}
+
+func TestTLSConfigFor(t *testing.T) {
+	cl := newTestClient(t)
+	getClientCertificate := func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return nil, nil }
+	verifyPeerCertificate := func([][]byte, [][]*x509.Certificate) error { return nil }
+	verifyConnection := func(tls.ConnectionState) error { return nil }
+	cl.Config.GetClientCertificate = getClientCertificate
+	cl.Config.VerifyPeerCertificate = verifyPeerCertificate
+	cl.Config.VerifyConnection = verifyConnection
+	cl.Config.Renegotiation = tls.RenegotiateOnceAsClient
+	cl.Config.KeyLogWriter = ioutil.Discard
+	cl.Config.DynamicRecordSizingDisabled = true
+	cl.Config.Rand = rand.Reader
+	cl.Config.ServerName = "default.example"
+
+	config := cl.tlsConfigFor("keyless.example")
+	if config.ServerName != "keyless.example" || cl.Config.ServerName != "default.example" {
+		t.Fatalf("ServerName not overridden on a copy: %q, %q", config.ServerName, cl.Config.ServerName)
+	}
+	funcs := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"GetClientCertificate", config.GetClientCertificate, getClientCertificate},
+		{"VerifyPeerCertificate", config.VerifyPeerCertificate, verifyPeerCertificate},
+		{"VerifyConnection", config.VerifyConnection, verifyConnection},
+		{"Time", config.Time, cl.Config.Time},
+	}
+	for _, f := range funcs {
+		if reflect.ValueOf(f.got).Pointer() != reflect.ValueOf(f.want).Pointer() {
+			t.Errorf("%s not copied", f.name)
+		}
+	}
+	if config.Renegotiation != tls.RenegotiateOnceAsClient || config.KeyLogWriter != ioutil.Discard ||
+		!config.DynamicRecordSizingDisabled || config.Rand != rand.Reader {
+		t.Error("config fields not copied")
+	}
+}
+
+func TestDialVerifyPeerCertificate(t *testing.T) {
+	addr := newTestServer(t)
+	cl := newTestClient(t)
+	var calls int32
+	cl.Config.VerifyPeerCertificate = func([][]byte, [][]*x509.Certificate) error {
+		atomic.AddInt32(&calls, 1)
+		return errors.New("pin mismatch")
+	}
+
+	if _, err := NewServer(addr, "localhost").Dial(cl); err == nil {
+		t.Fatal("expected dial to fail certificate pinning")
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatal("VerifyPeerCertificate was not called")
+	}
+}
+
+func TestVerifyServer(t *testing.T) {
+	addr := newTestServer(t)
+	cl := newTestClient(t)
+	var verified Remote
+	cl.VerifyServer = func(cs tls.ConnectionState, r Remote) error {
+		verified = r
+		if len(cs.PeerCertificates) == 0 {
+			t.Error("expected the server certificate in the connection state")
+		}
+		return errors.New("unexpected public key")
+	}
+	r := NewServer(addr, "localhost")
+	_, err := r.Dial(cl)
+	var verr *VerificationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a VerificationError, got %v", err)
+	}
+	if verified != r {
+		t.Fatal("expected VerifyServer to be called with the dialed remote")
+	}
+	if n := connPool.Len(addr.String()); n != 0 {
+		t.Fatalf("expected no pooled connection after a rejected dial, got %d", n)
+	}
+
+	cl.VerifyServer = func(tls.ConnectionState, Remote) error { return nil }
+	conn, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestMaxConcurrentDials(t *testing.T) {
+	cl := newTestClient(t)
+	cl.MaxConcurrentDials = 2
+	var inProgress, peak int32
+	cl.VerifyServer = func(tls.ConnectionState, Remote) error {
+		n := atomic.AddInt32(&inProgress, 1)
+		defer atomic.AddInt32(&inProgress, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+
+	var remotes []Remote
+	for i := 0; i < 8; i++ {
+		remotes = append(remotes, NewServer(newTestServer(t), "localhost"))
+	}
+	var wg sync.WaitGroup
+	for _, r := range remotes {
+		wg.Add(1)
+		go func(r Remote) {
+			defer wg.Done()
+			conn, err := r.Dial(cl)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+		}(r)
+	}
+	wg.Wait()
+	if p := atomic.LoadInt32(&peak); p != int32(cl.MaxConcurrentDials) {
+		t.Fatalf("expected at most %d dials at once, got %d", cl.MaxConcurrentDials, p)
+	}
+
+	// a dial waiting for a slot gives up with its context
+	cl.dialSlots <- struct{}{}
+	cl.dialSlots <- struct{}{}
+	defer func() { <-cl.dialSlots; <-cl.dialSlots }()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := NewServer(newTestServer(t), "localhost").DialContext(ctx, cl); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the dial to time out waiting for a slot, got %v", err)
+	}
+}
+
+func TestConcurrentDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: l}
+	go s.Serve(cl)
+	r := NewServer(l.Addr(), "localhost")
+
+	const dials = 50
+	conns := make(chan *Conn, dials)
+	var wg sync.WaitGroup
+	for i := 0; i < dials; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := r.Dial(c)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conns <- conn
+		}()
+	}
+	wg.Wait()
+	close(conns)
+
+	var first *Conn
+	for conn := range conns {
+		if first == nil {
+			first = conn
+		}
+		if conn != first {
+			t.Fatal("concurrent dials did not share the connection")
+		}
+		conn.KeepAlive()
+	}
+	if n := cl.Accepted(); n != 1 {
+		t.Fatalf("expected a single handshake, got %d", n)
+	}
+	if n := connPool.Len(l.Addr().String()); n != 1 {
+		t.Fatalf("expected a single pooled connection, got %d", n)
+	}
+
+	// a connection closed while checked out is not put back by KeepAlive
+	conn, err := r.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	conn.KeepAlive()
+	if n := connPool.Len(l.Addr().String()); n != 0 {
+		t.Fatal("closed connection returned to the pool")
+	}
+}
+
+func TestConcurrentGroupDial(t *testing.T) {
+	var remotes []Remote
+	for i := 0; i < 4; i++ {
+		remotes = append(remotes, &flakyRemote{
+			Remote: NewServer(newTestServer(t), "localhost"),
+			delay:  200 * time.Millisecond,
+		})
+	}
+	g, err := NewGroup(remotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+
+	// dials don't hold the group lock, so they overlap instead of taking
+	// 16 times the dial delay
+	const dials = 16
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < dials; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := g.Dial(c)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.KeepAlive()
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > dials*200*time.Millisecond/4 {
+		t.Fatalf("%d concurrent dials took %v, as if serialized", dials, elapsed)
+	}
+}
+
+func TestConcurrentAddDial(t *testing.T) {
+	// the members share a server of their own, as removing one closes
+	// its connections
+	server := NewServer(newTestServer(t), "localhost")
+	g, err := NewGroup([]Remote{&flakyRemote{Remote: server}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+	g.Add(g)
+
+	const adders, adds = 4, 16
+	var wg sync.WaitGroup
+	added := make([][]Remote, adders)
+	for i := 0; i < adders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < adds; j++ {
+				r := &flakyRemote{Remote: server}
+				g.Add(r)
+				g.Add(r)
+				// remove every other member again
+				if j%2 == 1 {
+					g.Remove(r)
+				} else {
+					added[i] = append(added[i], r)
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < adds; j++ {
+				conn, err := g.Dial(c)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.KeepAlive()
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := g.Remotes()
+	if want := 1 + adders*adds/2; len(stats) != want {
+		t.Fatalf("expected %d members, got %d", want, len(stats))
+	}
+	seen := make(map[Remote]bool)
+	for _, st := range stats {
+		if st.Remote == Remote(g) {
+			t.Fatal("expected the group not to be a member of itself")
+		}
+		if seen[st.Remote] {
+			t.Fatalf("expected distinct members, got %v twice", st.Remote)
+		}
+		seen[st.Remote] = true
+	}
+	for _, rs := range added {
+		for _, r := range rs {
+			if !seen[r] {
+				t.Fatalf("expected %v to be a member", r)
+			}
+		}
+	}
+}
+
+func TestAcquireContext(t *testing.T) {
+	cl := newTestClient(t)
+	cl.MaxConnsPerRemote = 1
+	g, err := NewGroup([]Remote{NewServer(newTestServer(t), "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+
+	held, err := g.AcquireContext(context.Background(), cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a dial still shares the connection in use
+	shared, err := g.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared != held {
+		t.Fatal("expected a dial to share the saturated pool's connection")
+	}
+	shared.KeepAlive()
+
+	// none is returned in time
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := g.AcquireContext(ctx, cl); err != context.DeadlineExceeded {
+		t.Fatalf("expected the acquire to time out, got %v", err)
+	}
+	if st := g.Stats()[0]; !st.Healthy || st.DialFailures != 0 {
+		t.Fatalf("waiting for a connection counted against the server: %+v", st)
+	}
+
+	// the connection is handed over once returned
+	acquired := make(chan *Conn, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := g.AcquireContext(ctx, cl)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- conn
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected the acquire to wait for the connection in use")
+	case <-time.After(100 * time.Millisecond):
+	}
+	held.KeepAlive()
+	select {
+	case conn := <-acquired:
+		if conn != held {
+			t.Fatal("expected the returned connection to be acquired")
+		}
+		conn.KeepAlive()
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire did not complete once the connection was returned")
+	}
+	if n := connPool.Len(held.addr); n != 1 {
+		t.Fatalf("expected a single pooled connection, got %d", n)
+	}
+}
+
+func TestAcquireFIFO(t *testing.T) {
+	const key = "acquire fifo"
+	defer connPool.RemoveAll(key)
+	if cn, _, err := connPool.Checkout(context.Background(), key, 1); cn != nil || err != nil {
+		t.Fatalf("expected a dial slot, got %v, %v", cn, err)
+	}
+	held := &Conn{logger: defaultLogger}
+	connPool.Fill(key, held)
+
+	const waiters = 20
+	order := make(chan int, waiters)
+	for i := 0; i < waiters; i++ {
+		go func(i int) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			cn, _, err := connPool.Acquire(ctx, key, 1)
+			if err != nil {
+				t.Error(err)
+				order <- -1
+				return
+			}
+			order <- i
+			connPool.Release(key, cn)
+		}(i)
+		// the next waiter arrives once this one is queued
+		for queued := 0; queued <= i; {
+			connPool.Lock()
+			queued = len(connPool.set(key).acquirers)
+			connPool.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	connPool.Release(key, held)
+	for want := 0; want < waiters; want++ {
+		select {
+		case got := <-order:
+			if got != want {
+				t.Fatalf("expected waiter %d to be served next, got %d", want, got)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("waiter %d wasn't served", want)
+		}
+	}
+}
+
+func TestConcurrentColdGroupDialHandshakes(t *testing.T) {
+	for _, maxConns := range []int{1, 4} {
+		var listeners []*countingListener
+		var remotes []Remote
+		for i := 0; i < 3; i++ {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cl := &countingListener{Listener: l}
+			go s.Serve(cl)
+			listeners = append(listeners, cl)
+			remotes = append(remotes, NewServer(l.Addr(), "localhost"))
+		}
+		g, err := NewGroup(remotes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer g.Close()
+		g.lastPingAll = time.Now()
+		cl := newTestClient(t)
+		cl.MaxConnsPerRemote = maxConns
+
+		// the first dials to each server make no more handshakes than
+		// the connections it may have
+		const dials = 60
+		var wg sync.WaitGroup
+		for i := 0; i < dials; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := g.Dial(cl)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.KeepAlive()
+			}()
+		}
+		wg.Wait()
+		for _, l := range listeners {
+			if n := l.Accepted(); n > maxConns {
+				t.Fatalf("expected at most %d handshakes with %s, got %d", maxConns, l.Addr(), n)
+			}
+		}
+	}
+}
+
+func TestDialRetries(t *testing.T) {
+	cl := newTestClient(t)
+	cl.DialBackoff = 10 * time.Millisecond
+
+	// both remotes are unreachable during the first sweep
+	flaky1 := &flakyRemote{Remote: remote, failNext: 1}
+	flaky2 := &flakyRemote{Remote: remote, failNext: 1}
+	g, err := NewGroup([]Remote{flaky1, flaky2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.lastPingAll = time.Now()
+
+	if _, err := g.Dial(cl); err == nil {
+		t.Fatal("expected dial without retries to fail")
+	}
+	flaky1.failNext, flaky2.failNext = 1, 1
+
+	cl.DialRetries = 3
+	conn, err := g.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+	if n := flaky1.Dials() + flaky2.Dials(); n != 5 {
+		t.Fatalf("expected a failed sweep and a successful dial, got %d dials", n)
+	}
+
+	// retries stop at the context deadline
+	flaky1.setFailing(true)
+	flaky2.setFailing(true)
+	cl.DialRetries = 1000
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := g.DialContext(ctx, cl); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("retries exceeded the deadline by %v", elapsed)
+	}
+}
+
+func TestMaxConnLifetime(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	addr := newTestServer(t)
+	cl := newTestClient(t)
+	cl.MaxConnLifetime = time.Minute
+	r := NewServer(addr, "localhost")
+	defer r.Close()
+
+	old, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.KeepAlive()
+	now = now.Add(30 * time.Second)
+	if again, err := r.Dial(cl); err != nil || again != old {
+		t.Fatal("connection was not reused within its lifetime:", err)
+	}
+
+	// the expired connection is replaced, but stays open while in use
+	now = now.Add(time.Minute)
+	fresh, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh == old {
+		t.Fatal("expired connection was reused")
+	}
+	select {
+	case <-old.closed:
+		t.Fatal("expired connection was closed while in use")
+	default:
+	}
+	if err := fresh.Conn.Ping(nil); err != nil {
+		t.Fatal(err)
+	}
+	fresh.KeepAlive()
+
+	old.KeepAlive()
+	select {
+	case <-old.closed:
+	case <-time.After(time.Second):
+		t.Fatal("expired connection was not closed once released")
+	}
+	if n := connPool.Len(addr.String()); n != 1 {
+		t.Fatalf("expected 1 pooled connection, got %d", n)
+	}
+}
+
+func TestOnConnClose(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	type event struct {
+		remote Remote
+		conn   *Conn
+		reason string
+	}
+	events := make(chan event, 10)
+	cl := newTestClient(t)
+	cl.MaxConnLifetime = time.Minute
+	cl.OnConnClose = func(remote Remote, conn *Conn, reason string) {
+		events <- event{remote, conn, reason}
+	}
+	r := NewServer(newTestServer(t), "localhost")
+	next := func() event {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("expected OnConnClose to be called")
+			return event{}
+		}
+	}
+
+	old, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.KeepAlive()
+	// the expired connection is rotated on the next dial
+	now = now.Add(2 * time.Minute)
+	fresh, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh == old {
+		t.Fatal("expired connection was reused")
+	}
+	fresh.KeepAlive()
+	if ev := next(); ev.remote != r || ev.conn != old || ev.reason != CloseReasonLifetime {
+		t.Fatalf("expected the old connection to be closed for %q, got %q", CloseReasonLifetime, ev.reason)
+	}
+
+	r.Close()
+	if ev := next(); ev.conn != fresh || ev.reason != CloseReasonShutdown {
+		t.Fatalf("expected the fresh connection to be closed for %q, got %q", CloseReasonShutdown, ev.reason)
+	}
+	// closing again doesn't report it again
+	fresh.Close()
+	select {
+	case ev := <-events:
+		t.Fatalf("expected a single call per connection, got another for %q", ev.reason)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMaxIdleTime(t *testing.T) {
+	addr := newTestServer(t)
+	cl := newTestClient(t)
+	cl.MaxIdleTime = 100 * time.Millisecond
+	g, err := NewGroup([]Remote{NewServer(addr, "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.lastPingAll = time.Now()
+
+	idle, err := g.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle.KeepAlive()
+
+	select {
+	case <-idle.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+	if n := connPool.Len(addr.String()); n != 0 {
+		t.Fatalf("expected the idle connection to leave the pool, got %d connections", n)
+	}
+
+	again, err := g.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == idle {
+		t.Fatal("closed idle connection was reused")
+	}
+	if err := again.Conn.Ping(nil); err != nil {
+		t.Fatal(err)
+	}
+	again.KeepAlive()
+
+	g.Close()
+	if g.reapStop != nil {
+		t.Fatal("Close did not stop the idle connection goroutine")
+	}
+
+	// nor is it restarted by a dial to the closed group
+	conn, err := g.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+	g.RLock()
+	restarted := g.reapStop != nil
+	g.RUnlock()
+	if restarted {
+		t.Fatal("dial restarted the idle connection goroutine of a closed group")
+	}
+}
+
+func TestDialAll(t *testing.T) {
+	live := []Remote{NewServer(newTestServer(t), "localhost"), NewServer(newTestServer(t), "localhost")}
+	failing := &flakyRemote{Remote: remote, failing: 1}
+	blacklisted := newTestServer(t)
+	cl := newTestClient(t)
+	cl.ProbeConcurrency = 2
+	cl.Blacklist = &AddrSet{}
+	cl.Blacklist.Add(blacklisted, blacklisted.(*net.TCPAddr).Port)
+
+	g, err := NewGroup(append(live, failing, NewServer(blacklisted, "localhost")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	conns, err := g.DialAll(cl)
+	if err == nil {
+		t.Fatal("expected the failing member to be reported")
+	}
+	if len(conns) != len(live) {
+		t.Fatalf("expected %d connections, got %d", len(live), len(conns))
+	}
+	addrs := make(map[string]bool)
+	for _, conn := range conns {
+		addrs[conn.addr] = true
+		if err := conn.Ping(nil); err != nil {
+			t.Fatal(err)
+		}
+		conn.KeepAlive()
+	}
+	for _, r := range live {
+		if !addrs[r.(*singleRemote).String()] {
+			t.Fatalf("no connection to %v", r)
+		}
+	}
+	if failing.Dials() != 1 {
+		t.Fatalf("expected a single dial of the failing member, got %d", failing.Dials())
+	}
+	if n := connPool.Len(blacklisted.String()); n != 0 {
+		t.Fatal("DialAll dialed a blacklisted server")
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	addrs := []net.Addr{newTestServer(t), newTestServer(t), newTestServer(t)}
+	blacklisted := newTestServer(t)
+	cl := newTestClient(t)
+	cl.ProbeConcurrency = 2
+	cl.Blacklist = &AddrSet{}
+	cl.Blacklist.Add(blacklisted, blacklisted.(*net.TCPAddr).Port)
+
+	var remotes []Remote
+	for _, addr := range append(addrs, blacklisted) {
+		remotes = append(remotes, NewServer(addr, "localhost"))
+	}
+	g, err := NewGroup(remotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	g.Warmup(cl)
+	for _, m := range g.remotes[:len(addrs)] {
+		if !m.latency.measured {
+			t.Fatalf("latency of %v not measured by Warmup", m.Remote)
+		}
+	}
+	for _, addr := range addrs {
+		if n := connPool.Len(addr.String()); n != 1 {
+			t.Fatalf("expected a connection to %v after Warmup, got %d", addr, n)
+		}
+	}
+	if n := connPool.Len(blacklisted.String()); n != 0 {
+		t.Fatal("Warmup dialed a blacklisted server")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	fast, mid, slow := newTestServer(t), newTestServer(t), newTestServer(t)
+	delays := map[string]time.Duration{
+		fast.String(): 0,
+		mid.String():  100 * time.Millisecond,
+		slow.String(): 200 * time.Millisecond,
+	}
+	cl := newTestClient(t)
+	cl.ProbeOp = func(cn *Conn) error {
+		time.Sleep(delays[cn.addr])
+		return cn.Ping(nil)
+	}
+	g, err := NewGroup([]Remote{NewServer(slow, "localhost"), NewServer(fast, "localhost"), NewServer(mid, "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	g.Refresh(cl)
+	g.RLock()
+	ranked := append([]*Member(nil), g.remotes...)
+	g.RUnlock()
+	sort.Stable(byLatency(ranked))
+	var order []string
+	for _, m := range ranked {
+		order = append(order, m.Remote.(*singleRemote).String())
+	}
+	if want := []string{fast.String(), mid.String(), slow.String()}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("expected members ranked %v after Refresh, got %v", want, order)
+	}
+	for _, st := range g.Stats() {
+		if st.Pings != 1 {
+			t.Fatalf("expected a single ping of %s, got %d", st.Addr, st.Pings)
+		}
+	}
+
+	// a sweep in progress doesn't count, since it may predate the call
+	delays[fast.String()] = 100 * time.Millisecond
+	go g.PingAll(cl, 0)
+	for {
+		g.RLock()
+		started := g.sweep != nil
+		g.RUnlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	g.Refresh(cl)
+	for _, st := range g.Stats() {
+		if st.Pings != 3 {
+			t.Fatalf("expected Refresh to start a sweep of its own, got %d pings of %s", st.Pings, st.Addr)
+		}
+	}
+}
+
+func TestWarmupWithin(t *testing.T) {
+	fast, mid, slow := newTestServer(t), newTestServer(t), newTestServer(t)
+	delays := map[string]time.Duration{
+		fast.String(): 0,
+		mid.String():  50 * time.Millisecond,
+		slow.String(): 2 * time.Second,
+	}
+	cl := newTestClient(t)
+	cl.ProbeConcurrency = 3
+	cl.ProbeOp = func(cn *Conn) error {
+		time.Sleep(delays[cn.addr])
+		return cn.Ping(nil)
+	}
+	g, err := NewGroup([]Remote{NewServer(slow, "localhost"), NewServer(mid, "localhost"), NewServer(fast, "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	// keep the handshakes out of the probes
+	for _, addr := range []net.Addr{fast, mid, slow} {
+		conn, err := NewServer(addr, "localhost").Dial(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.KeepAlive()
+	}
+
+	start := time.Now()
+	g.WarmupWithin(cl, time.Second)
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Fatalf("WarmupWithin took %v, longer than its timeout", elapsed)
+	}
+	measured := func(addr net.Addr) bool {
+		g.RLock()
+		defer g.RUnlock()
+		for _, m := range g.remotes {
+			if m.Remote.(*singleRemote).String() == addr.String() {
+				return m.latency.measured
+			}
+		}
+		return false
+	}
+	if !measured(fast) || !measured(mid) {
+		t.Fatal("expected the members answering in time to be measured")
+	}
+	if measured(slow) {
+		t.Fatal("expected the slow member to be unmeasured when WarmupWithin returns")
+	}
+	g.RLock()
+	ranked := append([]*Member(nil), g.remotes...)
+	g.RUnlock()
+	sort.Stable(byLatency(ranked))
+	if first := ranked[0].Remote.(*singleRemote).String(); first != fast.String() {
+		t.Fatalf("expected the fastest member ranked first, got %s", first)
+	}
+
+	// the late result is still recorded
+	for deadline := time.Now().Add(5 * time.Second); !measured(slow); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the slow member to be measured once it answered")
+		}
+	}
+}
+
+func TestInitialProbeTimeout(t *testing.T) {
+	addr := newTestServer(t)
+	cl := newTestClient(t)
+	cl.InitialProbeTimeout = time.Second
+	cl.Resolve = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("127.0.0.1")}, nil
+	}
+	_, port, _ := net.SplitHostPort(addr.String())
+	r, err := cl.LookupServerWithName("localhost", "keyless.example", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := r.(*Group)
+	defer g.Close()
+	g.RLock()
+	defer g.RUnlock()
+	if !g.remotes[0].latency.measured {
+		t.Fatal("expected the Group to be measured when the lookup returns")
+	}
+}
+
+func TestPerRemoteRate(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	addrs := []net.Addr{newTestServer(t), newTestServer(t)}
+	cl := newTestClient(t)
+	cl.PerRemoteRate = 1
+	cl.PerRemoteBurst = 2
+	g, err := NewGroup([]Remote{NewServer(addrs[0], "localhost"), NewServer(addrs[1], "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+
+	// dials beyond the burst of one server spill over to the other
+	dials := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		conn, err := g.Dial(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dials[conn.addr]++
+		conn.KeepAlive()
+	}
+	for _, addr := range addrs {
+		if dials[addr.String()] != 2 {
+			t.Fatalf("expected 2 dials to each server, got %v", dials)
+		}
+	}
+
+	// then dials are throttled until tokens are refilled
+	if _, err := g.Dial(cl); err != ErrRateLimited {
+		t.Fatalf("expected %v, got %v", ErrRateLimited, err)
+	}
+	if _, err := NewServer(addrs[0], "localhost").Dial(cl); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected %v, got %v", ErrRateLimited, err)
+	}
+	for _, m := range g.remotes {
+		if m.ErrorCount() != 0 {
+			t.Fatal("rate limited dials were counted as failures")
+		}
+	}
+	now = now.Add(time.Second)
+	conn, err := g.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+
+	// the buckets of the least recently dialed servers are evicted once
+	// as many servers as the pool holds were dialed since
+	for i := 0; i < connPoolSize; i++ {
+		cl.rateLimited(fmt.Sprintf("127.0.0.1:%d", 10000+i), true)
+	}
+	for _, addr := range addrs {
+		if v, _ := cl.rateLimits.cache.Get(addr.String()); v != nil {
+			t.Fatalf("bucket of %s kept after %d other servers were dialed", addr, connPoolSize)
+		}
+	}
+}
+
+func TestGroupString(t *testing.T) {
+	ra := NewServer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2407}, "a.test")
+	rb := NewServer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 2407}, "b.test")
+	rc := NewServer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 2407}, "c.test")
+	g, err := NewGroup([]Remote{ra, rb, rc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.remotes[0].latency.Update(5*time.Millisecond, 0.5)
+	g.remotes[1].latency.Update(time.Millisecond, 0.5)
+	g.remotes[2].errorCount = 2
+
+	want := "[127.0.0.2:2407 (b.test) latency=1ms errors=0 pos=1, " +
+		"127.0.0.1:2407 (a.test) latency=5ms errors=0 pos=0, " +
+		"127.0.0.3:2407 (c.test) unmeasured errors=2 pos=2]"
+	if got := g.String(); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestIsHealthy(t *testing.T) {
+	cl := newTestClient(t)
+	cl.Blacklist = &AddrSet{}
+
+	// a fresh remote is healthy until a dial fails
+	live := NewServer(newTestServer(t), "localhost")
+	if !live.IsHealthy(cl) {
+		t.Fatal("fresh remote is unhealthy")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	dead := NewServer(l.Addr(), "localhost")
+	if _, err := dead.Dial(cl); err == nil {
+		t.Fatal("expected dial to a closed port to fail")
+	}
+	if dead.IsHealthy(cl) {
+		t.Fatal("remote is healthy after a failed dial")
+	}
+
+	blacklisted := NewServer(newTestServer(t), "localhost")
+	cl.Blacklist.Add(blacklisted.(*singleRemote).Addr, blacklisted.(*singleRemote).Addr.(*net.TCPAddr).Port)
+	if blacklisted.IsHealthy(cl) {
+		t.Fatal("blacklisted remote is healthy")
+	}
+
+	// a group is healthy while any member is
+	g, err := NewGroup([]Remote{dead, blacklisted, live})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if !g.IsHealthy(cl) {
+		t.Fatal("group with a healthy member is unhealthy")
+	}
+	g.PingAll(cl, 0)
+	if !g.IsHealthy(cl) {
+		t.Fatal("group with a healthy member is unhealthy after a sweep")
+	}
+	g.Remove(live)
+	if g.IsHealthy(cl) {
+		t.Fatal("group without a healthy member is healthy")
+	}
+}
+
+func TestDialFunc(t *testing.T) {
+	l := newPipeListener()
+	defer l.Close()
+	go s.Serve(l)
+
+	cl := newTestClient(t)
+	var mu sync.Mutex
+	dialed := make(map[string]int)
+	cl.DialFunc = func(network, addr string, config *tls.Config) (net.Conn, error) {
+		mu.Lock()
+		dialed[addr]++
+		mu.Unlock()
+		raw, err := l.Dial()
+		if err != nil {
+			return nil, err
+		}
+		// the handshake is left to the client
+		return tls.Client(raw, config), nil
+	}
+	// the addresses are unreachable, so dials only succeed through DialFunc
+	addrs := []string{"192.0.2.1:2407", "192.0.2.2:2407"}
+	g, err := NewGroup([]Remote{
+		NewServer(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2407}, "localhost"),
+		NewServer(&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 2407}, "localhost"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	g.PingAll(cl, 2)
+	for _, st := range g.Stats() {
+		if !st.Measured {
+			t.Fatalf("expected %s to be measured through DialFunc, got %v", st.Addr, st.LastError)
+		}
+	}
+	conn, r, err := g.DialRemote(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.KeepAlive()
+	if err := conn.Ping(nil); err != nil {
+		t.Fatal(err)
+	}
+	if conn.addr != r.(*singleRemote).String() {
+		t.Fatalf("expected a connection to %s, got one to %s", r.(*singleRemote).String(), conn.addr)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, addr := range addrs {
+		if dialed[addr] != 1 {
+			t.Fatalf("expected %s to be dialed once, got %d", addr, dialed[addr])
+		}
+	}
+}
+
+func TestDialContextFunc(t *testing.T) {
+	l := newPipeListener()
+	defer l.Close()
+	go s.Serve(l)
+
+	cl := newTestClient(t)
+	cl.DialTimeout = 5 * time.Second
+	var verified int32
+	cl.VerifyServer = func(tls.ConnectionState, Remote) error {
+		atomic.AddInt32(&verified, 1)
+		return nil
+	}
+	cl.DialFunc = func(network, addr string, config *tls.Config) (net.Conn, error) {
+		t.Error("DialFunc called though DialContextFunc is set")
+		return nil, errors.New("unexpected DialFunc")
+	}
+	plain := false
+	cl.DialContextFunc = func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("expected the context of the dial to be bounded by DialTimeout")
+		}
+		raw, err := l.Dial()
+		if err != nil {
+			return nil, err
+		}
+		if plain {
+			return raw, nil
+		}
+		tlsConn := tls.Client(raw, config)
+		if err := tlsConn.Handshake(); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		// a wrapper of a *tls.Conn is verified by its connection state
+		return struct{ *tls.Conn }{tlsConn}, nil
+	}
+
+	r := NewServer(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2407}, "localhost")
+	defer r.Close()
+	conn, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.Ping(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&verified); n != 1 {
+		t.Fatalf("expected VerifyServer to check the wrapped connection once, got %d", n)
+	}
+
+	// a connection without TLS can't be verified
+	plain = true
+	r = NewServer(&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 2407}, "localhost")
+	defer r.Close()
+	var verr *VerificationError
+	if _, err := r.Dial(cl); !errors.As(err, &verr) {
+		t.Fatalf("expected a VerificationError for a connection without TLS, got %v", err)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	// accepts connections but never completes a TLS handshake
+	l, accepted := newBlackhole(t, "tcp", "127.0.0.1:0")
+	defer l.Close()
+
+	cl := newTestClient(t)
+	cl.DialTimeout = 10 * time.Second
+	cl.HandshakeTimeout = 100 * time.Millisecond
+	start := time.Now()
+	_, err := NewServer(l.Addr(), "localhost").Dial(cl)
+	if err == nil || !strings.Contains(err.Error(), "handshake timed out") {
+		t.Fatalf("expected the handshake to time out, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the error to wrap %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dial took %v, longer than the handshake timeout", elapsed)
+	}
+	if atomic.LoadInt32(accepted) != 1 {
+		t.Fatal("expected the connection to be accepted before the handshake")
+	}
+}
+
+func TestCloseAbortsDials(t *testing.T) {
+	// accepts connections but never completes a TLS handshake
+	l, _ := newBlackhole(t, "tcp", "127.0.0.1:0")
+	defer l.Close()
+
+	cl := newTestClient(t)
+	cl.Dialer.Timeout = time.Minute
+	cl.DialRetries = 5
+	unresponsive := NewServer(l.Addr(), "localhost")
+	g, err := NewGroup([]Remote{unresponsive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.lastPingAll = time.Now()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := g.Dial(cl)
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	g.Close()
+	select {
+	case err := <-result:
+		if err != ErrClosed {
+			t.Fatalf("expected %v, got %v", ErrClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not abort the dial in progress")
+	}
+
+	// the group can be dialed again
+	g.Remove(unresponsive)
+	g.Add(remote)
+	conn, err := g.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+}
+
+func TestSessionResumption(t *testing.T) {
+	addr := newTestServer(t)
+	// dialTwice dials r with cl twice, reporting whether the second dial
+	// resumed the session of the first.
+	dialTwice := func(cl *Client, r Remote) bool {
+		conn, err := r.Dial(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// reading the reply also processes the session tickets of the
+		// server
+		if err := conn.Ping(nil); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		conn, err = r.Dial(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.DidResume()
+	}
+
+	// a second handshake with the same server resumes the session
+	cl := newTestClient(t)
+	if !dialTwice(cl, NewServer(addr, "localhost")) {
+		t.Fatal("second dial to the same server did not resume its session")
+	}
+
+	// sessions aren't shared with other servers of the same name
+	if _, ok := cl.sessionCacheFor("127.0.0.1:1").Get("localhost"); ok {
+		t.Fatal("session cached for another address")
+	}
+
+	cl = newTestClient(t)
+	cl.SessionCacheSize = -1
+	if cl.sessionCacheFor(addr.String()) != nil {
+		t.Fatal("negative SessionCacheSize did not disable the cache")
+	}
+	if dialTwice(cl, NewServer(addr, "localhost")) {
+		t.Fatal("session resumed with the cache disabled")
+	}
+}
+
+func TestConnDidResume(t *testing.T) {
+	cl := newTestClient(t)
+	metrics := new(countingMetrics)
+	cl.Metrics = metrics
+	r := NewServer(newTestServer(t), "localhost")
+
+	conn, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.DidResume() {
+		t.Fatal("expected a full handshake on the first dial")
+	}
+	// reading the reply also processes the session tickets of the server
+	if err := conn.Ping(nil); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	conn, err = r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !conn.DidResume() {
+		t.Fatal("expected the second dial to resume the session")
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	if metrics.handshakes != 2 || metrics.resumptions != 1 {
+		t.Fatalf("expected 2 handshakes, 1 resumed, got %d, %d resumed", metrics.handshakes, metrics.resumptions)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// accepts connections but never completes a TLS handshake
+	l, _ := newBlackhole(t, "tcp", "127.0.0.1:0")
+	defer l.Close()
+
+	cl := newTestClient(t)
+	cl.Dialer.Timeout = time.Minute
+	cl.DialTimeout = 100 * time.Millisecond
+	start := time.Now()
+	_, err := NewServer(l.Addr(), "localhost").Dial(cl)
+	if err == nil {
+		t.Fatal("dial to an unresponsive server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dial took %v with a 100ms timeout", elapsed)
+	}
+}
+
+func TestTCPOptions(t *testing.T) {
+	cl := newTestClient(t)
+	var controls int32
+	cl.Dialer.Control = func(network, address string, rc syscall.RawConn) error {
+		atomic.AddInt32(&controls, 1)
+		return nil
+	}
+	conn, err := NewServer(newTestServer(t), "localhost").Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if n := atomic.LoadInt32(&controls); n != 1 {
+		t.Fatalf("expected the dial to go through the Control hook once, got %d", n)
+	}
+
+	for _, tc := range []struct {
+		dialer, tcp, want time.Duration
+	}{
+		{0, 0, defaultTCPKeepAlive},
+		{0, time.Minute, time.Minute},
+		{0, -1, -1},
+		// a keepalive period set on the Dialer takes precedence
+		{time.Second, time.Minute, time.Second},
+	} {
+		cl := &Client{Dialer: &net.Dialer{KeepAlive: tc.dialer}, TCPKeepAlive: tc.tcp}
+		if got := cl.netDialer().KeepAlive; got != tc.want {
+			t.Errorf("Dialer.KeepAlive %v, TCPKeepAlive %v: expected keepalive %v, got %v", tc.dialer, tc.tcp, tc.want, got)
+		}
+	}
+	// the Client's Dialer is left untouched
+	if cl.Dialer.KeepAlive != 0 {
+		t.Fatalf("netDialer modified Client.Dialer")
+	}
+}
+
+// newClientCertificate issues a client certificate signed by the test CA.
+func newClientCertificate(t *testing.T) tls.Certificate {
+	caPEM, err := ioutil.ReadFile(keylessCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := helpers.ParseCertificatePEM(caPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKeyPEM, err := ioutil.ReadFile("testdata/ca-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := helpers.ParsePrivateKeyPEM(caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "rotated client"},
+		NotBefore:    fixedCurrentTime().Add(-time.Hour),
+		NotAfter:     fixedCurrentTime().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSetClientCertificate(t *testing.T) {
+	// servers which report the client certificate of each handshake
+	peers := make(chan string, 10)
+	serve := func() net.Listener {
+		l, err := tls.Listen("tcp", "127.0.0.1:0", s.TLSConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					tlsConn := conn.(*tls.Conn)
+					if err := tlsConn.Handshake(); err != nil {
+						peers <- err.Error()
+						return
+					}
+					peers <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+					ioutil.ReadAll(conn)
+				}()
+			}
+		}()
+		return l
+	}
+	first, second := serve(), serve()
+	defer first.Close()
+	defer second.Close()
+
+	cl := newTestClient(t)
+	old, err := NewServer(first.Addr(), "localhost").Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if peer := <-peers; peer == "rotated client" {
+		t.Fatal("expected the original certificate before rotation")
+	}
+
+	cl.SetClientCertificate(newClientCertificate(t))
+	conn, err := NewServer(second.Addr(), "localhost").Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if peer := <-peers; peer != "rotated client" {
+		t.Fatalf("expected a fresh dial to use the new certificate, got %s", peer)
+	}
+
+	// the existing connection is kept
+	select {
+	case <-old.closed:
+		t.Fatal("rotation closed an existing connection")
+	case peer := <-peers:
+		t.Fatalf("unexpected handshake with %s", peer)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := connPool.Len(first.Addr().String()); n != 1 {
+		t.Fatalf("expected the existing connection to stay pooled, got %d", n)
+	}
+}
+
+func TestMaxInflightPerConn(t *testing.T) {
+	// a server which answers pings only when told to
+	l, err := tls.Listen("tcp", "127.0.0.1:0", s.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	requests := make(chan *protocol.Packet, 10)
+	var serverConn net.Conn
+	accepted := make(chan struct{})
+	go func() {
+		var err error
+		if serverConn, err = l.Accept(); err != nil {
+			return
+		}
+		close(accepted)
+		for {
+			pkt := new(protocol.Packet)
+			if _, err := pkt.ReadFrom(serverConn); err != nil {
+				return
+			}
+			requests <- pkt
+		}
+	}()
+
+	cl := newTestClient(t)
+	cl.MaxInflightPerConn = 2
+	conn, err := NewServer(l.Addr(), "localhost").Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-accepted
+
+	const n = 5
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() { errs <- conn.Ping(nil) }()
+	}
+	var received []*protocol.Packet
+	for len(received) < 2 {
+		received = append(received, <-requests)
+	}
+	select {
+	case pkt := <-requests:
+		t.Fatalf("operation %d was sent with 2 operations in flight", pkt.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// each answer lets another operation through
+	for answered := 0; answered < n; answered++ {
+		if len(received) == 0 {
+			received = append(received, <-requests)
+		}
+		pkt := received[0]
+		received = received[1:]
+		pong := protocol.NewPacket(pkt.ID, protocol.Operation{Opcode: protocol.OpPong})
+		if _, err := pong.WriteTo(serverConn); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	// a server which closes each connection right after the handshake
+	l, err := tls.Listen("tcp", "127.0.0.1:0", s.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	cl := newTestClient(t)
+	cl.ReconnectBackoff = 50 * time.Millisecond
+	cl.MaxReconnectBackoff = time.Second
+	r := NewServer(l.Addr(), "localhost")
+	defer r.Close()
+	// reconnects wait 50, 100, 200 and 400ms
+	for start := time.Now(); time.Since(start) < 700*time.Millisecond; {
+		if conn, err := r.Dial(cl); err == nil {
+			conn.KeepAlive()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&accepted); n < 2 || n > 6 {
+		t.Fatalf("expected reconnects to be throttled to about 5, got %d", n)
+	}
+
+	// the backoff is opt-in
+	if newTestClient(t).reconnectBackoffFor(l.Addr().String()) != nil {
+		t.Fatal("reconnects backed off with a zero ReconnectBackoff")
+	}
+}
+
+func TestReconnectBackoffReset(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	var b reconnectBackoff
+	if wait := b.wait(time.Second, 10*time.Second); wait != 0 {
+		t.Fatalf("expected no wait before any connection was lost, got %v", wait)
+	}
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second} {
+		b.lost(time.Millisecond, 10*time.Second)
+		if wait := b.wait(time.Second, 10*time.Second); wait != want {
+			t.Fatalf("expected a wait of %v after %d lost connections, got %v", want, i+1, wait)
+		}
+	}
+	// the wait is counted from the loss
+	now = now.Add(3 * time.Second)
+	if wait := b.wait(time.Second, 10*time.Second); wait != 7*time.Second {
+		t.Fatalf("expected the wait to count from the loss, got %v", wait)
+	}
+	// a stable connection resets the backoff
+	b.lost(10*time.Second, 10*time.Second)
+	if wait := b.wait(time.Second, 10*time.Second); wait != 0 {
+		t.Fatalf("expected no wait after a stable connection, got %v", wait)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	proxy := newTestProxy(t, sAddr)
+	defer proxy.Close()
+	cl := newTestClient(t)
+	cl.KeepaliveInterval = 50 * time.Millisecond
+	r := NewServer(proxy.Addr(), "localhost")
+
+	conn, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+
+	// keepalives keep a healthy idle connection open
+	time.Sleep(3 * cl.KeepaliveInterval)
+	if again, err := r.Dial(cl); err != nil || again != conn {
+		t.Fatal("healthy connection was not reused:", err)
+	}
+	conn.KeepAlive()
+
+	// silently drop the connection, as an idle NAT mapping would
+	proxy.Blackhole()
+	deadline := time.Now().Add(5 * time.Second)
+	for connPool.Len(proxy.Addr().String()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("failed keepalive did not remove the connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	again, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if again == conn || proxy.Accepted() != 2 {
+		t.Fatal("Dial did not reconnect after a failed keepalive")
+	}
+	if err := again.Conn.Ping(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateAfter(t *testing.T) {
+	proxy := newTestProxy(t, sAddr)
+	defer proxy.Close()
+	cl := newTestClient(t)
+	cl.ValidateAfter = 50 * time.Millisecond
+	cl.DialTimeout = 200 * time.Millisecond
+	r := NewServer(proxy.Addr(), "localhost")
+
+	conn, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+
+	// a connection used recently is handed out as is
+	if again, err := r.Dial(cl); err != nil || again != conn {
+		t.Fatal("recently used connection was not reused:", err)
+	}
+	conn.KeepAlive()
+
+	// the server silently goes away behind the idle connection
+	proxy.Blackhole()
+	time.Sleep(2 * cl.ValidateAfter)
+
+	again, err := r.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if again == conn || proxy.Accepted() != 2 {
+		t.Fatal("Dial handed out a half-open connection")
+	}
+	if err := again.Conn.Ping(nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-conn.closed:
+	default:
+		t.Fatal("half-open connection was not closed")
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	proxy := newTestProxy(t, sAddr)
+	defer proxy.Close()
+	cl := newTestClient(t)
+	cl.PingPayload = []byte("keyless health check")
+	cl.PingTimeout = 100 * time.Millisecond
+	g, err := NewGroup([]Remote{NewServer(proxy.Addr(), "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	g.PingAll(cl, 0)
+	if !g.remotes[0].latency.measured {
+		t.Fatal("ping with a payload failed")
+	}
+
+	// the server stops answering
+	proxy.Blackhole()
+	start := time.Now()
+	g.PingAll(cl, 0)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("sweep took %v with a 100ms ping timeout", elapsed)
+	}
+	if g.remotes[0].latency.measured {
+		t.Fatal("latency of unresponsive remote was not reset")
+	}
+	if g.remotes[0].pingFailures != 1 {
+		t.Fatalf("expected a ping failure, got %d", g.remotes[0].pingFailures)
+	}
+}
+
+func TestProbeOp(t *testing.T) {
+	cl := newTestClient(t)
+	var probes int32
+	cl.ProbeOp = func(conn *Conn) error {
+		atomic.AddInt32(&probes, 1)
+		time.Sleep(50 * time.Millisecond)
+		return conn.Ping(nil)
+	}
+	g, err := NewGroup([]Remote{NewServer(newTestServer(t), "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	g.PingAll(cl, 0)
+	if atomic.LoadInt32(&probes) != 1 {
+		t.Fatalf("expected a single probe, got %d", probes)
+	}
+	if latency, measured := g.remotes[0].Latency(); !measured || latency < 50*time.Millisecond {
+		t.Fatalf("latency %v doesn't reflect the probe", latency)
+	}
+
+	cl.ProbeOp = func(conn *Conn) error { return errors.New("probe failed") }
+	g.PingAll(cl, 0)
+	if _, measured := g.remotes[0].Latency(); measured {
+		t.Fatal("latency not reset by a failed probe")
+	}
+}
+
+func TestProbeRate(t *testing.T) {
+	cl := newTestClient(t)
+	cl.ProbeRate = 20
+	cl.ProbeBurst = 2
+	var probes int32
+	cl.ProbeOp = func(conn *Conn) error {
+		atomic.AddInt32(&probes, 1)
+		return conn.Ping(nil)
+	}
+	var remotes []Remote
+	for i := 0; i < 4; i++ {
+		remotes = append(remotes, NewServer(newTestServer(t), "localhost"))
+	}
+
+	// the groups sweep all their members at once, but share the limit
+	const groups = 3
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < groups; i++ {
+		g, err := NewGroup(remotes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer g.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.PingAll(cl, len(remotes))
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	n := int(atomic.LoadInt32(&probes))
+	if n != groups*len(remotes) {
+		t.Fatalf("expected %d probes, got %d", groups*len(remotes), n)
+	}
+	// beyond the burst, probes are 1/ProbeRate apart
+	min := time.Duration(float64(n-cl.ProbeBurst) / cl.ProbeRate * float64(time.Second))
+	if elapsed < min {
+		t.Fatalf("expected %d probes to take at least %v, took %v", n, min, elapsed)
+	}
+}
+
+func TestCloseStopsSweep(t *testing.T) {
+	// the handshakes of the sweeps stall until they're aborted
+	l, _ := newBlackhole(t, "tcp", "127.0.0.1:0")
+	defer l.Close()
+	cl := newTestClient(t)
+	before := runtime.NumGoroutine()
+
+	const groups = 20
+	var closed []*Group
+	for i := 0; i < groups; i++ {
+		g, err := NewGroup([]Remote{NewServer(l.Addr(), "localhost")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the first dial starts a background sweep
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if _, err := g.DialContext(ctx, cl); err == nil {
+			t.Fatal("expected the dial of a blackhole to fail")
+		}
+		cancel()
+		closed = append(closed, g)
+	}
+	sweeping := func(g *Group) bool {
+		g.RLock()
+		defer g.RUnlock()
+		return g.sweep != nil
+	}
+	// wait for the sweeps to stall, on a handshake or on the dial of
+	// another one
+	deadline := time.Now().Add(2 * time.Second)
+	for _, g := range closed {
+		for !sweeping(g) {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the dial to start a background sweep")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, g := range closed {
+		g.Close()
+	}
+
+	deadline = time.Now().Add(2 * time.Second)
+	for _, g := range closed {
+		for sweeping(g) {
+			if time.Now().After(deadline) {
+				t.Fatal("expected Close to stop the background sweep")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// a few goroutines of the runtime or of other tests may come and go
+	for runtime.NumGoroutine() > before+5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the goroutines of the sweeps to exit, got %d, %d before", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPingAllCoalesces(t *testing.T) {
+	slow := &flakyRemote{Remote: remote, delay: 300 * time.Millisecond}
+	g, err := NewGroup([]Remote{slow})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	ping := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.PingAll(c, 1)
+		}()
+	}
+	// start the other calls while the first sweep is dialing
+	ping()
+	for slow.Dials() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 19; i++ {
+		ping()
+	}
+	wg.Wait()
+	if n := slow.Dials(); n != 1 {
+		t.Fatalf("expected concurrent PingAll calls to share one sweep, got %d dials", n)
+	}
+
+	// rapid dials trigger at most one background sweep
+	g.lastPingAll = time.Time{}
+	for i := 0; i < 20; i++ {
+		conn, err := g.Dial(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.KeepAlive()
+	}
+	time.Sleep(time.Second)
+	if n := slow.Dials(); n != 1+20+1 {
+		t.Fatalf("expected a single background sweep, got %d sweep dials", n-21)
+	}
+}
+
+func TestPingAllKeepsDialedConn(t *testing.T) {
+	addr := newTestServer(t)
+	g, err := NewGroup([]Remote{NewServer(addr, "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+
+	conn, err := g.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.PingAll(c, 1)
+	if err := conn.Conn.Ping(nil); err != nil {
+		t.Fatal("connection unusable after a measurement sweep:", err)
+	}
+
+	// a probe which fails on the shared connection doesn't close it while
+	// the caller still holds it
+	probe, err := g.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probe != conn {
+		t.Fatal("expected the probe to share the connection")
+	}
+	probe.discard(CloseReasonPingFailed)
+	if err := conn.Conn.Ping(nil); err != nil {
+		t.Fatal("connection closed out from under its caller:", err)
+	}
+	conn.discard(CloseReasonPingFailed)
+	if err := conn.Conn.Ping(nil); err == nil {
+		t.Fatal("discarded connection left open once unused")
+	}
+	if connPool.Len(addr.String()) != 0 {
+		t.Fatal("discarded connection left in the pool")
+	}
+}
+
+func TestProbeConcurrency(t *testing.T) {
+	var remotes []Remote
+	for i := 0; i < 10; i++ {
+		remotes = append(remotes, NewServer(newTestServer(t), "localhost"))
+	}
+	g, err := NewGroup(remotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	cl := newTestClient(t)
+	g.lastPingAll = time.Now()
+
+	// the first sweep establishes the connections
+	g.PingAll(cl, 10)
+
+	// probe holds each probe until release is closed, recording the most
+	// probes in flight at once
+	var inflight, peak int32
+	started := make(chan struct{}, len(remotes))
+	release := make(chan struct{})
+	probe := func(cn *Conn) error {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for p := atomic.LoadInt32(&peak); n > p; p = atomic.LoadInt32(&peak) {
+			if atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		started <- struct{}{}
+		<-release
+		return cn.Ping(nil)
+	}
+	cl.ProbeOp = probe
+
+	// a Dial during a sweep isn't blocked by the probes in flight
+	done := make(chan struct{})
+	go func() {
+		g.PingAll(cl, 1)
+		close(done)
+	}()
+	<-started
+	conn, err := g.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+	if n := atomic.LoadInt32(&inflight); n != 1 {
+		t.Fatalf("expected the sweep to probe one member at a time, got %d", n)
+	}
+	close(release)
+	<-done
+	if n := atomic.LoadInt32(&peak); n != 1 {
+		t.Fatalf("expected a sweep of concurrency 1, got %d probes at once", n)
+	}
+
+	// with ProbeConcurrency, every member is probed at once
+	atomic.StoreInt32(&peak, 0)
+	started = make(chan struct{}, len(remotes))
+	release = make(chan struct{})
+	cl.ProbeConcurrency = 10
+	done = make(chan struct{})
+	go func() {
+		g.PingAll(cl, 0)
+		close(done)
+	}()
+	for i := 0; i < len(remotes); i++ {
+		<-started
+	}
+	close(release)
+	<-done
+	if n := atomic.LoadInt32(&peak); n != int32(len(remotes)) {
+		t.Fatalf("expected %d probes at once, got %d", len(remotes), n)
+	}
+}
+
+func TestNilRemotes(t *testing.T) {
+	var skipped Remote
+	g, err := NewGroup([]Remote{nil, remote, skipped})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Add(nil)
+	if members := g.Remotes(); len(members) != 1 || members[0].Remote != remote {
+		t.Fatalf("expected nil remotes to be skipped, got %+v", members)
+	}
+	g.lastPingAll = time.Now()
+	conn, err := g.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+
+	if _, err := NewGroup([]Remote{nil, nil}); err == nil {
+		t.Fatal("expected an error creating a group of nil remotes")
+	}
+	if _, err := NewWeightedGroup(map[Remote]int{nil: 1}); err == nil {
+		t.Fatal("expected an error creating a weighted group of nil remotes")
+	}
+}
+
+func TestGroupRemove(t *testing.T) {
+	addr1, addr2 := newTestServer(t), newTestServer(t)
+	g, err := NewGroup([]Remote{NewServer(addr1, "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.Add(NewServer(addr2, "localhost"))
+	g.PingAll(c, 2)
+
+	best := bestMember(g)
+	conn, err := best.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+
+	// an equal remote matches the member
+	single := best.Remote.(*singleRemote)
+	if !g.Remove(NewServer(single.Addr, single.ServerName)) {
+		t.Fatal("failed to remove the best remote")
+	}
+	if g.Remove(best.Remote) {
+		t.Fatal("removed a remote twice")
+	}
+	if err := conn.Conn.Ping(nil); err == nil {
+		t.Fatal("connection of the removed remote was not closed")
+	}
+
+	for i := 0; i < 5; i++ {
+		conn, err := g.Dial(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.addr == single.String() {
+			t.Fatal("dialed a removed remote")
+		}
+		conn.KeepAlive()
+	}
+}
+
+func TestRemoteID(t *testing.T) {
+	addr1, addr2 := newTestServer(t), newTestServer(t)
+	a, b := NewServer(addr1, "localhost"), NewServer(addr1, "localhost")
+	if a.(Identifier).ID() != b.(Identifier).ID() {
+		t.Fatalf("expected servers of the same address to be the same, got %s and %s", a.(Identifier).ID(), b.(Identifier).ID())
+	}
+	for _, other := range []Remote{NewServer(addr2, "localhost"), NewServer(addr1, "example.com")} {
+		if sameRemote(a, other) {
+			t.Fatalf("expected %s not to be the same as %s", a.(Identifier).ID(), other.(Identifier).ID())
+		}
+	}
+	if sameRemote(a, &flakyRemote{Remote: a}) {
+		t.Fatal("expected a remote without an ID to only be the same as itself")
+	}
+
+	// groups are the same if their members are
+	g1, err := NewGroup([]Remote{a, NewServer(addr2, "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g1.Close()
+	g2, err := NewGroup([]Remote{NewServer(addr2, "localhost"), b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g2.Close()
+	if !sameRemote(g1, g2) {
+		t.Fatalf("expected groups of the same members to be the same, got %s and %s", g1.ID(), g2.ID())
+	}
+
+	// adding an equal server is a no-op, and removing one removes the member
+	g1.Add(b)
+	if n := len(g1.Remotes()); n != 2 {
+		t.Fatalf("expected 2 members, got %d", n)
+	}
+	if !g1.Remove(NewServer(addr1, "localhost")) {
+		t.Fatal("failed to remove an equal server")
+	}
+	// the identity of a group is fixed on creation
+	if !sameRemote(g1, g2) {
+		t.Fatalf("expected the identity of a group to outlive its members, got %s and %s", g1.ID(), g2.ID())
+	}
+	g3, err := NewGroup([]Remote{NewServer(addr2, "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g3.Close()
+	if sameRemote(g1, g3) {
+		t.Fatal("expected groups created with different members not to be the same")
+	}
+	// matching a group against its members doesn't take its lock again
+	if g1.Remove(g1) {
+		t.Fatal("removed a group from itself")
+	}
+}
+
+func TestGroupDrain(t *testing.T) {
+	g, err := NewGroup([]Remote{NewServer(newTestServer(t), "localhost"), NewServer(newTestServer(t), "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.PingAll(c, 2)
+
+	best := bestMember(g)
+	single := best.Remote.(*singleRemote)
+	conn, err := g.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an equal remote matches the member
+	if !g.Drain(NewServer(single.Addr, single.ServerName)) {
+		t.Fatal("failed to drain the best remote")
+	}
+	// operations in flight on its connections complete
+	if conn.addr == single.String() {
+		if err := conn.Conn.Ping(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.KeepAlive()
+
+	stat := func() RemoteStats {
+		for _, st := range g.Stats() {
+			if st.Remote == best.Remote {
+				return st
+			}
+		}
+		t.Fatal("drained remote is not a member")
+		return RemoteStats{}
+	}
+	before := stat()
+	if !before.Drained || !before.Measured {
+		t.Fatalf("expected a drained member with its latency, got %+v", before.RemoteStat)
+	}
+	for i := 0; i < 5; i++ {
+		conn, err := g.Dial(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.addr == single.String() {
+			t.Fatal("dialed a drained remote")
+		}
+		conn.KeepAlive()
+	}
+	if after := stat(); after.Dials != before.Dials || after.Latency != before.Latency {
+		t.Fatalf("expected the stats of the drained remote to be kept, got %+v, before %+v", after, before)
+	}
+
+	// draining the other member too leaves nothing to dial
+	for _, st := range g.Remotes() {
+		g.Drain(st.Remote)
+	}
+	if _, err := g.Dial(c); err != ErrAllDrained {
+		t.Fatalf("expected ErrAllDrained, got %v", err)
+	}
+
+	if !g.Undrain(best.Remote) {
+		t.Fatal("failed to undrain the best remote")
+	}
+	conn, err = g.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.addr != single.String() {
+		t.Fatalf("expected a dial of the undrained remote, got %s", conn.addr)
+	}
+	conn.KeepAlive()
+	if stat().Drained {
+		t.Fatal("expected the remote not to be drained")
+	}
+}
+
+func TestReady(t *testing.T) {
+	cl := newTestClient(t)
+	var dials int32
+	cl.Dialer.Control = func(network, address string, rc syscall.RawConn) error {
+		atomic.AddInt32(&dials, 1)
+		return nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := NewServer(l.Addr(), "localhost")
+	l.Close()
+
+	g, err := NewGroup([]Remote{dead, NewServer(newTestServer(t), "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+	if err := g.Ready(cl); err != nil {
+		t.Fatal(err)
+	}
+	// the connection established is pinged again rather than dialing
+	n := atomic.LoadInt32(&dials)
+	if err := g.Ready(cl); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&dials) != n {
+		t.Fatal("expected readiness to be probed on the established connection")
+	}
+
+	down, err := NewGroup([]Remote{dead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+	down.lastPingAll = time.Now()
+	if err := down.Ready(cl); err == nil || !strings.Contains(err.Error(), "not ready") {
+		t.Fatalf("expected a group without reachable servers not to be ready, got %v", err)
+	}
+}
+
+func TestConn(t *testing.T) {
+	addr := newTestServer(t)
+	r := NewServer(addr, "localhost")
+	defer r.Close()
+	if _, ok := r.(conner).Conn(); ok {
+		t.Fatal("got a connection before any dial")
+	}
+	if n := connPool.Len(addr.String()); n != 0 {
+		t.Fatalf("Conn dialed %d connections", n)
+	}
+	g, err := NewGroup([]Remote{deadRemote, r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.Conn(); ok {
+		t.Fatal("group returned a connection before any dial")
+	}
+
+	dialed, err := r.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialed.KeepAlive()
+	cn, ok := r.(conner).Conn()
+	if !ok || cn != dialed {
+		t.Fatalf("expected the dialed connection, got %v %v", cn, ok)
+	}
+	if err := cn.Ping(nil); err != nil {
+		t.Fatal(err)
+	}
+	cn.KeepAlive()
+	if cn, ok = g.Conn(); !ok || cn != dialed {
+		t.Fatalf("expected the group to return the dialed connection, got %v %v", cn, ok)
+	}
+	cn.KeepAlive()
+	if n := connPool.Len(addr.String()); n != 1 {
+		t.Fatalf("expected a single pooled connection, got %d", n)
+	}
+}
+
+func TestGroupRemotes(t *testing.T) {
+	addr := newTestServer(t)
+	g, err := NewGroup([]Remote{NewServer(addr, "localhost"), deadRemote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.PingAll(c, 2)
+
+	stats := g.Remotes()
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 members, got %d", len(stats))
+	}
+	live, dead := stats[0], stats[1]
+	if live.Network != "tcp" || live.Addr != addr.String() || live.ServerName != "localhost" {
+		t.Fatalf("bad description of a single server: %+v", live)
+	}
+	if !live.Measured || live.Latency <= 0 || !live.Healthy || live.ErrorCount != 0 {
+		t.Fatalf("bad state of a live server: %+v", live)
+	}
+	if dead.Remote != deadRemote || dead.Addr != "" || dead.Measured || dead.Healthy || dead.ErrorCount != 1 {
+		t.Fatalf("bad state of a dead group: %+v", dead)
+	}
+
+	if live.LastError != nil || !live.LastErrorAt.IsZero() {
+		t.Fatalf("live server has a last error: %+v", live)
+	}
+	if dead.LastError == nil || dead.LastErrorAt.IsZero() {
+		t.Fatalf("last error of a dead group wasn't recorded: %+v", dead)
+	}
+
+	// the snapshot is a copy
+	stats[0].ErrorCount = 100
+	if g.Remotes()[0].ErrorCount != 0 {
+		t.Fatal("snapshot shares state with the group")
+	}
+
+	// the cause of a failure is kept, not just counted
+	misnamed, err := NewGroup([]Remote{NewServer(newTestServer(t), "misnamed.example")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer misnamed.Close()
+	before := time.Now()
+	misnamed.PingAll(c, 1)
+	st := misnamed.Remotes()[0]
+	if st.LastError == nil || !strings.Contains(st.LastError.Error(), "x509") || st.LastErrorAt.Before(before) {
+		t.Fatalf("expected the certificate error to be recorded, got %v at %v", st.LastError, st.LastErrorAt)
+	}
+}
+
+func TestGroupStats(t *testing.T) {
+	flaky := &flakyRemote{Remote: NewServer(newTestServer(t), "localhost")}
+	g, err := NewGroup([]Remote{flaky})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+
+	start := time.Now()
+	g.PingAll(c, 1)
+	conn, err := g.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+	flaky.setFailing(true)
+	g.Dial(c)
+	g.PingAll(c, 1)
+
+	stats := g.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("expected 1 member, got %d", len(stats))
+	}
+	st := stats[0]
+	if st.Dials != 2 || st.DialFailures != 1 || st.Pings != 1 || st.PingFailures != 1 {
+		t.Fatalf("bad counters: %+v", st)
+	}
+	if st.ConsecutiveFailures != 2 || st.ErrorCount != 2 || st.Healthy {
+		t.Fatalf("bad failure state: %+v", st)
+	}
+	if st.LastError == nil || st.LastError.Error() != "flaky remote failing" || st.LastErrorAt.Before(st.LastSuccess) || st.LastSuccess.Before(start) {
+		t.Fatalf("bad last error or timestamps: %+v", st)
+	}
+}
+
+func TestAggregateLatency(t *testing.T) {
+	var remotes []Remote
+	for i := 0; i < 5; i++ {
+		remotes = append(remotes, NewServer(&net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(i+1)), Port: 2407}, "localhost"))
+	}
+	g, err := NewGroup(remotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best, healthy := g.AggregateLatency(); best != 0 || healthy != 5 {
+		t.Fatalf("expected no latency and 5 healthy members, got %v and %d", best, healthy)
+	}
+
+	g.Lock()
+	g.remotes[0].latency.Update(30*time.Millisecond, defaultLatencyAlpha)
+	g.remotes[1].latency.Update(20*time.Millisecond, defaultLatencyAlpha)
+	// the fastest members are unhealthy or drained
+	g.remotes[2].latency.Update(time.Millisecond, defaultLatencyAlpha)
+	g.remotes[2].failures = 1
+	g.remotes[3].latency.Update(2*time.Millisecond, defaultLatencyAlpha)
+	g.remotes[3].drained = true
+	g.Unlock()
+	if best, healthy := g.AggregateLatency(); best != 20*time.Millisecond || healthy != 3 {
+		t.Fatalf("expected 20ms and 3 healthy members, got %v and %d", best, healthy)
+	}
+}
+
+func TestOnStateChange(t *testing.T) {
+	type event struct {
+		addr       net.Addr
+		serverName string
+		healthy    bool
+	}
+	var mu sync.Mutex
+	var events []event
+	cl := newTestClient(t)
+	cl.OnStateChange = func(addr net.Addr, serverName string, healthy bool) {
+		mu.Lock()
+		events = append(events, event{addr, serverName, healthy})
+		mu.Unlock()
+	}
+	takeEvents := func() []event {
+		mu.Lock()
+		defer mu.Unlock()
+		taken := events
+		events = nil
+		return taken
+	}
+
+	flaky := &flakyRemote{Remote: NewServer(newTestServer(t), "localhost")}
+	g, err := NewGroup([]Remote{flaky})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+
+	dial := func() {
+		if conn, err := g.Dial(cl); err == nil {
+			conn.KeepAlive()
+		}
+	}
+	dial()
+	dial()
+	if ev := takeEvents(); len(ev) != 0 {
+		t.Fatalf("expected no events while healthy, got %v", ev)
+	}
+	flaky.setFailing(true)
+	dial()
+	dial()
+	g.PingAll(cl, 1)
+	if ev := takeEvents(); len(ev) != 1 || ev[0].healthy || ev[0].addr != nil {
+		t.Fatalf("expected a single unhealthy event, got %v", ev)
+	}
+	flaky.setFailing(false)
+	g.PingAll(cl, 1)
+	dial()
+	if ev := takeEvents(); len(ev) != 1 || !ev[0].healthy {
+		t.Fatalf("expected a single healthy event, got %v", ev)
+	}
+
+	// single servers are described by their address and server name
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr()
+	l.Close()
+	dead, err := NewGroup([]Remote{NewServer(addr, "dead.test")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.lastPingAll = time.Now()
+	dead.Dial(cl)
+	if ev := takeEvents(); len(ev) != 1 || ev[0].addr != addr || ev[0].serverName != "dead.test" || ev[0].healthy {
+		t.Fatalf("bad event for a single server: %v", ev)
+	}
+}
+
+func TestPreferredZone(t *testing.T) {
+	local, remote := newTestServer(t), newTestServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr()
+	l.Close()
+
+	cl := newTestClient(t)
+	cl.PreferredZone = "local"
+
+	g, err := NewGroup([]Remote{
+		NewServerInZone(remote, "localhost", "remote"),
+		NewServerInZone(local, "localhost", "local"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+	// the remote zone is faster
+	g.remotes[0].latency.Update(time.Millisecond, 0.5)
+	for i := 0; i < 10; i++ {
+		conn, err := g.Dial(cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.KeepAlive()
+		if conn.addr != local.String() {
+			t.Fatalf("dialed %s instead of the local zone", conn.addr)
+		}
+	}
+	if g.Remotes()[1].Zone != "local" {
+		t.Fatal("zone missing from the member snapshot")
+	}
+
+	// spill over to other zones once the local zone fails
+	g, err = NewGroup([]Remote{
+		NewServerInZone(remote, "localhost", "remote"),
+		NewServerInZone(dead, "localhost", "local"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+	conn, err := g.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+	if conn.addr != remote.String() {
+		t.Fatalf("dialed %s instead of spilling over to the remote zone", conn.addr)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	l, _ := newBlackhole(t, "tcp", "127.0.0.1:0")
+	unreachable := l.Addr().String()
+	l.Close()
+
+	logger := &memLogger{}
+	cl := newTestClient(t)
+	cl.Logger = logger
+	g, err := NewGroup([]Remote{NewServer(newTestServer(t), "localhost"), NewServer(l.Addr(), "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	cl.ProbeOp = func(cn *Conn) error { return errors.New("probe rejected") }
+	g.PingAll(cl, 0)
+	if !logger.Logged("info: PingAll's dial failed: dial " + unreachable) {
+		t.Fatalf("dial failure wasn't logged through the Logger: %q", logger.messages)
+	}
+	if !logger.Logged("info: PingAll's ping failed: probe rejected") {
+		t.Fatalf("ping failure wasn't logged through the Logger: %q", logger.messages)
+	}
+	if !logger.Logged("debug: Dialing localhost at") || !logger.Logged("debug: add conn with key") {
+		t.Fatalf("debug messages weren't logged through the Logger: %q", logger.messages)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	addr := newTestServer(t)
+	tracer := &memTracer{}
+	cl := newTestClient(t)
+	cl.Tracer = tracer
+
+	g, err := NewGroup([]Remote{NewServer(addr, "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+
+	ctx, root := tracer.Start(context.Background(), "request")
+	conn, err := g.DialContext(ctx, cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.KeepAlive()
+	root.End()
+	g.PingAll(cl, 1)
+
+	spans := tracer.Spans()
+	if len(spans) != 5 {
+		t.Fatalf("expected 5 spans, got %d", len(spans))
+	}
+	for i, want := range []struct{ name, parent string }{
+		{"request", ""},
+		{spanGroupDial, "request"},
+		{spanDial, spanGroupDial},
+		// the dial of PingAll is served by the pool
+		{spanDial, ""},
+		{spanPing, ""},
+	} {
+		span := spans[i]
+		parent := ""
+		if span.parent != nil {
+			parent = span.parent.name
+		}
+		if span.name != want.name || parent != want.parent || !span.ended {
+			t.Fatalf("span %d: expected %s with parent %q, got %s with parent %q", i, want.name, want.parent, span.name, parent)
+		}
+	}
+	dial := spans[2]
+	if dial.attrs["server.addr"] != addr.String() || dial.attrs["server.name"] != "localhost" || dial.attrs["outcome"] != "ok" {
+		t.Fatalf("bad dial span attributes: %v", dial.attrs)
+	}
+
+	// failures are recorded as errors
+	dead, err := NewGroup([]Remote{deadRemote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.lastPingAll = time.Now()
+	dead.Dial(cl)
+	spans = tracer.Spans()
+	if failed := spans[5]; failed.name != spanGroupDial || failed.attrs["outcome"] != "error" || len(failed.errs) == 0 {
+		t.Fatalf("failed dial not recorded: %+v", failed)
+	}
+
+	// lookups are traced as part of the caller's span
+	ctx, root = tracer.Start(context.Background(), "lookup")
+	if _, err := cl.LookupServerContext(ctx, "localhost:2407"); err != nil {
+		t.Fatal(err)
+	}
+	root.End()
+	var resolve *memSpan
+	for _, span := range tracer.Spans() {
+		if span.name == spanResolve && span.parent == root {
+			resolve = span
+		}
+	}
+	if resolve == nil || resolve.attrs["host"] != "localhost" || !resolve.ended {
+		t.Fatalf("lookup not traced as part of the caller's span: %+v", resolve)
 	}
 }
 
-func TestSlowServer(t *testing.T) {
-	// Setup a slow keyless server
-	cfg := server.DefaultServeConfig().WithTCPTimeout(time.Second * 30)
-	s2, err := server.NewServerFromFile(cfg, serverCert, serverKey, keylessCA)
+func TestDialErrors(t *testing.T) {
+	cl := newTestClient(t)
+	cl.BreakerThreshold = 1
+
+	blacklisted := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 65433}
+	cl.Blacklist.Add(blacklisted, blacklisted.Port)
+	r := NewServer(blacklisted, "localhost")
+	_, err := r.Dial(cl)
+	var dialErr *DialError
+	if !errors.Is(err, ErrBlacklisted) || !errors.As(err, &dialErr) || dialErr.Remote != r {
+		t.Fatalf("expected a blacklist rejection, got %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
-	s2.TLSConfig().Time = fixedCurrentTime
+	dead := NewServer(l.Addr(), "localhost")
+	l.Close()
+	g, err := NewGroup([]Remote{dead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.lastPingAll = time.Now()
+	// the error of the last dial is returned
+	_, err = g.Dial(cl)
+	if !errors.As(err, &dialErr) || dialErr.Remote != dead || errors.Is(err, ErrBlacklisted) {
+		t.Fatalf("expected the dial error of the dead server, got %v", err)
+	}
+	if _, err = g.Dial(cl); err != ErrBreakerOpen {
+		t.Fatalf("expected ErrBreakerOpen, got %v", err)
+	}
 
-	l, err := net.Listen("tcp", "localhost:0")
+	g.Remove(dead)
+	if _, err = g.Dial(cl); err != ErrGroupEmpty {
+		t.Fatalf("expected ErrGroupEmpty, got %v", err)
+	}
+}
+
+func TestAllBlacklisted(t *testing.T) {
+	cl := newTestClient(t)
+	cl.DialRetries = 3
+	a, b := newTestServer(t), newTestServer(t)
+	g, err := NewGroup([]Remote{NewServer(a, "localhost"), NewServer(b, "localhost")})
 	if err != nil {
 		t.Fatal(err)
 	}
-	sl := slowListener{l}
+	defer g.Close()
+	g.lastPingAll = time.Now()
 
-	go func() {
-		if err := s2.Serve(&sl); err != nil {
-			t.Fatal(err)
+	cl.Blacklist.Add(a, a.(*net.TCPAddr).Port)
+	conn, err := g.Dial(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.addr != b.String() {
+		t.Fatalf("expected the server which isn't blacklisted to be dialed, got %s", conn.addr)
+	}
+	conn.KeepAlive()
+
+	cl.Blacklist.Add(b, b.(*net.TCPAddr).Port)
+	start := time.Now()
+	if _, err := g.Dial(cl); err != ErrAllBlacklisted {
+		t.Fatalf("expected ErrAllBlacklisted, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("expected the dial to fail fast, took %v", elapsed)
+	}
+	for _, st := range g.Stats() {
+		want := 0
+		if st.Addr == b.String() {
+			want = 1
 		}
-	}()
+		if st.Dials != want || !st.Healthy {
+			t.Fatalf("expected no dial of a blacklisted server: %+v", st)
+		}
+	}
+}
 
-	// wait for server to come up
-	time.Sleep(100 * time.Millisecond)
+func TestHealthEvents(t *testing.T) {
+	cl := newTestClient(t)
+	cl.BreakerThreshold = 1
+	cl.BreakerCooldown = 10 * time.Millisecond
+	cl.LatencyThreshold = 10 * time.Millisecond
+	r := &flakyRemote{Remote: NewServer(newTestServer(t), "localhost")}
+	g, err := NewGroup([]Remote{r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
 
-	// clear cached remotes and set a remote group of normal and slow servers
-	host, p, _ := net.SplitHostPort(sAddr)
-	remote, err = c.LookupServerWithName("localhost", host, p)
+	events, cancel := cl.SubscribeHealth(16)
+	// a subscriber which never reads doesn't stall dials
+	_, cancelStalled := cl.SubscribeHealth(0)
+	defer cancelStalled()
+
+	r.setFailing(true)
+	if _, err := g.Dial(cl); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	r.setFailing(false)
+	time.Sleep(2 * cl.BreakerCooldown)
+	conn, err := g.Dial(cl)
 	if err != nil {
 		t.Fatal(err)
 	}
+	conn.KeepAlive()
+	g.Observe(cl, r, 50*time.Millisecond, nil)
+	for i := 0; i < 5; i++ {
+		g.Observe(cl, r, time.Millisecond, nil)
+	}
+	cancel()
 
-	s2host, s2port, _ := net.SplitHostPort(sl.Addr().String())
-	slowRemote, err := c.LookupServerWithName("localhost", s2host, s2port)
+	var kinds []HealthEventKind
+	for ev := range events {
+		if ev.Remote != r {
+			t.Fatalf("event of unexpected remote %v", ev.Remote)
+		}
+		if (ev.Kind == RemoteDown || ev.Kind == BreakerOpened) && ev.Err == nil {
+			t.Fatalf("expected the error of the failure in %s event", ev.Kind)
+		}
+		if ev.Kind == LatencyAbove && ev.Latency <= cl.LatencyThreshold {
+			t.Fatalf("expected a latency above the threshold, got %v", ev.Latency)
+		}
+		kinds = append(kinds, ev.Kind)
+	}
+	want := []HealthEventKind{RemoteDown, BreakerOpened, BreakerClosed, RemoteUp, LatencyAbove, LatencyBelow}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("expected events %v, got %v", want, kinds)
+	}
+}
+
+func TestDoWithRetry(t *testing.T) {
+	a, b := newTestServer(t), newTestServer(t)
+	g, err := NewGroup([]Remote{NewServer(a, "localhost"), NewServer(b, "localhost")})
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("slow server is at %s:%s", s2host, s2port)
+	defer g.Close()
+	g.lastPingAll = time.Now()
 
-	g, _ := NewGroup([]Remote{remote, slowRemote})
-	c.DefaultRemote = g
-	t.Log("c.DefaultRemote size:", len(c.DefaultRemote.(*Group).remotes))
+	// the operation fails on whichever server is dialed first
+	var tried []string
+	err = c.DoWithRetry(g, func(conn *Conn) error {
+		tried = append(tried, conn.addr)
+		if len(tried) == 1 {
+			return errors.New("connection reset")
+		}
+		return conn.Conn.Ping(nil)
+	}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tried) != 2 || tried[0] == tried[1] {
+		t.Fatalf("expected a retry on the other server, tried %v", tried)
+	}
+	for _, st := range g.Remotes() {
+		if st.Healthy != (st.Addr != tried[0]) {
+			t.Fatalf("failed server not marked: %+v", st)
+		}
+	}
 
-	g.PingAll(c, 1)
+	// errors returned by the server aren't retried
+	calls := 0
+	err = c.DoWithRetry(g, func(conn *Conn) error {
+		calls++
+		return protocol.ErrKeyNotFound
+	}, 2)
+	if err != protocol.ErrKeyNotFound || calls != 1 {
+		t.Fatalf("expected a single attempt returning the server error, got %d attempts and %v", calls, err)
+	}
 
-	// After ping checks, 1st remote must be the normal server.
-	firstRemote := g.remotes[0]
-	conn, err := firstRemote.Dial(c)
+	// the last error is returned once retries are exhausted
+	calls = 0
+	err = c.DoWithRetry(g, func(conn *Conn) error {
+		calls++
+		return fmt.Errorf("failure %d", calls)
+	}, 2)
+	if err == nil || err.Error() != "failure 3" {
+		t.Fatalf("expected the error of the last of 3 attempts, got %v", err)
+	}
+}
+
+func TestGroupObserve(t *testing.T) {
+	fast, slow := NewServer(newTestServer(t), "localhost"), NewServer(newTestServer(t), "localhost")
+	g, err := NewGroup([]Remote{slow, fast})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if conn.addr != sAddr {
-		t.Fatal("bad 1st remote addr:", conn.addr)
+	defer g.Close()
+	cl := newTestClient(t)
+	cl.BreakerThreshold = 3
+	var changes []bool
+	cl.OnStateChange = func(addr net.Addr, serverName string, healthy bool) {
+		changes = append(changes, healthy)
+	}
+	g.Observe(cl, slow, 10*time.Millisecond, nil)
+	g.Observe(cl, fast, time.Millisecond, nil)
+	if best := bestMember(g); best.Remote != fast {
+		t.Fatal("expected the fast member to be preferred")
+	}
+
+	// a burst of slow operations demotes the fast member
+	for i := 0; i < 5; i++ {
+		g.Observe(cl, fast, 50*time.Millisecond, nil)
+	}
+	if best := bestMember(g); best.Remote != slow {
+		t.Fatal("expected slow operations to demote the member")
+	}
+
+	// failed operations open its circuit breaker
+	for i := 0; i < cl.BreakerThreshold; i++ {
+		g.Observe(cl, fast, 0, errors.New("operation failed"))
+	}
+	for _, st := range g.Remotes() {
+		if st.Remote == fast && (st.Healthy || st.Measured || st.LastError == nil) {
+			t.Fatalf("expected failed operations to eject the member: %+v", st)
+		}
+	}
+	g.Lock()
+	available := g.remotes[1].available(cl)
+	g.Unlock()
+	if available {
+		t.Fatal("expected the circuit breaker to be open")
+	}
+	if !reflect.DeepEqual(changes, []bool{false}) {
+		t.Fatalf("expected a single change to unhealthy, got %v", changes)
+	}
+
+	// a successful operation closes it again
+	g.Observe(cl, fast, time.Millisecond, nil)
+	if st := g.Remotes()[1]; !st.Healthy || !st.Measured {
+		t.Fatalf("expected a successful operation to restore the member: %+v", st)
+	}
+
+	// remotes which aren't members are ignored
+	g.Observe(cl, remote, 0, errors.New("operation failed"))
+}
+
+func TestDrain(t *testing.T) {
+	r := NewServer(newTestServer(t), "localhost")
+	g, err := NewGroup([]Remote{r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetDrainTimeout(5 * time.Second)
+
+	// an operation in flight completes before the connection is closed
+	conn, err := r.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := make(chan struct{})
+	go func() {
+		g.Remove(r)
+		close(removed)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-removed:
+		t.Fatal("Remove did not wait for the operation in flight")
+	default:
+	}
+	if err := conn.Conn.Ping(nil); err != nil {
+		t.Fatal("operation in flight failed while draining:", err)
+	}
+	conn.KeepAlive()
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("Remove did not return once the operation completed")
+	}
+	select {
+	case <-conn.closed:
+	default:
+		t.Fatal("drained connection was not closed")
+	}
+
+	// connections are force-closed after the timeout
+	g.Add(r)
+	g.SetDrainTimeout(100 * time.Millisecond)
+	conn, err = r.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.KeepAlive()
+	start := time.Now()
+	g.Close()
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Close took %v to force-close with a 100ms drain timeout", elapsed)
+	}
+	select {
+	case <-conn.closed:
+	default:
+		t.Fatal("connection was not force-closed")
+	}
+
+	// the members of a group are drained at once
+	var remotes []Remote
+	for i := 0; i < 4; i++ {
+		r := NewServer(newTestServer(t), "localhost")
+		conn, err := r.Dial(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.KeepAlive()
+		remotes = append(remotes, r)
+	}
+	g, err = NewGroup(remotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetDrainTimeout(200 * time.Millisecond)
+	start = time.Now()
+	g.Close()
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Fatalf("Close of 4 members took %v with a 200ms drain timeout", elapsed)
+	}
+}
+
+// bestMember returns the member of g which LatencyPolicy ranks first.
+func bestMember(g *Group) *Member {
+	g.RLock()
+	defer g.RUnlock()
+	ranked := append([]*Member(nil), g.remotes...)
+	sort.Stable(byLatency(ranked))
+	return ranked[0]
+}
+
+// newTestServer serves s on a fresh local TCP listener, so that tests which
+// inspect the connection pool don't share pool entries with each other.
+func newTestServer(t testing.TB) net.Addr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr()
+}
+
+// newTestClient returns a client configured like c which tests can modify
+// freely.
+func newTestClient(t testing.TB) *Client {
+	cl, err := NewClientFromFile(clientCert, clientKey, keyserverCA)
+	if err != nil {
+		t.Fatal(err)
 	}
+	cl.Config.Time = fixedCurrentTime
+	cl.Dialer.Timeout = 3 * time.Second
+	return cl
 }
 
 // helper function reads a cert from a file and convert it to a signer
@@ -251,6 +3910,243 @@ func NewRemoteSignerByCertFile(filepath string) (crypto.Signer, error) {
 	return s, err
 }
 
+// testProxy forwards TCP connections to a target address. Blackhole makes it
+// silently discard all traffic on the connections open at that point.
+type testProxy struct {
+	l        net.Listener
+	target   string
+	accepted int32
+
+	mu    sync.Mutex
+	conns []*proxiedConn
+}
+
+type proxiedConn struct {
+	client, server net.Conn
+	blackholed     int32
+}
+
+func newTestProxy(t *testing.T, target string) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProxy{l: l, target: target}
+	go func() {
+		for {
+			client, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", target)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			atomic.AddInt32(&p.accepted, 1)
+			pc := &proxiedConn{client: client, server: server}
+			p.mu.Lock()
+			p.conns = append(p.conns, pc)
+			p.mu.Unlock()
+			go pc.forward(server, client)
+			go pc.forward(client, server)
+		}
+	}()
+	return p
+}
+
+func (pc *proxiedConn) forward(dst, src net.Conn) {
+	defer dst.Close()
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if atomic.LoadInt32(&pc.blackholed) != 0 {
+			continue
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func (p *testProxy) Addr() net.Addr {
+	return p.l.Addr()
+}
+
+func (p *testProxy) Accepted() int {
+	return int(atomic.LoadInt32(&p.accepted))
+}
+
+func (p *testProxy) Blackhole() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.conns {
+		atomic.StoreInt32(&pc.blackholed, 1)
+	}
+}
+
+func (p *testProxy) Close() {
+	p.l.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.conns {
+		pc.client.Close()
+		pc.server.Close()
+	}
+}
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func (l *countingListener) Accepted() int {
+	return int(atomic.LoadInt32(&l.accepted))
+}
+
+// pipeListener accepts the server ends of in-memory pipes made by Dial.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// Dial returns the client end of a new pipe.
+func (l *pipeListener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, errors.New("pipe listener closed")
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("pipe listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+// countingMetrics counts the events it receives.
+type countingMetrics struct {
+	sync.Mutex
+	dials, dialFailures, pingFailures, rejections, latencies, reuses int
+	// handshakes counts the TLS handshakes, and resumptions those which
+	// resumed a session.
+	handshakes, resumptions int
+}
+
+func (m *countingMetrics) Dial(serverName, addr string) {
+	m.Lock()
+	m.dials++
+	m.Unlock()
+}
+
+func (m *countingMetrics) DialFailure(serverName, addr string) {
+	m.Lock()
+	m.dialFailures++
+	m.Unlock()
+}
+
+func (m *countingMetrics) PingFailure(serverName, addr string) {
+	m.Lock()
+	m.pingFailures++
+	m.Unlock()
+}
+
+func (m *countingMetrics) BlacklistRejection(serverName, addr string) {
+	m.Lock()
+	m.rejections++
+	m.Unlock()
+}
+
+func (m *countingMetrics) Latency(serverName, addr string, d time.Duration) {
+	m.Lock()
+	m.latencies++
+	m.Unlock()
+}
+
+func (m *countingMetrics) Reuse(serverName, addr string) {
+	m.Lock()
+	m.reuses++
+	m.Unlock()
+}
+
+func (m *countingMetrics) Handshake(serverName, addr string, resumed bool) {
+	m.Lock()
+	m.handshakes++
+	if resumed {
+		m.resumptions++
+	}
+	m.Unlock()
+}
+
+// flakyRemote wraps a Remote whose dials can be made to fail or slow.
+type flakyRemote struct {
+	Remote
+	failing int32
+	dials   int32
+	// failNext is the number of upcoming dials which fail regardless of
+	// failing.
+	failNext int32
+	// delay slows down each dial.
+	delay time.Duration
+}
+
+func (r *flakyRemote) setFailing(failing bool) {
+	var v int32
+	if failing {
+		v = 1
+	}
+	atomic.StoreInt32(&r.failing, v)
+}
+
+func (r *flakyRemote) Dials() int {
+	return int(atomic.LoadInt32(&r.dials))
+}
+
+func (r *flakyRemote) Dial(c *Client) (*Conn, error) {
+	return r.DialContext(context.Background(), c)
+}
+
+func (r *flakyRemote) DialContext(ctx context.Context, c *Client) (*Conn, error) {
+	atomic.AddInt32(&r.dials, 1)
+	time.Sleep(r.delay)
+	if atomic.AddInt32(&r.failNext, -1) >= 0 || atomic.LoadInt32(&r.failing) != 0 {
+		return nil, errors.New("flaky remote failing")
+	}
+	return r.Remote.DialContext(ctx, c)
+}
+
 // slowListener returns a slowConn
 type slowListener struct {
 	l net.Listener
@@ -310,3 +4206,127 @@ func (sc *slowConn) SetReadDeadline(t time.Time) error {
 func (sc *slowConn) SetWriteDeadline(t time.Time) error {
 	return sc.c.SetWriteDeadline(t)
 }
+
+// memTracer records spans in memory.
+type memTracer struct {
+	sync.Mutex
+	spans []*memSpan
+}
+
+type memSpan struct {
+	tracer *memTracer
+	name   string
+	parent *memSpan
+	attrs  map[string]string
+	errs   []error
+	ended  bool
+}
+
+type memSpanKey struct{}
+
+func (tr *memTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &memSpan{tracer: tr, name: name, attrs: make(map[string]string)}
+	span.parent, _ = ctx.Value(memSpanKey{}).(*memSpan)
+	tr.Lock()
+	tr.spans = append(tr.spans, span)
+	tr.Unlock()
+	return context.WithValue(ctx, memSpanKey{}, span), span
+}
+
+// Spans returns the spans started so far, in order.
+func (tr *memTracer) Spans() []*memSpan {
+	tr.Lock()
+	defer tr.Unlock()
+	return append([]*memSpan(nil), tr.spans...)
+}
+
+func (s *memSpan) SetAttribute(key, value string) {
+	s.tracer.Lock()
+	s.attrs[key] = value
+	s.tracer.Unlock()
+}
+
+func (s *memSpan) RecordError(err error) {
+	s.tracer.Lock()
+	s.errs = append(s.errs, err)
+	s.tracer.Unlock()
+}
+
+func (s *memSpan) End() {
+	s.tracer.Lock()
+	s.ended = true
+	s.tracer.Unlock()
+}
+
+// memLogger records log messages in memory, prefixed by their level.
+type memLogger struct {
+	sync.Mutex
+	messages []string
+}
+
+func (l *memLogger) logf(level, format string, v ...interface{}) {
+	l.Lock()
+	l.messages = append(l.messages, level+": "+fmt.Sprintf(format, v...))
+	l.Unlock()
+}
+
+func (l *memLogger) Debugf(format string, v ...interface{})   { l.logf("debug", format, v...) }
+func (l *memLogger) Infof(format string, v ...interface{})    { l.logf("info", format, v...) }
+func (l *memLogger) Warningf(format string, v ...interface{}) { l.logf("warning", format, v...) }
+func (l *memLogger) Errorf(format string, v ...interface{})   { l.logf("error", format, v...) }
+
+// Logged reports whether a message containing substr was logged.
+func (l *memLogger) Logged(substr string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, msg := range l.messages {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func BenchmarkDialSingle(b *testing.B) {
+	r := NewServer(newTestServer(b), "localhost")
+	defer r.Close()
+	benchmarkDial(b, c, r)
+}
+
+func BenchmarkDialOneMemberGroup(b *testing.B) {
+	g, err := NewGroup([]Remote{NewServer(newTestServer(b), "localhost")})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer g.Close()
+	g.lastPingAll = time.Now()
+	benchmarkDial(b, c, g)
+}
+
+func BenchmarkDialOneMemberGroupFastPath(b *testing.B) {
+	g, err := NewGroup([]Remote{NewServer(newTestServer(b), "localhost")})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer g.Close()
+	cl := newTestClient(b)
+	cl.SingleMemberFastPath = true
+	benchmarkDial(b, cl, g)
+}
+
+// benchmarkDial measures the dials of r served by its pooled connection.
+func benchmarkDial(b *testing.B, cl *Client, r Remote) {
+	conn, err := r.Dial(cl)
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn.KeepAlive()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := r.Dial(cl)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.KeepAlive()
+	}
+}
@@ -0,0 +1,63 @@
+package client
+
+import "context"
+
+// A Tracer starts spans around the DNS lookups, dials and health check pings
+// of a Client, so that they show up in the trace of the request they're made
+// for. It's a minimal interface which an adapter can implement on top of a
+// tracing library, as package oteltrace does for OpenTelemetry.
+// Implementations must be safe for concurrent use.
+type Tracer interface {
+	// Start starts a span named name, as a child of the span in ctx, if
+	// any, and returns a context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// A Span is a unit of work started by a Tracer.
+type Span interface {
+	// SetAttribute annotates the span, e.g. with the address dialed.
+	SetAttribute(key, value string)
+	// RecordError records that the work failed with err.
+	RecordError(err error)
+	// End completes the span.
+	End()
+}
+
+// Names of the spans started by a Client.
+const (
+	spanResolve   = "keyless.resolve"
+	spanGroupDial = "keyless.group_dial"
+	spanDial      = "keyless.dial"
+	spanPing      = "keyless.ping"
+)
+
+// nopTracer starts spans which discard everything.
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(key, value string) {}
+func (nopSpan) RecordError(err error)          {}
+func (nopSpan) End()                           {}
+
+func (c *Client) tracer() Tracer {
+	if c.Tracer == nil {
+		return nopTracer{}
+	}
+	return c.Tracer
+}
+
+// endSpan records the outcome of the work of span, then ends it.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.SetAttribute("outcome", "error")
+		span.RecordError(err)
+	} else {
+		span.SetAttribute("outcome", "ok")
+	}
+	span.End()
+}
@@ -113,6 +113,9 @@ type Conn struct {
 	nextID uint32
 
 	opTimeout time.Duration
+	// slots, if non-nil, holds a value for each operation in flight, which
+	// is bounded by its capacity.
+	slots chan struct{}
 
 	// To lock up the connection, always acquire in the following order to avoid
 	// deadlock: writeMtx, mapMtx (don't acquire readMtx).
@@ -138,6 +141,19 @@ func NewConn(inner net.Conn) *Conn {
 	return NewConnTimeout(inner, defaultOpTimeout)
 }
 
+// SetMaxInflight limits the number of operations in flight on c to n, so that
+// a server isn't sent more requests at once than it can take. Once the limit
+// is reached, DoOperation waits for an operation to complete first; the wait
+// counts against the operation timeout. A limit below 1 means no limit. It
+// must be called before c is used.
+func (c *Conn) SetMaxInflight(n int) {
+	if n < 1 {
+		c.slots = nil
+		return
+	}
+	c.slots = make(chan struct{}, n)
+}
+
 // Close closes the connection and causes all outstanding operations to fail.
 func (c *Conn) Close() error {
 	c.writeMtx.Lock()
@@ -219,6 +235,18 @@ func (c *Conn) DoOperation(op protocol.Operation) (*protocol.Operation, error) {
 	// we will never receive.
 	response := make(chan *protocol.Operation, 1)
 
+	end := time.Now().Add(c.opTimeout)
+	if c.slots != nil {
+		timer := time.NewTimer(c.opTimeout)
+		select {
+		case c.slots <- struct{}{}:
+			timer.Stop()
+		case <-timer.C:
+			return nil, fmt.Errorf("operation timed out waiting for one of %d operations in flight to complete", cap(c.slots))
+		}
+		defer func() { <-c.slots }()
+	}
+
 	// Acquire the map mutex and only release it once we're done with the map.
 	c.mapMtx.Lock()
 	if c.closed {
@@ -246,7 +274,6 @@ func (c *Conn) DoOperation(op protocol.Operation) (*protocol.Operation, error) {
 		c.writeMtx.Unlock()
 		return nil, ErrClosed
 	}
-	end := time.Now().Add(c.opTimeout)
 	err := c.conn.SetWriteDeadline(end)
 	if err != nil {
 		c.writeMtx.Unlock()
@@ -259,8 +286,8 @@ func (c *Conn) DoOperation(op protocol.Operation) (*protocol.Operation, error) {
 	}
 
 	// Take into account how long we've already been waiting since the beginning
-	// of writing to the connection (which could have taken a while if the
-	// connection was backed up).
+	// of the operation, including for a slot and for writing to the connection
+	// (which could have taken a while if the connection was backed up).
 	left := end.Sub(time.Now())
 	select {
 	case op := <-response: